@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Video codecs by BITMAPINFOHEADER compression fourcc, matched without case
+var AVI_VIDEO_CODECS = map[string]string{
+	"XVID": "mpeg4",
+	"DIVX": "mpeg4",
+	"DX50": "mpeg4",
+	"FMP4": "mpeg4",
+	"MP4V": "mpeg4",
+	"DIV3": "msmpeg4v3",
+	"MP43": "msmpeg4v3",
+	"H264": "h264",
+	"X264": "h264",
+	"AVC1": "h264",
+	"HEVC": "hevc",
+	"H265": "hevc",
+	"HVC1": "hevc",
+	"MJPG": "mjpeg",
+	"MPG2": "mpeg2video",
+	"WMV3": "wmv3",
+	"WVC1": "vc1",
+}
+
+// Audio codecs by WAVEFORMATEX format tag
+var AVI_AUDIO_CODECS = map[uint16]string{
+	0x0003: "pcm_f32le",
+	0x0050: "mp2",
+	0x0055: "mp3",
+	0x00ff: "aac",
+	0x0161: "wmav2",
+	0x0162: "wmapro",
+	0x1610: "aac",
+	0x2000: "ac3",
+	0x2001: "dts",
+	0x674f: "vorbis",
+	0x6750: "vorbis",
+	0x6751: "vorbis",
+	0xf1ac: "flac",
+}
+
+// Format tags by INFO list chunk
+var AVI_INFO_TAGS = map[string]string{
+	"INAM": "title",
+	"IART": "artist",
+	"ICMT": "comment",
+	"ICOP": "copyright",
+	"ICRD": "date",
+	"IGNR": "genre",
+	"ILNG": "language",
+	"ISFT": "encoder",
+}
+
+// Bytes of the first video chunk read to find the codec header
+const aviHeaderBytes = 4096
+
+// Largest chunk whose content is read whole
+const aviMaxChunkContent = 1 << 20
+
+// Returned from an eachChunk callback to stop early
+var errStopChunks = errors.New("stop")
+
+// aviChunk is the position of a RIFF chunk: its id, list type if it is a list,
+// and where its content starts and ends
+type aviChunk struct {
+	ID    string
+	List  string
+	Start int64
+	End   int64
+}
+
+type aviReader struct {
+	r *budgetReader
+}
+
+type aviStream struct {
+	Stream
+	number              int
+	scale, rate, length uint32
+}
+
+// Read the stream information of an AVI file from its hdrl list, and the
+// codec header from the first video chunk of its movi list. The movi list is
+// skipped over to reach an INFO list after it.
+func probeAVI(r *budgetReader) (*FFProbeResponse, error) {
+	a := &aviReader{r: r}
+	riff, err := a.chunk(0, r.size)
+	if err == errBudgetExceeded {
+		return nil, err
+	} else if err != nil || riff.ID != "RIFF" || riff.List != "AVI " {
+		return nil, errNotThisFormat
+	}
+
+	response := &FFProbeResponse{
+		Format: Format{
+			FormatName:     "avi",
+			FormatLongName: "AVI (Audio Video Interleaved)",
+			ProbeScore:     100,
+			Tags:           map[string]string{},
+		},
+	}
+	var streams []*aviStream
+	err = a.eachChunk(riff.Start, riff.End, func(chunk aviChunk) error {
+		switch chunk.List {
+		case "hdrl":
+			found, err := a.readHeaderList(chunk)
+			if err != nil {
+				return err
+			}
+			streams = found
+		case "INFO":
+			return a.readInfo(chunk, response.Format.Tags)
+		case "movi":
+			return a.readFirstVideoChunk(chunk, streams)
+		}
+		return nil
+	})
+	// The INFO list and the index after the movi list are worth a read but
+	// not a failure
+	if err == errBudgetExceeded && len(streams) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) == 0 {
+		return nil, fmt.Errorf("no stream headers found")
+	}
+
+	var duration float64
+	for i, s := range streams {
+		s.Index = i
+		if s.rate > 0 && s.scale > 0 {
+			seconds := float64(s.length) * float64(s.scale) / float64(s.rate)
+			s.TimeBase = reducedFraction(int64(s.scale), int64(s.rate))
+			s.DurationTS = int64(s.length)
+			s.Duration = fmt.Sprintf("%.6f", seconds)
+			duration = max(duration, seconds)
+			if s.CodecType == "video" {
+				s.RFrameRate = reducedFraction(int64(s.rate), int64(s.scale))
+				s.AvgFrameRate = s.RFrameRate
+				s.NbFrames = strconv.FormatUint(uint64(s.length), 10)
+			}
+		}
+		finishNativeStream(&s.Stream)
+		response.Streams = append(response.Streams, s.Stream)
+	}
+	response.Format.StartTime = "0.000000"
+	if duration > 0 {
+		response.Format.Duration = fmt.Sprintf("%.6f", duration)
+	}
+	return response, nil
+}
+
+// Read the header of the chunk at an offset, which must end before end
+func (a *aviReader) chunk(offset, end int64) (aviChunk, error) {
+	var header [12]byte
+	n, err := a.r.ReadAt(header[:], offset)
+	if n < 8 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return aviChunk{}, err
+	}
+	chunk := aviChunk{ID: string(header[:4]), Start: offset + 8}
+	chunk.End = chunk.Start + int64(binary.LittleEndian.Uint32(header[4:8]))
+	if chunk.ID == "RIFF" || chunk.ID == "LIST" {
+		if n < 12 {
+			return aviChunk{}, io.ErrUnexpectedEOF
+		}
+		chunk.List = string(header[8:12])
+		chunk.Start += 4
+	}
+	// A truncated file still has its headers
+	chunk.End = min(chunk.End, end)
+	if chunk.End < chunk.Start {
+		return aviChunk{}, fmt.Errorf("invalid %q chunk at %d", chunk.ID, offset)
+	}
+	return chunk, nil
+}
+
+// Call fn for each chunk between two offsets
+func (a *aviReader) eachChunk(start, end int64, fn func(chunk aviChunk) error) error {
+	for offset := start; offset+8 <= end; {
+		chunk, err := a.chunk(offset, end)
+		if err != nil {
+			return err
+		}
+		if err := fn(chunk); err != nil {
+			return err
+		}
+		// Chunks are padded to an even size
+		offset = chunk.End + chunk.End&1
+	}
+	return nil
+}
+
+func (a *aviReader) content(chunk aviChunk) ([]byte, error) {
+	if chunk.End-chunk.Start > aviMaxChunkContent {
+		return nil, fmt.Errorf("%q chunk of %d bytes is too large", chunk.ID, chunk.End-chunk.Start)
+	}
+	buf := make([]byte, chunk.End-chunk.Start)
+	if _, err := a.r.ReadAt(buf, chunk.Start); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (a *aviReader) readHeaderList(hdrl aviChunk) ([]*aviStream, error) {
+	var streams []*aviStream
+	number := 0
+	err := a.eachChunk(hdrl.Start, hdrl.End, func(chunk aviChunk) error {
+		if chunk.List != "strl" {
+			return nil
+		}
+		s := &aviStream{
+			Stream: Stream{Tags: map[string]string{}, Disposition: newDisposition()},
+			number: number,
+		}
+		known := false
+		err := a.eachChunk(chunk.Start, chunk.End, func(chunk aviChunk) error {
+			data, err := a.content(chunk)
+			if err != nil {
+				return err
+			}
+			switch chunk.ID {
+			case "strh":
+				if len(data) < 36 {
+					return nil
+				}
+				switch string(data[:4]) {
+				case "vids":
+					s.CodecType = "video"
+				case "auds":
+					s.CodecType = "audio"
+				}
+				s.scale = binary.LittleEndian.Uint32(data[20:24])
+				s.rate = binary.LittleEndian.Uint32(data[24:28])
+				s.length = binary.LittleEndian.Uint32(data[32:36])
+			case "strf":
+				switch s.CodecType {
+				case "video":
+					known = readBitmapInfo(&s.Stream, data)
+				case "audio":
+					known = readWaveFormat(&s.Stream, data)
+				}
+			case "strn":
+				if name := strings.TrimRight(string(data), "\x00"); name != "" {
+					s.Tags["title"] = name
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Streams ffprobe would not list still count for the chunk ids of the others
+		number++
+		if known {
+			streams = append(streams, s)
+		}
+		return nil
+	})
+	return streams, err
+}
+
+// Fill in a video stream from its BITMAPINFOHEADER
+func readBitmapInfo(stream *Stream, data []byte) bool {
+	if len(data) < 20 {
+		return false
+	}
+	stream.Width = int(int32(binary.LittleEndian.Uint32(data[4:8])))
+	stream.Height = int(int32(binary.LittleEndian.Uint32(data[8:12])))
+	if stream.Height < 0 {
+		stream.Height = -stream.Height
+	}
+	stream.CodedWidth, stream.CodedHeight = stream.Width, stream.Height
+	tag := binary.LittleEndian.Uint32(data[16:20])
+	stream.CodecTag = fmt.Sprintf("0x%04x", tag)
+	stream.CodecTagString = fourccString(tag)
+	stream.CodecName = AVI_VIDEO_CODECS[strings.ToUpper(string(data[16:20]))]
+	if tag == 0 {
+		stream.CodecName = "rawvideo"
+	}
+	if stream.CodecName == "" {
+		return false
+	}
+	if stream.CodecName != "rawvideo" {
+		stream.PixFmt = "yuv420p"
+	}
+	stream.Refs = 1
+	setAspectRatios(stream, [2]int64{1, 1})
+	return true
+}
+
+// Fill in an audio stream from its WAVEFORMATEX
+func readWaveFormat(stream *Stream, data []byte) bool {
+	if len(data) < 16 {
+		return false
+	}
+	format := binary.LittleEndian.Uint16(data[0:2])
+	stream.Channels = int(binary.LittleEndian.Uint16(data[2:4]))
+	stream.SampleRate = strconv.Itoa(int(binary.LittleEndian.Uint32(data[4:8])))
+	stream.BitRate = strconv.Itoa(int(binary.LittleEndian.Uint32(data[8:12])) * 8)
+	bits := int(binary.LittleEndian.Uint16(data[14:16]))
+	stream.CodecTag = fmt.Sprintf("0x%04x", format)
+	stream.CodecTagString = fourccString(uint32(format))
+
+	stream.CodecName = AVI_AUDIO_CODECS[format]
+	if format == 0x0001 {
+		stream.CodecName = map[int]string{8: "pcm_u8", 16: "pcm_s16le", 24: "pcm_s24le", 32: "pcm_s32le"}[bits]
+		stream.SampleFmt = map[int]string{8: "u8", 16: "s16", 24: "s32", 32: "s32"}[bits]
+		stream.BitsPerSample = bits
+	}
+	if stream.CodecName == "" {
+		return false
+	}
+	if len(data) >= 18 && format != 0x0001 {
+		if extra := int(binary.LittleEndian.Uint16(data[16:18])); extra > 0 && 18+extra <= len(data) {
+			stream.ExtradataSize = extra
+		}
+	}
+	return true
+}
+
+// Read the first chunk of the video stream in the movi list, whose codec
+// header has what the stream headers leave out, like the profile
+func (a *aviReader) readFirstVideoChunk(movi aviChunk, streams []*aviStream) error {
+	var video *aviStream
+	for _, s := range streams {
+		if s.CodecType == "video" {
+			video = s
+			break
+		}
+	}
+	if video == nil {
+		return nil
+	}
+
+	prefix := fmt.Sprintf("%02d", video.number)
+	chunks := 0
+	var visit func(chunk aviChunk) error
+	visit = func(chunk aviChunk) error {
+		chunks++
+		if chunks > 16 {
+			return errStopChunks
+		}
+		// Interleaved files group their chunks in "rec " lists
+		if chunk.List == "rec " {
+			return a.eachChunk(chunk.Start, chunk.End, visit)
+		}
+		if chunk.List != "" || !strings.HasPrefix(chunk.ID, prefix) || chunk.End == chunk.Start {
+			return nil
+		}
+		data := make([]byte, min(chunk.End-chunk.Start, aviHeaderBytes))
+		if _, err := a.r.ReadAt(data, chunk.Start); err != nil {
+			return err
+		}
+		parseVideoHeader(&video.Stream, data)
+		return errStopChunks
+	}
+	err := a.eachChunk(movi.Start, movi.End, visit)
+	if err == errStopChunks || err == errBudgetExceeded {
+		return nil
+	}
+	return err
+}
+
+func (a *aviReader) readInfo(info aviChunk, tags map[string]string) error {
+	return a.eachChunk(info.Start, info.End, func(chunk aviChunk) error {
+		key, known := AVI_INFO_TAGS[chunk.ID]
+		if !known {
+			return nil
+		}
+		data, err := a.content(chunk)
+		if err != nil {
+			return err
+		}
+		if value := strings.TrimRight(string(data), "\x00"); value != "" {
+			tags[key] = value
+		}
+		return nil
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// A RIFF chunk holding its content, padded to an even size
+func riffChunk(id string, content ...[]byte) []byte {
+	data := bytes.Join(content, nil)
+	chunk := binary.LittleEndian.AppendUint32([]byte(id), uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 != 0 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func riffList(listType string, chunks ...[]byte) []byte {
+	return riffChunk("LIST", append([][]byte{[]byte(listType)}, chunks...)...)
+}
+
+// Little-endian fields of a header: uint16 and uint32 values, strings and byte
+// slices as they are
+func riffFields(fields ...interface{}) []byte {
+	var out []byte
+	for _, field := range fields {
+		switch value := field.(type) {
+		case uint16:
+			out = binary.LittleEndian.AppendUint16(out, value)
+		case uint32:
+			out = binary.LittleEndian.AppendUint32(out, value)
+		case string:
+			out = append(out, value...)
+		case []byte:
+			out = append(out, value...)
+		}
+	}
+	return out
+}
+
+// A stream header list, with the scale, rate and length of the stream
+func aviStreamList(kind, handler string, scale, rate, length uint32, format []byte, name string) []byte {
+	header := riffFields(kind, handler, make([]byte, 12), scale, rate, uint32(0), length, make([]byte, 20))
+	chunks := [][]byte{riffChunk("strh", header), riffChunk("strf", format)}
+	if name != "" {
+		chunks = append(chunks, riffChunk("strn", []byte(name+"\x00")))
+	}
+	return riffList("strl", chunks...)
+}
+
+// An AVI file with a text stream ffprobe does not list, an XviD video and an
+// MP3 and a German AC-3 audio, whose first video chunk is in a rec list after
+// padding, and an INFO list after the movi list
+func aviFixtureWith(padding []byte) []byte {
+	bitmapInfo := riffFields(uint32(40), uint32(720), uint32(0xfffffed0), uint16(1), uint16(12), "XVID", make([]byte, 20))
+	mp3Format := riffFields(uint16(0x55), uint16(2), uint32(48000), uint32(16000), uint16(1), uint16(0), uint16(12), make([]byte, 12))
+	ac3Format := riffFields(uint16(0x2000), uint16(6), uint32(48000), uint32(56000), uint16(1792), uint16(0), uint16(0))
+	hdrl := riffList("hdrl",
+		riffChunk("avih", make([]byte, 56)),
+		aviStreamList("txts", "\x00\x00\x00\x00", 1, 1, 1, []byte{0}, ""),
+		// 1000 frames of 1001/24000 s
+		aviStreamList("vids", "xvid", 1001, 24000, 1000, bitmapInfo, "Video"),
+		aviStreamList("auds", "\x00\x00\x00\x00", 1152, 48000, 1738, mp3Format, ""),
+		aviStreamList("auds", "\x00\x00\x00\x00", 1, 56000, 2335666, ac3Format, "Deutsch"),
+	)
+	movi := riffList("movi",
+		riffChunk("JUNK", padding),
+		riffChunk("02wb", []byte{0xff, 0xfb, 0x90, 0x64}),
+		riffList("rec ",
+			riffChunk("02wb", []byte{0xff, 0xfb, 0x90, 0x64}),
+			riffChunk("01dc", []byte{0, 0, 1, 0xb0, 0xf5, 0, 0, 1, 0xb5}),
+		),
+	)
+	info := riffList("INFO",
+		riffChunk("INAM", []byte("A Movie\x00")),
+		riffChunk("ISFT", []byte("VirtualDubMod 1.5\x00")),
+	)
+	return riffChunk("RIFF", []byte("AVI "), hdrl, movi, riffChunk("idx1", make([]byte, 16)), info)
+}
+
+func TestProbeAVI(t *testing.T) {
+	response, err := probeBytes(probeAVI, aviFixtureWith(nil), int64(NATIVE_PROBE_BUDGET))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	format := response.Format
+	if format.FormatName != "avi" || format.Duration != "41.712000" || format.Tags["title"] != "A Movie" ||
+		format.Tags["encoder"] != "VirtualDubMod 1.5" {
+		t.Errorf("format %+v", format)
+	}
+	if len(response.Streams) != 3 {
+		t.Fatalf("%d streams, want 3 without the text stream", len(response.Streams))
+	}
+	video, mp3, ac3 := response.Streams[0], response.Streams[1], response.Streams[2]
+	tests := []struct {
+		field, got, want string
+	}{
+		{"video codec", video.CodecName, "mpeg4"},
+		{"video tag", video.CodecTagString, "XVID"},
+		{"video profile", video.Profile, "Advanced Simple Profile"},
+		{"video size", fmt.Sprintf("%dx%d", video.Width, video.Height), "720x304"},
+		{"video frame rate", video.RFrameRate, "24000/1001"},
+		{"video frames", video.NbFrames, "1000"},
+		{"video duration", video.Duration, "41.708333"},
+		{"video time base", video.TimeBase, "1001/24000"},
+		{"video aspect ratio", video.DisplayAspectRatio, "45:19"},
+		{"video title", video.Tags["title"], "Video"},
+		{"mp3 codec", mp3.CodecName, "mp3"},
+		{"mp3 tag", mp3.CodecTag, "0x0055"},
+		{"mp3 sample rate", mp3.SampleRate, "48000"},
+		{"mp3 bit rate", mp3.BitRate, "128000"},
+		{"mp3 duration", mp3.Duration, "41.712000"},
+		{"ac3 codec", ac3.CodecName, "ac3"},
+		{"ac3 channel layout", ac3.ChannelLayout, "5.1(side)"},
+		{"ac3 bit rate", ac3.BitRate, "448000"},
+		{"ac3 title", ac3.Tags["title"], "Deutsch"},
+		{"ac3 duration", ac3.Duration, "41.708321"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s is %q, want %q", test.field, test.got, test.want)
+		}
+	}
+	if video.Level != 5 || mp3.Channels != 2 || mp3.ExtradataSize != 12 || ac3.Channels != 6 {
+		t.Errorf("video level %d, mp3 channels %d and extradata %d, ac3 channels %d",
+			video.Level, mp3.Channels, mp3.ExtradataSize, ac3.Channels)
+	}
+}
+
+func TestProbeAVIBudget(t *testing.T) {
+	// A first video chunk and an INFO list beyond the budget are left out
+	data := aviFixtureWith(make([]byte, 4*nativeChunkSize))
+	response, err := probeBytes(probeAVI, data, nativeChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Streams[0].Profile != "" || response.Format.Tags["title"] != "" || response.Streams[0].Width != 720 {
+		t.Errorf("profile %q and title %q beyond the budget", response.Streams[0].Profile, response.Format.Tags["title"])
+	}
+	if response, err := probeBytes(probeAVI, data, int64(len(data))); err != nil ||
+		response.Streams[0].Profile != "Advanced Simple Profile" || response.Format.Tags["title"] != "A Movie" {
+		t.Errorf("chunks within the budget were not read: %v", err)
+	}
+
+	// Stream headers beyond it fail the probe
+	data = riffChunk("RIFF", []byte("AVI "), riffChunk("JUNK", make([]byte, 2*nativeChunkSize)), aviFixtureWith(nil)[12:])
+	if _, err := probeBytes(probeAVI, data, nativeChunkSize); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("headers beyond the budget gave %v, want %v", err, errBudgetExceeded)
+	}
+}
+
+func TestProbeAVIErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"not RIFF", []byte("\x1aE\xdf\xa3 a matroska file"), errNotThisFormat},
+		{"WAVE", riffChunk("RIFF", []byte("WAVE"), riffChunk("fmt ", make([]byte, 16))), errNotThisFormat},
+		{"short", []byte("RIFF"), errNotThisFormat},
+		{"no stream headers", riffChunk("RIFF", []byte("AVI "), riffList("movi")), nil},
+		{"unknown codecs only", riffChunk("RIFF", []byte("AVI "), riffList("hdrl",
+			aviStreamList("vids", "abcd", 1, 25, 1, riffFields(uint32(40), uint32(2), uint32(2), uint32(0), "abcd"), ""))), nil},
+		{"list shorter than its type", riffChunk("RIFF", []byte("AVI "), riffFields("LIST", uint32(2), "hdrl")), nil},
+	}
+	for _, test := range tests {
+		_, err := probeBytes(probeAVI, test.data, int64(NATIVE_PROBE_BUDGET))
+		if err == nil || test.want != nil && err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func FuzzProbeAVI(f *testing.F) {
+	fuzzReader(f, probeAVI, aviFixtureWith(nil), aviFixtureWith(make([]byte, 3)))
+}
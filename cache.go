@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Directory holding cached real ffprobe results; set it to an empty value to disable the cache
+var CACHE_DIR = envOrDefault("FFPROBE_SHIM_CACHE_DIR", "/tmp/ffprobe-shim-cache")
+
+// Arguments used for the canonical real probe whose result is cached; every
+// request is answered from this by reformatting it
+var CACHE_PROBE_ARGS = []string{
+	"-v", "error",
+	"-hide_banner",
+	"-print_format", "json",
+	"-show_format",
+	"-show_streams",
+	"-show_chapters",
+	"-show_programs",
+}
+
+// Sources of cached results
+const (
+	cacheSourceReal    = "real"
+	cacheSourceDerived = "derived" // From the real probe of a sibling episode
+	cacheSourceNative  = "native"  // From the container headers
+)
+
+// Upper bound on entries kept in memory by the daemon
+const memoryCacheLimit = 10000
+
+// In-memory copy of the cache, enabled by the daemon to avoid rereading entries
+var memoryCache struct {
+	sync.Mutex
+	entries map[string]*CacheEntry
+}
+
+func enableMemoryCache() {
+	memoryCache.Lock()
+	defer memoryCache.Unlock()
+	memoryCache.entries = make(map[string]*CacheEntry)
+}
+
+func memoryCacheGet(key string) (*CacheEntry, bool) {
+	memoryCache.Lock()
+	defer memoryCache.Unlock()
+	entry, found := memoryCache.entries[key]
+	return entry, found
+}
+
+func memoryCachePut(key string, entry *CacheEntry) {
+	memoryCache.Lock()
+	defer memoryCache.Unlock()
+	if memoryCache.entries == nil {
+		return
+	}
+	// Entries of replaced files are never looked up again, so start over
+	// rather than grow without bound
+	if len(memoryCache.entries) >= memoryCacheLimit {
+		memoryCache.entries = make(map[string]*CacheEntry)
+	}
+	memoryCache.entries[key] = entry
+}
+
+// CacheEntry is the on-disk form of a cached probe result
+type CacheEntry struct {
+	Path     string          `json:"path"`
+	Size     int64           `json:"size"`
+	ModTime  int64           `json:"mtime"`
+	Source   string          `json:"source"`
+	Created  time.Time       `json:"created"`
+	Response json.RawMessage `json:"response"`
+}
+
+// Normalize a path so that different spellings of the same file share an entry
+func normalizeCachePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// Cache key: the normalized path plus size and modification time, so that a
+// replaced file is probed again
+func cacheKey(path string, info os.FileInfo) string {
+	sum := sha256.Sum256([]byte(normalizeCachePath(path) + "\x00" +
+		strconv.FormatInt(info.Size(), 10) + "\x00" +
+		strconv.FormatInt(info.ModTime().UnixNano(), 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+func cacheFilePath(key string) string {
+	return filepath.Join(CACHE_DIR, key[:2], key+".json")
+}
+
+// Look up a cached result for a file
+func loadCachedEntry(path string, info os.FileInfo) (*CacheEntry, bool) {
+	if CACHE_DIR == "" {
+		return nil, false
+	}
+
+	key := cacheKey(path, info)
+	if entry, found := memoryCacheGet(key); found {
+		return entry, true
+	}
+
+	data, err := os.ReadFile(cacheFilePath(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading cache entry for %s: %v", path, err)
+		}
+		return nil, false
+	}
+
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Printf("Ignoring corrupt cache entry for %s: %v", path, err)
+		return nil, false
+	}
+	memoryCachePut(key, &entry)
+	return &entry, true
+}
+
+// Decode the probe result stored in a cache entry
+func (entry *CacheEntry) decodeResponse() (*FFProbeResponse, error) {
+	return decodeProbeResponse(entry.Response)
+}
+
+// jsonObject is a JSON object with its members in the order they were printed
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	Key   string
+	Value interface{} // string, json.Number, bool, nil, jsonObject or []interface{}
+}
+
+func (object jsonObject) get(key string) interface{} {
+	for _, member := range object {
+		if member.Key == key {
+			return member.Value
+		}
+	}
+	return nil
+}
+
+// Decode an ffprobe JSON result. The output of the real ffprobe is kept as
+// it printed it, so that it is reprinted with every field, zero values and
+// the order of tags included, rather than only with what FFProbeResponse
+// has room for.
+func decodeProbeResponse(data []byte) (*FFProbeResponse, error) {
+	var response FFProbeResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	value, err := decodeOrderedJSON(decoder)
+	if err != nil {
+		return nil, err
+	}
+	raw, _ := value.(jsonObject)
+
+	response.Format.raw, _ = raw.get("format").(jsonObject)
+	streams := jsonObjects(raw.get("streams"))
+	if len(streams) == len(response.Streams) {
+		for i := range response.Streams {
+			response.Streams[i].raw = streams[i]
+		}
+	}
+	programs := jsonObjects(raw.get("programs"))
+	if len(programs) == len(response.Programs) {
+		for i := range response.Programs {
+			program := &response.Programs[i]
+			program.raw = programs[i]
+			streams := jsonObjects(program.raw.get("streams"))
+			if len(streams) == len(program.Streams) {
+				for j := range program.Streams {
+					program.Streams[j].raw = streams[j]
+				}
+			}
+		}
+	}
+	chapters := jsonObjects(raw.get("chapters"))
+	if len(chapters) == len(response.Chapters) {
+		for i := range response.Chapters {
+			response.Chapters[i].raw = chapters[i]
+		}
+	}
+	return &response, nil
+}
+
+// Forget what the real ffprobe printed, for a response changed since
+func (response *FFProbeResponse) dropRaw() {
+	response.Format.raw = nil
+	for i := range response.Streams {
+		response.Streams[i].raw = nil
+	}
+	for i := range response.Programs {
+		response.Programs[i].raw = nil
+		for j := range response.Programs[i].Streams {
+			response.Programs[i].Streams[j].raw = nil
+		}
+	}
+	for i := range response.Chapters {
+		response.Chapters[i].raw = nil
+	}
+}
+
+// Decode the next JSON value, keeping objects in order
+func decodeOrderedJSON(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := jsonObject{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrderedJSON(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, jsonMember{Key: key.(string), Value: value})
+		}
+		_, err := decoder.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for decoder.More() {
+			value, err := decodeOrderedJSON(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := decoder.Token()
+		return array, err
+	}
+	return token, nil
+}
+
+// The objects of a JSON array; nil unless every element is one
+func jsonObjects(value interface{}) []jsonObject {
+	array, _ := value.([]interface{})
+	objects := make([]jsonObject, 0, len(array))
+	for _, element := range array {
+		object, ok := element.(jsonObject)
+		if !ok {
+			return nil
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+// Load and decode a cached result for a file
+func loadCachedResponse(path string, info os.FileInfo) (*FFProbeResponse, bool) {
+	entry, found := loadCachedEntry(path, info)
+	if !found {
+		return nil, false
+	}
+	response, err := entry.decodeResponse()
+	if err != nil {
+		log.Printf("Ignoring undecodable cache entry for %s: %v", path, err)
+		return nil, false
+	}
+	log.Printf("Cache hit for %s (source: %s, created %s)", path, entry.Source, entry.Created.Format(time.RFC3339))
+	return response, true
+}
+
+// Store a probe result, atomically replacing any previous entry
+func storeCachedResponse(path string, info os.FileInfo, response []byte, source string) error {
+	if CACHE_DIR == "" {
+		return nil
+	}
+
+	entry := CacheEntry{
+		Path:     normalizeCachePath(path),
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UnixNano(),
+		Source:   source,
+		Created:  time.Now().UTC(),
+		Response: json.RawMessage(response),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := cacheKey(path, info)
+	target := cacheFilePath(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".entry-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	memoryCachePut(key, &entry)
+	log.Printf("Cached %s probe result for %s", source, path)
+	return nil
+}
+
+// Run the real ffprobe with the canonical arguments, once a slot is free,
+// and return its JSON output
+func runRealProbe(path string, slot slotRequest) ([]byte, error) {
+	if _, err := os.Stat(REAL_FFPROBE); err != nil {
+		return nil, fmt.Errorf("real ffprobe not available: %w", err)
+	}
+
+	release, err := acquireRealProbeSlot(slot)
+	if err == errSlotTimeout {
+		return nil, err
+	} else if err != nil {
+		log.Printf("Error waiting for a real ffprobe slot, running anyway: %v", err)
+	} else {
+		defer release()
+	}
+
+	args := append(append([]string{}, CACHE_PROBE_ARGS...), "file:"+path)
+	log.Printf("Running real probe: %s %v", REAL_FFPROBE, args)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(REAL_FFPROBE, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runChild(cmd, nil); err == errRealProbeTimeout {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("real probe failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	// Make sure the output decodes before it is trusted
+	var response FFProbeResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("real probe returned invalid JSON: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// Probe a file with the real ffprobe and cache the result. Concurrent calls
+// for the same file, from any process, share a single real probe: the first
+// one holds a lock on the file's key while the others wait for it and then
+// read its result from the cache.
+func probeAndCache(path string, info os.FileInfo, slot slotRequest) (*FFProbeResponse, error) {
+	key := cacheKey(path, info)
+	lockPath := filepath.Join(CACHE_DIR, "locks", key+".lock")
+
+	lock, err := tryLockFile(lockPath)
+	if err == errLocked {
+		log.Printf("Waiting for the probe of %s already in flight", path)
+		start := time.Now()
+		lock, err = lockFile(lockPath)
+		if err == nil {
+			log.Printf("Probe of %s in flight finished after %s", path, time.Since(start).Round(time.Millisecond))
+		}
+	}
+	if err != nil {
+		// Probing twice is better than not at all
+		log.Printf("Error locking %s, probing without deduplication: %v", lockPath, err)
+	} else {
+		defer func() {
+			os.Remove(lockPath)
+			lock.Close()
+		}()
+	}
+
+	if entry, found := loadCachedEntry(path, info); found && entry.Source == cacheSourceReal {
+		if response, err := entry.decodeResponse(); err == nil {
+			log.Printf("Using result of concurrent probe of %s", path)
+			return response, nil
+		}
+	}
+
+	output, err := runRealProbe(path, slot)
+	if err != nil {
+		return nil, err
+	}
+	if err := storeCachedResponse(path, info, output, cacheSourceReal); err != nil {
+		log.Printf("Error caching probe result for %s: %v", path, err)
+	}
+
+	return decodeProbeResponse(output)
+}
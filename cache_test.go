@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Point the shim at a fake real ffprobe that prints testResponse after a
+// short delay and logs each call, and at an empty cache. Returns the file
+// the calls are logged to.
+func fakeRealProbe(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	output, err := json.Marshal(testResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "output.json"), output, 0644); err != nil {
+		t.Fatal(err)
+	}
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$*\" >> " + calls + "\nsleep 0.5\ncat " + filepath.Join(dir, "output.json") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	realProbe, cacheDir := REAL_FFPROBE, CACHE_DIR
+	REAL_FFPROBE, CACHE_DIR = filepath.Join(dir, "ffprobe"), filepath.Join(dir, "cache")
+	t.Cleanup(func() { REAL_FFPROBE, CACHE_DIR = realProbe, cacheDir })
+	return calls
+}
+
+// Lines logged by the fake real ffprobe
+func realProbeCalls(t *testing.T, calls string) []string {
+	t.Helper()
+	data, err := os.ReadFile(calls)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestServeRealProbeSharesProbe(t *testing.T) {
+	calls := fakeRealProbe(t)
+	input := filepath.Join(t.TempDir(), "movie.bin")
+	if err := os.WriteFile(input, []byte("not a known container"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Jellyfin asks like this; several scans often ask at once
+	args := []string{"-analyzeduration", "200M", "-probesize", "1G", "-threads", "0", "-v", "warning",
+		"-print_format", "json", "-show_streams", "-show_format", "-i", input}
+	serve := func() string {
+		opts, err := parseFFProbeArgs(args)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		var stdout, stderr bytes.Buffer
+		inv := &invocation{Args: args, Stdout: &stdout, Stderr: &stderr}
+		if code := serveRealProbe(inv, input, info, opts); code != 0 {
+			t.Errorf("exit status %d: %s", code, stderr.String())
+		}
+		return stdout.String()
+	}
+
+	outputs := make([]string, 3)
+	var wg sync.WaitGroup
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			outputs[i] = serve()
+		}(i)
+	}
+	wg.Wait()
+	if got := realProbeCalls(t, calls); len(got) != 1 || !strings.HasPrefix(got[0], strings.Join(CACHE_PROBE_ARGS, " ")) {
+		t.Fatalf("concurrent calls ran the real ffprobe as %q, want one canonical probe", got)
+	}
+	for _, output := range outputs[1:] {
+		if output != outputs[0] {
+			t.Errorf("concurrent calls printed\n%s\nand\n%s", outputs[0], output)
+		}
+	}
+
+	// Later calls are answered from the cache
+	if output := serve(); output != outputs[0] {
+		t.Errorf("cached call printed\n%s\nwant\n%s", output, outputs[0])
+	}
+	if got := realProbeCalls(t, calls); len(got) != 1 {
+		t.Errorf("a cached call ran the real ffprobe: %q", got)
+	}
+}
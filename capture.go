@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	ptn "github.com/middelink/go-parse-torrent-name"
+)
+
+// Subcommand that turns a real probe into a template
+const captureCommand = "shim-capture"
+
+// Stream fields that describe one file rather than a kind of release
+var FILE_SPECIFIC_STREAM_FIELDS = []string{"duration", "duration_ts", "nb_frames", "nb_read_frames", "nb_read_packets"}
+
+// Format fields that describe one file rather than a kind of release
+var FILE_SPECIFIC_FORMAT_FIELDS = []string{"filename", "size", "duration"}
+
+// Format tags that describe one title rather than a kind of release
+var FILE_SPECIFIC_FORMAT_TAGS = []string{"title", "comment", "IMDB", "TMDB", "TVDB"}
+
+// Statistics tags written by mkvmerge, possibly with a language suffix such as "BPS-eng"
+var STATISTICS_TAGS = []string{
+	"BPS", "DURATION", "NUMBER_OF_FRAMES", "NUMBER_OF_BYTES",
+	"_STATISTICS_WRITING_APP", "_STATISTICS_WRITING_DATE_UTC", "_STATISTICS_TAGS",
+}
+
+// Top-level keys of the configuration file, in the order they are written
+var CONFIG_KEYS = []string{"templates", "rules", "video_codecs", "audio_codecs", "paths"}
+
+// Capture a template from a real probe of a file, or from ffprobe JSON output
+func runCapture(args []string) int {
+	flags := flag.NewFlagSet(captureCommand, flag.ContinueOnError)
+	from := flags.String("from", "", "read ffprobe -of json output from this file instead of probing")
+	name := flags.String("name", "", "template name (default: derived from the file name)")
+	pattern := flags.String("pattern", "", "rule pattern (default: derived from the file name)")
+	configFile := flags.String("config", CONFIG_FILE, "configuration file to update")
+	force := flags.Bool("force", false, "replace an existing template of the same name")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [options] <media file>\n", filepath.Base(os.Args[0]), captureCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	mediaFile := flags.Arg(0)
+
+	var output []byte
+	var err error
+	if *from != "" {
+		output, err = os.ReadFile(*from)
+	} else {
+		output, err = runRealProbe(mediaFile, slotRequest{})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot probe %s: %v\n", mediaFile, err)
+		return 1
+	}
+
+	template, err := captureTemplate(output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot use probe of %s: %v\n", mediaFile, err)
+		return 1
+	}
+
+	filename := filepath.Base(mediaFile)
+	rule := PatternInfo{Pattern: *pattern, Template: *name}
+	if rule.Template == "" {
+		rule.Template = suggestTemplateName(filename)
+	}
+	if rule.Pattern == "" {
+		rule.Pattern = suggestRulePattern(filename)
+	}
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid pattern %q: %v\n", rule.Pattern, err)
+		return 1
+	}
+	if !re.MatchString(filename) {
+		fmt.Fprintf(os.Stderr, "Pattern %q does not match %s; give one with -pattern\n", rule.Pattern, filename)
+		return 1
+	}
+
+	if err := addCapturedTemplate(*configFile, rule, template, *force); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Added template %q and rule %q to %s\n", rule.Template, rule.Pattern, *configFile)
+	return 0
+}
+
+// Turn ffprobe JSON output into a template by removing what only describes
+// the probed file; everything else is kept as the real ffprobe printed it
+func captureTemplate(output []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(output))
+	dec.UseNumber()
+	var template map[string]interface{}
+	if err := dec.Decode(&template); err != nil {
+		return nil, err
+	}
+	streams, _ := template["streams"].([]interface{})
+	if len(streams) == 0 {
+		return nil, errors.New("no streams found")
+	}
+
+	// Chapters are specific to a title, and so are the error and programs of a probe
+	for _, key := range []string{"chapters", "error", "programs"} {
+		delete(template, key)
+	}
+
+	for _, item := range streams {
+		stream, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, field := range FILE_SPECIFIC_STREAM_FIELDS {
+			delete(stream, field)
+		}
+		if tags, ok := stream["tags"].(map[string]interface{}); ok {
+			for key := range tags {
+				if isStatisticsTag(key) {
+					delete(tags, key)
+				}
+			}
+		}
+	}
+
+	if format, ok := template["format"].(map[string]interface{}); ok {
+		for _, field := range FILE_SPECIFIC_FORMAT_FIELDS {
+			delete(format, field)
+		}
+		if tags, ok := format["tags"].(map[string]interface{}); ok {
+			for _, key := range FILE_SPECIFIC_FORMAT_TAGS {
+				delete(tags, key)
+			}
+		}
+	}
+	return template, nil
+}
+
+func isStatisticsTag(key string) bool {
+	base, _, _ := strings.Cut(key, "-")
+	for _, tag := range STATISTICS_TAGS {
+		if strings.EqualFold(base, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Where the title of a release ends at the latest: an episode, a year or a resolution
+var TITLE_END_PATTERN = regexp.MustCompile(`(?i)[ ._\[(-]*\b(s\d+e\d+|(19|20)\d{2}|\d{3,4}p)\b`)
+
+// Title of a release as PTN parses it, cut short where PTN kept more of the
+// name than the title, as it does for names with parentheses
+func releaseTitle(filename string) (string, *ptn.TorrentInfo) {
+	info, err := ptn.Parse(filename)
+	if err != nil {
+		info = &ptn.TorrentInfo{}
+	}
+	title := info.Title
+	if title == "" {
+		title = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	if loc := TITLE_END_PATTERN.FindStringIndex(title); loc != nil && loc[0] > 0 {
+		title = title[:loc[0]]
+	}
+	return strings.TrimSpace(title), info
+}
+
+// Template name from the title and resolution of a release, e.g. "show-name-1080p"
+func suggestTemplateName(filename string) string {
+	name, info := releaseTitle(filename)
+	if info.Resolution != "" {
+		name += " " + info.Resolution
+	}
+	name = regexp.MustCompile(`[^a-z0-9]+`).ReplaceAllString(strings.ToLower(name), "-")
+	return strings.Trim(name, "-")
+}
+
+// Rule pattern matching other files of the same release: its title, then
+// its resolution and group where they are known
+func suggestRulePattern(filename string) string {
+	title, info := releaseTitle(filename)
+	if title == "" {
+		return "^" + regexp.QuoteMeta(filename) + "$"
+	}
+
+	var words []string
+	for _, word := range strings.FieldsFunc(title, func(r rune) bool {
+		return strings.ContainsRune(" ._-", r)
+	}) {
+		words = append(words, regexp.QuoteMeta(word))
+	}
+	pattern := `(?i)^` + strings.Join(words, `[ ._-]+`)
+	if info.Resolution != "" {
+		pattern += `.*` + regexp.QuoteMeta(info.Resolution)
+	}
+	if info.Group != "" {
+		pattern += `.*` + regexp.QuoteMeta(info.Group)
+	}
+	return pattern
+}
+
+// Add a template and a rule for it to the configuration file. A file without
+// rules gets the new rule alone: the compiled-in ones only back up the
+// guesses from the file name, which still apply. The result is validated
+// before it replaces the file, which is written back in the format it was in.
+func addCapturedTemplate(configFile string, rule PatternInfo, template map[string]interface{}, force bool) error {
+	config := map[string]json.RawMessage{}
+	asYAML := isYAMLExtension(configFile)
+	if data, err := os.ReadFile(configFile); err == nil {
+		if _, err := readConfig(configFile); err != nil {
+			return fmt.Errorf("not updating an invalid configuration: %w", err)
+		}
+		if asYAML = isYAMLConfig(data); asYAML {
+			if data, _, err = yamlToJSON(data); err != nil {
+				return err
+			}
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	templates := map[string]json.RawMessage{}
+	if raw, exists := config["templates"]; exists {
+		if err := json.Unmarshal(raw, &templates); err != nil {
+			return err
+		}
+	}
+	if _, exists := templates[rule.Template]; exists && !force {
+		return fmt.Errorf("template %q already exists in %s; use -force to replace it", rule.Template, configFile)
+	}
+	if _, exists := TEMPLATES[rule.Template]; exists && !force {
+		return fmt.Errorf("template %q is built in; use -force to replace it", rule.Template)
+	}
+	raw, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	templates[rule.Template] = raw
+
+	// The new rule goes first, since it is more specific than those before it
+	var rules []PatternInfo
+	if raw, exists := config["rules"]; exists {
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			return err
+		}
+	}
+	rules = append([]PatternInfo{rule}, rules...)
+
+	if config["templates"], err = json.Marshal(templates); err != nil {
+		return err
+	}
+	if config["rules"], err = json.Marshal(rules); err != nil {
+		return err
+	}
+	return writeConfigFile(configFile, config, asYAML)
+}
+
+// Whether a configuration file is named like a YAML one
+func isYAMLExtension(configFile string) bool {
+	ext := strings.ToLower(filepath.Ext(configFile))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Write a configuration file with its keys in the documented order
+func writeConfigFile(configFile string, config map[string]json.RawMessage, asYAML bool) error {
+	var out bytes.Buffer
+	out.WriteString("{\n")
+	first := true
+	for _, key := range CONFIG_KEYS {
+		raw, exists := config[key]
+		if !exists {
+			continue
+		}
+		if !first {
+			out.WriteString(",\n")
+		}
+		first = false
+		fmt.Fprintf(&out, "  %q: ", key)
+		if err := json.Indent(&out, raw, "  ", "  "); err != nil {
+			return err
+		}
+	}
+	out.WriteString("\n}\n")
+	data := out.Bytes()
+	if asYAML {
+		var err error
+		if data, err = jsonToYAML(data); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(configFile), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(configFile), ".config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if _, err := readConfig(tmp.Name()); err != nil {
+		return fmt.Errorf("the updated configuration would be invalid: %w", err)
+	}
+	return os.Rename(tmp.Name(), configFile)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAddCapturedTemplate(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	template := map[string]interface{}{
+		"streams": []interface{}{map[string]interface{}{"codec_type": "video", "codec_name": "hevc"}},
+	}
+
+	// A new file gets the captured rule alone
+	first := PatternInfo{Pattern: "(?i)^show", Template: "show-2160p"}
+	if err := addCapturedTemplate(configFile, first, template, false); err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Rules, []PatternInfo{first}) {
+		t.Errorf("rules %+v, want the captured one only", config.Rules)
+	}
+
+	// Later captures go before the rules already there
+	second := PatternInfo{Pattern: "(?i)^film", Template: "film-1080p"}
+	if err := addCapturedTemplate(configFile, second, template, false); err != nil {
+		t.Fatal(err)
+	}
+	if config, err = readConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Rules, []PatternInfo{second, first}) {
+		t.Errorf("rules %+v, want %+v then %+v", config.Rules, second, first)
+	}
+	if len(config.Templates) != 2 {
+		t.Errorf("templates %v, want the two captured ones", config.Templates)
+	}
+
+	before, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []PatternInfo{first, {Pattern: "x", Template: "tv_show"}} {
+		if err := addCapturedTemplate(configFile, rule, template, false); err == nil {
+			t.Errorf("template %q was replaced without -force", rule.Template)
+		}
+	}
+	if after, err := os.ReadFile(configFile); err != nil || string(after) != string(before) {
+		t.Errorf("a refused capture changed the file")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Deadline for a real ffprobe run; 0 means none
+var REAL_PROBE_TIMEOUT = envDuration("FFPROBE_SHIM_REAL_TIMEOUT", 0)
+
+// What to answer when a real ffprobe run exceeds REAL_PROBE_TIMEOUT
+var REAL_TIMEOUT_POLICY = envOrDefault("FFPROBE_SHIM_REAL_TIMEOUT_POLICY", timeoutPolicyError)
+
+// Returned when a real ffprobe run is killed for exceeding its deadline
+var errRealProbeTimeout = errors.New("real ffprobe timed out")
+
+// Signals sent to this process, or to the caller's process group, that are
+// passed on to the real ffprobe, which is in a group of its own
+var FORWARDED_SIGNALS = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// Run a real ffprobe child in its own process group, so that everything it
+// started goes when it is killed. The group is killed when REAL_PROBE_TIMEOUT
+// expires, and signals are passed on to it: those from the given channel, or
+// the FORWARDED_SIGNALS sent to this process if it is nil.
+func runChild(cmd *exec.Cmd, signals <-chan os.Signal) error {
+	if signals == nil {
+		local := make(chan os.Signal, 1)
+		signal.Notify(local, FORWARDED_SIGNALS...)
+		defer signal.Stop(local)
+		signals = local
+	}
+
+	cmd.SysProcAttr = childProcAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var deadline <-chan time.Time
+	if REAL_PROBE_TIMEOUT > 0 {
+		timer := time.NewTimer(REAL_PROBE_TIMEOUT)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	timedOut := false
+	for {
+		select {
+		case err := <-done:
+			if timedOut {
+				return errRealProbeTimeout
+			}
+			return err
+		case <-deadline:
+			log.Printf("Real ffprobe (pid %d) exceeded %s, killing its process group", pid, REAL_PROBE_TIMEOUT)
+			syscall.Kill(-pid, syscall.SIGKILL)
+			timedOut = true
+			deadline = nil
+		case sig := <-signals:
+			if sig, ok := sig.(syscall.Signal); ok {
+				log.Printf("Forwarding %v to real ffprobe (pid %d)", sig, pid)
+				syscall.Kill(-pid, sig)
+			}
+		}
+	}
+}
+
+// Records whether anything was written through it
+type trackingWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *trackingWriter) Write(data []byte) (int, error) {
+	if len(data) > 0 {
+		t.written = true
+	}
+	return t.w.Write(data)
+}
@@ -0,0 +1,12 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// Process attributes of a real ffprobe child: its own process group, and a
+// SIGKILL when this process dies, so that it is not orphaned outside the
+// caller's group if this process is killed without a chance to kill it
+func childProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// H.264 profile names by profile_idc
+var H264_PROFILES = map[byte]string{
+	44:  "CAVLC 4:4:4",
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4 Predictive",
+}
+
+// HEVC profile names by general_profile_idc
+var HEVC_PROFILES = map[byte]string{
+	1: "Main",
+	2: "Main 10",
+	3: "Main Still Picture",
+	4: "Rext",
+}
+
+// AV1 profile names by seq_profile
+var AV1_PROFILES = map[byte]string{
+	0: "Main",
+	1: "High",
+	2: "Professional",
+}
+
+// AAC profile names by audio object type
+var AAC_PROFILES = map[byte]string{
+	1:  "Main",
+	2:  "LC",
+	3:  "SSR",
+	4:  "LTP",
+	5:  "HE-AAC",
+	23: "LD",
+	29: "HE-AACv2",
+	39: "ELD",
+}
+
+// Fill in what the codec configuration record of a stream tells: profile,
+// level and pixel format. Records that are too short are ignored; the rest of
+// the stream is still right without them.
+func applyCodecConfig(stream *Stream, config []byte) {
+	if len(config) > 0 {
+		stream.ExtradataSize = len(config)
+	}
+	switch stream.CodecName {
+	case "h264":
+		applyAVCConfig(stream, config)
+	case "hevc":
+		applyHEVCConfig(stream, config)
+	case "av1":
+		applyAV1Config(stream, config)
+	case "aac":
+		if len(config) >= 1 {
+			if profile, known := AAC_PROFILES[config[0]>>3]; known {
+				stream.Profile = profile
+			}
+		}
+	}
+}
+
+// AVCDecoderConfigurationRecord (ISO/IEC 14496-15)
+func applyAVCConfig(stream *Stream, config []byte) {
+	stream.PixFmt = "yuv420p"
+	if len(config) < 6 {
+		return
+	}
+	profile, constraints, level := config[1], config[2], config[3]
+	stream.Profile = H264_PROFILES[profile]
+	if profile == 66 && constraints&0x40 != 0 {
+		stream.Profile = "Constrained Baseline"
+	}
+	stream.Level = int(level)
+	stream.IsAVC = "true"
+	stream.NalLengthSize = strconv.Itoa(int(config[4]&3) + 1)
+
+	// The high profiles append their chroma format and bit depth after the
+	// parameter sets
+	switch profile {
+	case 110:
+		stream.PixFmt = "yuv420p10le"
+	case 122:
+		stream.PixFmt = "yuv422p10le"
+	}
+	rest := config[5:]
+	for _, countMask := range []byte{0x1f, 0xff} {
+		if len(rest) < 1 {
+			return
+		}
+		count := int(rest[0] & countMask)
+		rest = rest[1:]
+		for i := 0; i < count; i++ {
+			if len(rest) < 2 {
+				return
+			}
+			length := int(rest[0])<<8 | int(rest[1])
+			if len(rest) < 2+length {
+				return
+			}
+			rest = rest[2+length:]
+		}
+	}
+	if profile >= 100 && len(rest) >= 2 {
+		stream.PixFmt = pixelFormat(int(rest[0]&3), int(rest[1]&7)+8)
+	}
+}
+
+// HEVCDecoderConfigurationRecord (ISO/IEC 14496-15)
+func applyHEVCConfig(stream *Stream, config []byte) {
+	if len(config) < 22 {
+		stream.PixFmt = "yuv420p"
+		return
+	}
+	stream.Profile = HEVC_PROFILES[config[1]&0x1f]
+	stream.Level = int(config[12])
+	stream.PixFmt = pixelFormat(int(config[16]&3), int(config[17]&7)+8)
+	stream.NalLengthSize = strconv.Itoa(int(config[21]&3) + 1)
+}
+
+// AV1CodecConfigurationRecord (AV1 Codec ISO Media File Format Binding)
+func applyAV1Config(stream *Stream, config []byte) {
+	if len(config) < 4 {
+		stream.PixFmt = "yuv420p"
+		return
+	}
+	stream.Profile = AV1_PROFILES[config[1]>>5]
+	stream.Level = int(config[1] & 0x1f)
+
+	depth := 8
+	if config[2]&0x40 != 0 {
+		depth = 10
+		if config[2]&0x20 != 0 {
+			depth = 12
+		}
+	}
+	chroma := 3
+	switch {
+	case config[2]&0x10 != 0:
+		chroma = 0
+	case config[2]&0x08 != 0 && config[2]&0x04 != 0:
+		chroma = 1
+	case config[2]&0x08 != 0:
+		chroma = 2
+	}
+	stream.PixFmt = pixelFormat(chroma, depth)
+}
+
+// Pixel format name from a chroma_format_idc and a bit depth, e.g. "yuv420p10le"
+func pixelFormat(chroma, depth int) string {
+	name := [...]string{"gray", "yuv420p", "yuv422p", "yuv444p"}[chroma]
+	if depth > 8 {
+		if chroma == 0 {
+			return fmt.Sprintf("gray%dle", depth)
+		}
+		return fmt.Sprintf("%s%dle", name, depth)
+	}
+	return name
+}
+
+// Side data for a DOVIDecoderConfigurationRecord (dvcC or dvvC)
+func doviSideData(config []byte) (SideData, bool) {
+	if len(config) < 5 {
+		return SideData{}, false
+	}
+	flags := int64(config[2])<<8 | int64(config[3])
+	return SideData{
+		SideDataType: "DOVI configuration record",
+		Fields: []SideDataField{
+			{"dv_version_major", int64(config[0])},
+			{"dv_version_minor", int64(config[1])},
+			{"dv_profile", flags >> 9},
+			{"dv_level", flags >> 3 & 0x3f},
+			{"rpu_present_flag", flags >> 2 & 1},
+			{"el_present_flag", flags >> 1 & 1},
+			{"bl_present_flag", flags & 1},
+			{"dv_bl_signal_compatibility_id", int64(config[4] >> 4)},
+		},
+	}, true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApplyCodecConfig(t *testing.T) {
+	tests := []struct {
+		codec  string
+		config []byte
+		want   string // Profile, level, pixel format and NAL length size
+	}{
+		// High at 4.1, with an SPS, a PPS and the 4:2:0 8-bit extension
+		{"h264", []byte{1, 100, 0, 41, 0xff, 0xe1, 0, 2, 0x67, 0x64, 1, 0, 1, 0x68, 0xfd, 0xf8}, "High 41 yuv420p 4"},
+		{"h264", []byte{1, 122, 0, 40, 0xfd, 0xe0, 0, 0xfe, 0xfa}, "High 4:2:2 40 yuv422p10le 2"},
+		{"h264", []byte{1, 110, 0, 51, 0xff, 0xe0, 0}, "High 10 51 yuv420p10le 4"},
+		{"h264", []byte{1, 66, 0xc0, 30, 0xff, 0xe0}, "Constrained Baseline 30 yuv420p 4"},
+		{"h264", []byte{1, 77, 0, 31}, " 0 yuv420p "},
+		{"h264", nil, " 0 yuv420p "},
+		{"hevc", hevcMain10Config(), "Main 10 153 yuv420p10le 4"},
+		{"hevc", hevcMain10Config()[:21], " 0 yuv420p "},
+		// Main at 4.0, 10-bit 4:2:0
+		{"av1", []byte{0x81, 0x08, 0x4c, 0}, "Main 8 yuv420p10le "},
+		{"av1", []byte{0x81, 0x28, 0x00, 0}, "High 8 yuv444p "},
+		{"av1", []byte{0x81, 0x48, 0x70, 0}, "Professional 8 gray12le "},
+		{"av1", []byte{0x81}, " 0 yuv420p "},
+		{"aac", []byte{0x12, 0x10}, "LC 0  "},
+		{"aac", []byte{0x2b, 0x92, 0x08, 0}, "HE-AAC 0  "},
+		{"aac", []byte{0xf8}, " 0  "},
+		{"ac3", []byte{1, 2, 3}, " 0  "},
+	}
+	for _, test := range tests {
+		stream := Stream{CodecName: test.codec}
+		applyCodecConfig(&stream, test.config)
+		got := fmt.Sprintf("%s %d %s %s", stream.Profile, stream.Level, stream.PixFmt, stream.NalLengthSize)
+		if got != test.want {
+			t.Errorf("%s config % x gave %q, want %q", test.codec, test.config, got, test.want)
+		}
+		if stream.ExtradataSize != len(test.config) {
+			t.Errorf("%s config % x gave extradata size %d", test.codec, test.config, stream.ExtradataSize)
+		}
+	}
+}
+
+func TestDoviSideData(t *testing.T) {
+	// Profile 8.1 at level 6 with an RPU and a base layer
+	sideData, ok := doviSideData([]byte{1, 0, 0x10, 0x35, 0x10})
+	if !ok {
+		t.Fatal("record was rejected")
+	}
+	want := "[{dv_version_major 1} {dv_version_minor 0} {dv_profile 8} {dv_level 6} {rpu_present_flag 1} " +
+		"{el_present_flag 0} {bl_present_flag 1} {dv_bl_signal_compatibility_id 1}]"
+	if got := fmt.Sprint(sideData.Fields); got != want {
+		t.Errorf("fields %s, want %s", got, want)
+	}
+	if _, ok := doviSideData([]byte{1, 0, 0x10, 0x35}); ok {
+		t.Error("a short record was accepted")
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rules configuration file, in JSON or YAML; when it is unset or missing the
+// compiled-in PATTERNS, TEMPLATES and codec maps are used. Templates in the
+// file are added to the compiled-in ones, replacing those of the same name;
+// every other top-level key present replaces the matching default as a whole:
+//
+//	{
+//	  "templates":    {"name": <ffprobe -of json output, see templateExtendsKey>, ...},
+//	  "rules":        [{"pattern": "<regexp on the file name>", "template": "name", "overlays": [...]}, ...],
+//	  "video_codecs": {"x265": "hevc", ...},
+//	  "audio_codecs": {"truehd": "truehd", ...},
+//	  "paths":        [{"prefix": "/mnt/zurg", "wait": "2m", "mode": "real"}, ...]
+//	}
+var CONFIG_FILE = envOrDefault("FFPROBE_SHIM_CONFIG", "/etc/ffprobe-shim/config.json")
+
+// Subcommand that validates the configuration file
+const checkConfigCommand = "shim-check-config"
+
+// Whether the rules come from the configuration file; explicit rules are
+// then tried before the guesses based on the parsed file name
+var rulesFirst = false
+
+// Templates from the configuration file, which the guesses based on the
+// parsed file name only complete
+var configuredTemplates = map[string]bool{}
+
+// How files under a path are answered
+const (
+	pathModeAuto        = "auto"        // Cache, then templates, then the real ffprobe
+	pathModeReal        = "real"        // Cache, then the real ffprobe; never synthetic
+	pathModePassthrough = "passthrough" // Always the real ffprobe with the original arguments
+)
+
+// PathPolicy overrides the defaults for files under a path prefix
+type PathPolicy struct {
+	Prefix string `json:"prefix"`
+	Wait   string `json:"wait,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+
+	wait *time.Duration
+}
+
+// Policies from the configuration file, longest prefixes first
+var PATH_POLICIES []PathPolicy
+
+// The policy of the longest prefix a path falls under, if any
+func pathPolicyFor(path string) (PathPolicy, bool) {
+	for _, policy := range PATH_POLICIES {
+		if hasPathPrefix(path, policy.Prefix) {
+			return policy, true
+		}
+	}
+	return PathPolicy{}, false
+}
+
+// How files under a path are answered
+func pathModeFor(path string) string {
+	if policy, found := pathPolicyFor(path); found && policy.Mode != "" {
+		return policy.Mode
+	}
+	return pathModeAuto
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// shimConfig is a validated configuration; nil fields were not in the file
+type shimConfig struct {
+	Templates   map[string]FFProbeResponse
+	Composed    map[string]FFProbeResponse // What rules with overlays name
+	Rules       []PatternInfo
+	VideoCodecs map[string]string
+	AudioCodecs map[string]string
+	Paths       []PathPolicy
+}
+
+// configError points at the part of the configuration file that is wrong
+type configError struct {
+	File      string
+	Line, Col int
+	Message   string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Col, e.Message)
+}
+
+// Load the configuration file over the compiled-in defaults; an invalid file
+// is ignored as a whole so that a typo cannot half-apply
+func loadConfig() {
+	config, err := readConfig(CONFIG_FILE)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Ignoring configuration, using built-in rules: %v", err)
+		}
+		return
+	}
+	applyConfig(config)
+	log.Printf("Loaded configuration from %s", CONFIG_FILE)
+	if _, exists := TEMPLATES[DEFAULT_TEMPLATE]; !exists {
+		log.Printf("Default template %q does not exist, files matching no rule will not get synthetic answers", DEFAULT_TEMPLATE)
+	}
+}
+
+func applyConfig(config *shimConfig) {
+	for _, templates := range []map[string]FFProbeResponse{config.Templates, config.Composed} {
+		for name, template := range templates {
+			TEMPLATES[name] = template
+			configuredTemplates[name] = true
+		}
+	}
+	if config.Rules != nil {
+		PATTERNS = config.Rules
+		compiledPatterns = compilePatterns(PATTERNS)
+		rulesFirst = true
+	}
+	if config.VideoCodecs != nil {
+		VIDEO_CODEC_MAP = config.VideoCodecs
+	}
+	if config.AudioCodecs != nil {
+		AUDIO_CODEC_MAP = config.AudioCodecs
+	}
+	if config.Paths != nil {
+		PATH_POLICIES = config.Paths
+		for _, policy := range PATH_POLICIES {
+			if policy.wait != nil {
+				FILE_WAIT_PATHS = append(FILE_WAIT_PATHS, waitOverride{Prefix: policy.Prefix, Wait: *policy.wait})
+			}
+		}
+		sort.SliceStable(FILE_WAIT_PATHS, func(i, j int) bool {
+			return len(FILE_WAIT_PATHS[i].Prefix) > len(FILE_WAIT_PATHS[j].Prefix)
+		})
+	}
+}
+
+// Validate the configuration file
+func runCheckConfig(args []string) int {
+	file := CONFIG_FILE
+	if len(args) > 0 {
+		file = args[0]
+	}
+	config, err := readConfig(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: OK (%s)\n", file, config.summary())
+	return 0
+}
+
+func (config *shimConfig) summary() string {
+	var parts []string
+	count := func(name string, present bool, n int) {
+		if present {
+			parts = append(parts, fmt.Sprintf("%d %s", n, name))
+		} else {
+			parts = append(parts, name+" built in")
+		}
+	}
+	count("templates", config.Templates != nil, len(config.Templates))
+	count("rules", config.Rules != nil, len(config.Rules))
+	count("video codecs", config.VideoCodecs != nil, len(config.VideoCodecs))
+	count("audio codecs", config.AudioCodecs != nil, len(config.AudioCodecs))
+	count("path policies", config.Paths != nil, len(config.Paths))
+	return strings.Join(parts, ", ")
+}
+
+// configReader decodes a configuration file while keeping track of where
+// each value came from, so that errors can point at it
+type configReader struct {
+	file string
+	data []byte
+	dec  *json.Decoder
+
+	// Where the values of a YAML file, converted to data, came from
+	positions []yamlPosition
+}
+
+// Error at a byte offset of the file
+func (r *configReader) errorAt(offset int64, format string, args ...interface{}) error {
+	if r.positions != nil {
+		line, col := yamlPositionAt(r.positions, offset)
+		return &configError{File: r.file, Line: line, Col: col, Message: fmt.Sprintf(format, args...)}
+	}
+	line, col := 1, 1
+	for _, c := range r.data[:min(int(offset), len(r.data))] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return &configError{File: r.file, Line: line, Col: col, Message: fmt.Sprintf(format, args...)}
+}
+
+// Turn a decoding error inside a value starting at base into a positioned error
+func (r *configReader) decodeError(base int64, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return r.errorAt(base+syntaxErr.Offset, "%v", err)
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "value"
+		}
+		return r.errorAt(base+typeErr.Offset, "%s must be %s, not %s", field, jsonKind(typeErr.Type.Kind().String()), typeErr.Value)
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		return r.errorAt(int64(len(r.data)), "unexpected end of file")
+	}
+	return r.errorAt(base, "%v", err)
+}
+
+func jsonKind(kind string) string {
+	switch kind {
+	case "string":
+		return "a string"
+	case "map", "struct":
+		return "an object"
+	case "slice", "array":
+		return "an array"
+	}
+	return "a number"
+}
+
+// Offset where the next value starts, past whitespace and separators
+func (r *configReader) nextValue() int64 {
+	offset := r.dec.InputOffset()
+	for offset < int64(len(r.data)) && strings.IndexByte(" \t\r\n,:", r.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// Read the next raw value and where it starts
+func (r *configReader) rawValue() (json.RawMessage, int64, error) {
+	offset := r.nextValue()
+	var raw json.RawMessage
+	if err := r.dec.Decode(&raw); err != nil {
+		// Offsets of the file's own decoder are already absolute
+		return nil, offset, r.decodeError(0, err)
+	}
+	return raw, offset, nil
+}
+
+// Expect a delimiter token
+func (r *configReader) expect(delim json.Delim, what string) error {
+	offset := r.nextValue()
+	token, err := r.dec.Token()
+	if err != nil {
+		return r.decodeError(0, err)
+	}
+	if token != delim {
+		return r.errorAt(offset, "%s must be %s", what, map[json.Delim]string{'{': "an object", '[': "an array"}[delim])
+	}
+	return nil
+}
+
+// Call fn for each member of an object, with the offset of its key
+func (r *configReader) eachMember(what string, fn func(key string, offset int64) error) error {
+	if err := r.expect('{', what); err != nil {
+		return err
+	}
+	for r.dec.More() {
+		offset := r.nextValue()
+		token, err := r.dec.Token()
+		if err != nil {
+			return r.decodeError(0, err)
+		}
+		if err := fn(token.(string), offset); err != nil {
+			return err
+		}
+	}
+	_, err := r.dec.Token()
+	return err
+}
+
+// Call fn for each element of an array
+func (r *configReader) eachElement(what string, fn func(index int) error) error {
+	if err := r.expect('[', what); err != nil {
+		return err
+	}
+	for i := 0; r.dec.More(); i++ {
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	_, err := r.dec.Token()
+	return err
+}
+
+// Decode a raw value strictly, rejecting unknown fields
+func (r *configReader) decodeStrict(raw json.RawMessage, offset int64, target interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(target); err != nil {
+		if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return r.errorAt(offset, "unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+		}
+		return r.decodeError(offset, err)
+	}
+	return nil
+}
+
+// Read and validate a configuration file
+func readConfig(file string) (*shimConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := &configReader{file: file, data: data}
+	if isYAMLConfig(data) {
+		if r.data, r.positions, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	r.dec = json.NewDecoder(bytes.NewReader(r.data))
+	r.dec.UseNumber()
+
+	config := &shimConfig{}
+	templateSources := map[string]*templateSource{}
+	templateOffsets := map[string]int64{}
+	var ruleOffsets []int64
+	seen := map[string]bool{}
+
+	err = r.eachMember("the configuration", func(key string, keyOffset int64) error {
+		if seen[key] {
+			return r.errorAt(keyOffset, "duplicate key %q", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "templates":
+			config.Templates = map[string]FFProbeResponse{}
+			return r.eachMember("templates", func(name string, offset int64) error {
+				raw, valueOffset, err := r.rawValue()
+				if err != nil {
+					return err
+				}
+				source, err := parseTemplateSource(raw)
+				if err != nil {
+					return r.errorAt(valueOffset, "template %q: %v", name, err)
+				}
+				// Catch type errors here, where their position is known
+				var template FFProbeResponse
+				if err := json.Unmarshal(raw, &template); err != nil {
+					return r.decodeError(valueOffset, err)
+				}
+				templateSources[name] = source
+				templateOffsets[name] = offset
+				return nil
+			})
+
+		case "rules":
+			config.Rules = []PatternInfo{}
+			return r.eachElement("rules", func(index int) error {
+				raw, offset, err := r.rawValue()
+				if err != nil {
+					return err
+				}
+				var rule PatternInfo
+				if err := r.decodeStrict(raw, offset, &rule); err != nil {
+					return err
+				}
+				if rule.Pattern == "" {
+					return r.errorAt(offset, "rule %d has no pattern", index+1)
+				}
+				if _, err := regexp.Compile(rule.Pattern); err != nil {
+					return r.errorAt(offset, "rule %d: invalid pattern: %v", index+1, err)
+				}
+				if rule.Template == "" {
+					return r.errorAt(offset, "rule %d has no template", index+1)
+				}
+				config.Rules = append(config.Rules, rule)
+				ruleOffsets = append(ruleOffsets, offset)
+				return nil
+			})
+
+		case "video_codecs", "audio_codecs":
+			codecs := map[string]string{}
+			if key == "video_codecs" {
+				config.VideoCodecs = codecs
+			} else {
+				config.AudioCodecs = codecs
+			}
+			return r.eachMember(key, func(name string, offset int64) error {
+				raw, valueOffset, err := r.rawValue()
+				if err != nil {
+					return err
+				}
+				var codec string
+				if err := json.Unmarshal(raw, &codec); err != nil {
+					return r.errorAt(valueOffset, "%s %q must be a codec name string", key, name)
+				}
+				if name == "" || codec == "" {
+					return r.errorAt(offset, "%s entries need a name and a codec", key)
+				}
+				// File names are matched in lower case
+				codecs[strings.ToLower(name)] = codec
+				return nil
+			})
+
+		case "paths":
+			config.Paths = []PathPolicy{}
+			return r.eachElement("paths", func(index int) error {
+				raw, offset, err := r.rawValue()
+				if err != nil {
+					return err
+				}
+				var policy PathPolicy
+				if err := r.decodeStrict(raw, offset, &policy); err != nil {
+					return err
+				}
+				if !filepath.IsAbs(policy.Prefix) {
+					return r.errorAt(offset, "path %d: prefix must be an absolute path", index+1)
+				}
+				policy.Prefix = filepath.Clean(policy.Prefix)
+				if policy.Wait != "" {
+					wait, err := time.ParseDuration(policy.Wait)
+					if err != nil || wait < 0 {
+						return r.errorAt(offset, "path %d: invalid wait %q, expected a duration such as \"90s\"", index+1, policy.Wait)
+					}
+					policy.wait = &wait
+				}
+				switch policy.Mode {
+				case "", pathModeAuto, pathModeReal, pathModePassthrough:
+				default:
+					return r.errorAt(offset, "path %d: invalid mode %q, expected %s, %s or %s",
+						index+1, policy.Mode, pathModeAuto, pathModeReal, pathModePassthrough)
+				}
+				config.Paths = append(config.Paths, policy)
+				return nil
+			})
+		}
+
+		return r.errorAt(keyOffset, "unknown key %q, expected templates, rules, video_codecs, audio_codecs or paths", key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if offset := r.nextValue(); offset < int64(len(r.data)) {
+		return nil, r.errorAt(offset, "unexpected data after the configuration")
+	}
+
+	// Compose the templates, in name order so that errors are reproducible
+	resolver := newTemplateResolver(templateSources, TEMPLATES)
+	names := make([]string, 0, len(templateSources))
+	for name := range templateSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content, err := resolver.resolve(name)
+		if err == nil {
+			config.Templates[name], err = templateResponse(content)
+		}
+		if err != nil {
+			return nil, r.errorAt(templateOffsets[name], "template %q: %v", name, err)
+		}
+	}
+
+	// Rules may name any template, compiled-in ones included, with overlays
+	// on top; a composition is registered under a name of its own, while a
+	// compiled-in template named as it is keeps its guesses from the name
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		name := composedTemplateName(rule.Template, rule.Overlays)
+		template, err := resolver.compose(rule.Template, rule.Overlays)
+		if err != nil {
+			return nil, r.errorAt(ruleOffsets[i], "rule %d: %v", i+1, err)
+		}
+		if len(template.Streams) == 0 {
+			return nil, r.errorAt(ruleOffsets[i], "rule %d: template %q has no streams", i+1, name)
+		}
+		if len(rule.Overlays) == 0 {
+			continue
+		}
+		if config.Composed == nil {
+			config.Composed = map[string]FFProbeResponse{}
+		}
+		config.Composed[name] = template
+		rule.Template = name
+		rule.Overlays = nil
+	}
+
+	sort.SliceStable(config.Paths, func(i, j int) bool {
+		return len(config.Paths[i].Prefix) > len(config.Paths[j].Prefix)
+	})
+	return config, nil
+}
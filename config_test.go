@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Read a configuration from a temporary file
+func readTestConfig(t *testing.T, content string) *shimConfig {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestConfigRuleTemplates(t *testing.T) {
+	// A compiled-in template named as it is stays unconfigured, so that the
+	// guesses from the file name still apply
+	config := readTestConfig(t, `{"rules": [{"pattern": "S\\d+E\\d+", "template": "tv_show"}]}`)
+	if config.Templates != nil || config.Composed != nil || config.Rules[0].Template != "tv_show" {
+		t.Errorf("rule on a compiled-in template gave templates %v, compositions %v, rule %+v",
+			config.Templates, config.Composed, config.Rules[0])
+	}
+	if got, want := config.summary(), "templates built in, 1 rules, video codecs built in, audio codecs built in, path policies built in"; got != want {
+		t.Errorf("summary %q, want %q", got, want)
+	}
+
+	config = readTestConfig(t, `{
+		"templates": {"surround": {"streams": [{}, {"channels": 8}]}},
+		"rules": [
+			{"pattern": "S\\d+E\\d+", "template": "tv_show", "overlays": ["surround"]},
+			{"pattern": "Concert", "template": "surround"}
+		]
+	}`)
+	if _, exists := config.Composed["tv_show+surround"]; !exists || len(config.Composed) != 1 {
+		t.Errorf("compositions %v, want tv_show+surround", config.Composed)
+	}
+	if config.Rules[0].Template != "tv_show+surround" || config.Rules[1].Template != "surround" {
+		t.Errorf("rules name %q and %q", config.Rules[0].Template, config.Rules[1].Template)
+	}
+	if got, want := config.summary(), "1 templates, 2 rules, video codecs built in, audio codecs built in, path policies built in"; got != want {
+		t.Errorf("summary %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlPosition is where the JSON written from a YAML node starts, and where
+// that node is in the YAML file
+type yamlPosition struct {
+	Offset    int64
+	Line, Col int
+}
+
+// Whether a configuration file is YAML rather than JSON; a JSON file is an
+// object, and YAML configurations are written in block style
+func isYAMLConfig(data []byte) bool {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] != '{'
+}
+
+// Convert a YAML configuration into the JSON the configuration reader takes,
+// with the positions of its values in the YAML file
+func yamlToJSON(data []byte) ([]byte, []yamlPosition, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, nil, err
+	}
+	if len(document.Content) == 0 {
+		return nil, nil, fmt.Errorf("the configuration is empty")
+	}
+	converter := &yamlConverter{}
+	if err := converter.write(document.Content[0], 0); err != nil {
+		return nil, nil, err
+	}
+	return converter.out.Bytes(), converter.positions, nil
+}
+
+// Aliases nested deeper than this are taken for a loop
+const maxYAMLDepth = 100
+
+type yamlConverter struct {
+	out       bytes.Buffer
+	positions []yamlPosition
+}
+
+func (c *yamlConverter) mark(node *yaml.Node) {
+	c.positions = append(c.positions, yamlPosition{Offset: int64(c.out.Len()), Line: node.Line, Col: node.Column})
+}
+
+func (c *yamlConverter) write(node *yaml.Node, depth int) error {
+	if depth > maxYAMLDepth {
+		return fmt.Errorf("line %d: values nested too deep", node.Line)
+	}
+	c.mark(node)
+
+	switch node.Kind {
+	case yaml.AliasNode:
+		return c.write(node.Alias, depth+1)
+
+	case yaml.MappingNode:
+		c.out.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode || key.Tag == "!!merge" {
+				return fmt.Errorf("line %d: keys must be plain strings", key.Line)
+			}
+			if i > 0 {
+				c.out.WriteByte(',')
+			}
+			c.mark(key)
+			c.writeString(key.Value)
+			c.out.WriteByte(':')
+			if err := c.write(value, depth+1); err != nil {
+				return err
+			}
+		}
+		c.out.WriteByte('}')
+
+	case yaml.SequenceNode:
+		c.out.WriteByte('[')
+		for i, element := range node.Content {
+			if i > 0 {
+				c.out.WriteByte(',')
+			}
+			if err := c.write(element, depth+1); err != nil {
+				return err
+			}
+		}
+		c.out.WriteByte(']')
+
+	case yaml.ScalarNode:
+		return c.writeScalar(node)
+
+	default:
+		return fmt.Errorf("line %d: unexpected YAML node", node.Line)
+	}
+	return nil
+}
+
+func (c *yamlConverter) writeScalar(node *yaml.Node) error {
+	switch node.ShortTag() {
+	case "!!null":
+		c.out.WriteString("null")
+	case "!!bool":
+		var value bool
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		c.out.WriteString(strconv.FormatBool(value))
+	case "!!int":
+		var value int64
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		c.out.WriteString(strconv.FormatInt(value, 10))
+	case "!!float":
+		var value float64
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return fmt.Errorf("line %d: %s is not a number JSON can hold", node.Line, node.Value)
+		}
+		c.out.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	default:
+		c.writeString(node.Value)
+	}
+	return nil
+}
+
+func (c *yamlConverter) writeString(s string) {
+	encoded, _ := json.Marshal(s)
+	c.out.Write(encoded)
+}
+
+// The YAML line and column of the value the JSON at an offset came from
+func yamlPositionAt(positions []yamlPosition, offset int64) (int, int) {
+	i := sort.Search(len(positions), func(i int) bool { return positions[i].Offset > offset })
+	if i == 0 {
+		return 1, 1
+	}
+	return positions[i-1].Line, positions[i-1].Col
+}
+
+// Write a JSON configuration as YAML, in block style
+func jsonToYAML(data []byte) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	setBlockStyle(&document)
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func setBlockStyle(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode {
+		node.Style = 0
+	} else if node.Style == yaml.DoubleQuotedStyle && node.Tag == "!!str" {
+		// Quote only what would otherwise read as another type
+		node.Style = 0
+	}
+	for _, child := range node.Content {
+		setBlockStyle(child)
+	}
+}
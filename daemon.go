@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Unix socket of the daemon, in a directory only its user can enter; set it
+// to an empty value to always answer in-process
+var DAEMON_SOCKET = envOrDefault("FFPROBE_SHIM_SOCKET",
+	filepath.Join(os.TempDir(), fmt.Sprintf("ffprobe-shim-%d", os.Getuid()), "daemon.sock"))
+
+// Variables of the caller's environment the shim reads, the only ones sent to
+// the daemon; the real ffprobe runs with the daemon's own environment
+var DAEMON_FORWARDED_ENV = []string{
+	"USE_FFPROBE_SHIM",
+	"FFPROBE_SHIM_PRIORITY",
+	"FFPROBE_SHIM_MAX_WAIT",
+}
+
+// Subcommand that runs the daemon
+const daemonCommand = "shim-daemon"
+
+// How long a client waits to connect before answering in-process
+const daemonDialTimeout = time.Second
+
+// Streams of the frames the daemon sends back. A frame is the stream byte,
+// a big-endian uint32 length and that many bytes of data; the exit frame
+// carries the exit code as a big-endian int32 and ends the reply.
+const (
+	frameStdout byte = 1
+	frameStderr byte = 2
+	frameExit   byte = 3
+)
+
+// DaemonRequest is what a client sends, as a single JSON line
+type DaemonRequest struct {
+	Args []string `json:"args"`
+	Env  []string `json:"env"` // Only DAEMON_FORWARDED_ENV
+	Cwd  string   `json:"cwd"`
+}
+
+// Writes data as frames of one stream, shared with the other streams of the same connection
+type frameWriter struct {
+	conn   net.Conn
+	stream byte
+	mu     *sync.Mutex
+}
+
+func (w *frameWriter) Write(data []byte) (int, error) {
+	if err := writeFrame(w.conn, w.mu, w.stream, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func writeFrame(conn net.Conn, mu *sync.Mutex, stream byte, data []byte) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	header := make([]byte, 5)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+	_, err := conn.Write(data)
+	return err
+}
+
+// Serve ffprobe calls over the socket until interrupted
+func runDaemon() int {
+	if DAEMON_SOCKET == "" {
+		fmt.Fprintln(os.Stderr, "FFPROBE_SHIM_SOCKET is empty, not starting the daemon")
+		return 1
+	}
+
+	if err := prepareSocketDir(filepath.Dir(DAEMON_SOCKET)); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot use %s for the daemon socket: %v\n", filepath.Dir(DAEMON_SOCKET), err)
+		return 1
+	}
+
+	// Only remove the socket if nobody is listening on it
+	if conn, err := net.DialTimeout("unix", DAEMON_SOCKET, daemonDialTimeout); err == nil {
+		conn.Close()
+		fmt.Fprintf(os.Stderr, "A daemon is already listening on %s\n", DAEMON_SOCKET)
+		return 1
+	}
+	os.Remove(DAEMON_SOCKET)
+
+	// The socket is created with no access for other users, rather than
+	// restricted once it exists
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", DAEMON_SOCKET)
+	syscall.Umask(umask)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot listen on %s: %v\n", DAEMON_SOCKET, err)
+		return 1
+	}
+	defer os.Remove(DAEMON_SOCKET)
+	log.Printf("Daemon listening on %s", DAEMON_SOCKET)
+
+	enableMemoryCache()
+	if BACKGROUND_PROBE && CACHE_DIR != "" {
+		startRefreshLoop()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Daemon received %v, shutting down", sig)
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return 0
+			}
+			log.Printf("Error accepting daemon connection: %v", err)
+			continue
+		}
+		go serveDaemonConn(conn)
+	}
+}
+
+// Create the directory of the socket for this user alone, or make sure an
+// existing one is only writable by this user
+func prepareSocketDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() && stat.Uid != 0 {
+		return fmt.Errorf("owned by uid %d", stat.Uid)
+	}
+	// A shared directory like /tmp is fine as long as it is sticky, so that
+	// the socket cannot be replaced by another user
+	if info.Mode().Perm()&0022 != 0 && info.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("writable by other users")
+	}
+	return nil
+}
+
+// Keep the variables of an environment that the shim reads
+func forwardedEnv(env []string) []string {
+	var forwarded []string
+	for _, variable := range env {
+		name, _, _ := strings.Cut(variable, "=")
+		if containsString(DAEMON_FORWARDED_ENV, name) {
+			forwarded = append(forwarded, variable)
+		}
+	}
+	return forwarded
+}
+
+// Answer one forwarded call
+func serveDaemonConn(conn net.Conn) {
+	defer conn.Close()
+
+	if uid, known := peerUID(conn); known && uid != os.Getuid() {
+		log.Printf("Refusing daemon connection from uid %d", uid)
+		return
+	}
+
+	var request DaemonRequest
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &request)
+	}
+	if err != nil {
+		// Connections closed without a request are liveness checks
+		if len(line) > 0 || err != io.EOF {
+			log.Printf("Invalid daemon request: %v", err)
+		}
+		return
+	}
+
+	// Clients send nothing after the request, so the connection only becomes
+	// readable when the client goes away, such as when it is interrupted; the
+	// real ffprobe it was waiting for is then stopped too
+	signals := make(chan os.Signal, 1)
+	go func() {
+		reader.ReadByte()
+		signals <- syscall.SIGTERM
+	}()
+
+	var mu sync.Mutex
+	inv := &invocation{
+		Args:    request.Args,
+		Env:     append(os.Environ(), forwardedEnv(request.Env)...),
+		Cwd:     request.Cwd,
+		Stdout:  &frameWriter{conn: conn, stream: frameStdout, mu: &mu},
+		Stderr:  &frameWriter{conn: conn, stream: frameStderr, mu: &mu},
+		Signals: signals,
+	}
+
+	code := 1
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic while answering %v: %v", request.Args, r)
+			}
+		}()
+		code = runShim(inv)
+	}()
+
+	exit := make([]byte, 4)
+	binary.BigEndian.PutUint32(exit, uint32(int32(code)))
+	if err := writeFrame(conn, &mu, frameExit, exit); err != nil {
+		log.Printf("Error sending exit code to client: %v", err)
+	}
+}
+
+// Have the daemon answer a call, relaying its output. Returns false, without
+// having written anything, if the call should be answered in-process.
+func forwardToDaemon(inv *invocation) (int, bool) {
+	if DAEMON_SOCKET == "" {
+		return 0, false
+	}
+	if _, useShim := inv.lookupEnv("USE_FFPROBE_SHIM"); !useShim {
+		return 0, false
+	}
+
+	// Calls that pass through to the real ffprobe, or that need our stdin,
+	// gain nothing from the daemon
+	opts, err := parseFFProbeArgs(inv.Args)
+	if err != nil || opts.InputPath == "" || opts.isInfoRequest() {
+		return 0, false
+	}
+
+	// Whoever answers on the socket gets to see the arguments, so it has to
+	// be a daemon of this user
+	info, err := os.Lstat(DAEMON_SOCKET)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return 0, false
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		log.Printf("Not using %s, which belongs to uid %d", DAEMON_SOCKET, stat.Uid)
+		return 0, false
+	}
+
+	conn, err := net.DialTimeout("unix", DAEMON_SOCKET, daemonDialTimeout)
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+	if uid, known := peerUID(conn); known && uid != os.Getuid() {
+		log.Printf("Not using the daemon on %s, which runs as uid %d", DAEMON_SOCKET, uid)
+		return 0, false
+	}
+
+	request, err := json.Marshal(DaemonRequest{Args: inv.Args, Env: forwardedEnv(inv.Env), Cwd: inv.Cwd})
+	if err != nil {
+		return 0, false
+	}
+	if _, err := conn.Write(append(request, '\n')); err != nil {
+		log.Printf("Error sending request to daemon: %v", err)
+		return 0, false
+	}
+
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 5)
+	relayed := false
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			log.Printf("Daemon connection lost: %v", err)
+			if !relayed {
+				return 0, false
+			}
+			return 1, true
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			log.Printf("Daemon connection lost: %v", err)
+			return 1, true
+		}
+		relayed = true
+
+		switch header[0] {
+		case frameStdout:
+			inv.Stdout.Write(data)
+		case frameStderr:
+			inv.Stderr.Write(data)
+		case frameExit:
+			if len(data) != 4 {
+				return 1, true
+			}
+			return int(int32(binary.BigEndian.Uint32(data))), true
+		}
+	}
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Sample aspect ratios by aspect_ratio_idc, shared by H.264 and HEVC
+var VUI_ASPECT_RATIOS = [][2]int64{
+	{0, 1}, {1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11},
+	{32, 11}, {80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+// Frame rates by MPEG-2 frame_rate_code
+var MPEG2_FRAME_RATES = []string{"0/0", "24000/1001", "24/1", "25/1", "30000/1001", "30/1", "50/1", "60000/1001", "60/1"}
+
+// Display aspect ratios by MPEG-2 aspect_ratio_information
+var MPEG2_ASPECT_RATIOS = [][2]int64{{0, 1}, {1, 1}, {4, 3}, {16, 9}, {221, 100}}
+
+// AC-3 bitrates in kbit/s by frmsizecod/2, and sample rates by fscod
+var (
+	AC3_BITRATES     = []int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640}
+	AC3_SAMPLE_RATES = []int{48000, 44100, 32000}
+)
+
+// E-AC-3 audio blocks per frame by numblkscod
+var EAC3_BLOCKS = []int{1, 2, 3, 6}
+
+// AAC sample rates by sampling_frequency_index
+var AAC_SAMPLE_RATES = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// MPEG audio bitrates in kbit/s by bitrate_index, for MPEG-1 layer II, MPEG-1
+// layer III and MPEG-2 layers II and III
+var MPEG_AUDIO_BITRATES = [3][15]int{
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// MPEG-1 audio sample rates; MPEG-2 halves them and MPEG-2.5 quarters them
+var MPEG_AUDIO_SAMPLE_RATES = []int{44100, 48000, 32000}
+
+// DTS channels by AMODE, and sample rates by SFREQ
+var (
+	DTS_CHANNELS     = []int{1, 2, 2, 2, 2, 3, 3, 4, 4, 5, 6, 6, 6, 7, 8, 8}
+	DTS_SAMPLE_RATES = []int{0, 8000, 16000, 32000, 0, 0, 11025, 22050, 44100, 0, 0, 12000, 24000, 48000, 0, 0}
+)
+
+// Blu-ray LPCM channels by channel assignment, and sample rates by sampling frequency
+var (
+	PCM_BLURAY_CHANNELS     = []int{0, 1, 0, 2, 3, 3, 4, 4, 5, 6, 7, 8}
+	PCM_BLURAY_SAMPLE_RATES = map[byte]int{1: 48000, 4: 96000, 5: 192000}
+)
+
+// MPEG-4 Visual profiles by range of profile_and_level_indication, whose low
+// nibble is the level
+var MPEG4_VISUAL_PROFILES = []struct {
+	First, Last byte
+	Name        string
+}{
+	{0x01, 0x08, "Simple Profile"},
+	{0xf0, 0xf7, "Advanced Simple Profile"},
+}
+
+// bitReader reads the bits of a bitstream header, most significant first.
+// Reading past the end yields zeros and sets overrun.
+type bitReader struct {
+	data    []byte
+	pos     int
+	overrun bool
+}
+
+func (b *bitReader) bits(n int) uint64 {
+	var value uint64
+	for i := 0; i < n; i++ {
+		value <<= 1
+		if b.pos >= len(b.data)*8 {
+			b.overrun = true
+			continue
+		}
+		value |= uint64(b.data[b.pos/8]>>(7-b.pos%8)) & 1
+		b.pos++
+	}
+	return value
+}
+
+func (b *bitReader) skip(n int) {
+	b.bits(n)
+}
+
+// Unsigned Exp-Golomb code
+func (b *bitReader) ue() uint64 {
+	zeros := 0
+	for b.bits(1) == 0 {
+		if b.overrun || zeros == 32 {
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + b.bits(zeros)
+}
+
+// Signed Exp-Golomb code
+func (b *bitReader) se() int64 {
+	code := b.ue()
+	if code&1 != 0 {
+		return int64(code+1) / 2
+	}
+	return -int64(code / 2)
+}
+
+// NAL units of an Annex B byte stream, without their start codes
+func annexBUnits(data []byte) [][]byte {
+	var units [][]byte
+	start := -1
+	for i := 0; i+3 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			units = append(units, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		units = append(units, data[start:])
+	}
+	return units
+}
+
+// Remove the emulation prevention bytes of a NAL unit
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, c := range nal {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// Fill in a video stream from the sequence header found in the start of its
+// elementary stream; false if there is none
+func parseVideoHeader(stream *Stream, data []byte) bool {
+	switch stream.CodecName {
+	case "h264":
+		for _, nal := range annexBUnits(data) {
+			if len(nal) > 4 && nal[0]&0x1f == 7 {
+				return parseH264SPS(stream, unescapeRBSP(nal[1:]))
+			}
+		}
+	case "hevc":
+		for _, nal := range annexBUnits(data) {
+			if len(nal) > 4 && nal[0]>>1&0x3f == 33 {
+				return parseHEVCSPS(stream, unescapeRBSP(nal[2:]))
+			}
+		}
+	case "mpeg1video", "mpeg2video":
+		return parseMPEG2SequenceHeader(stream, data)
+	case "mpeg4":
+		return parseMPEG4VisualHeader(stream, data)
+	}
+	return false
+}
+
+// H.264 sequence parameter set (ITU-T H.264 7.3.2.1.1)
+func parseH264SPS(stream *Stream, sps []byte) bool {
+	b := &bitReader{data: sps}
+	profile := byte(b.bits(8))
+	constraints := byte(b.bits(8))
+	stream.Level = int(b.bits(8))
+	stream.Profile = H264_PROFILES[profile]
+	if profile == 66 && constraints&0x40 != 0 {
+		stream.Profile = "Constrained Baseline"
+	}
+	b.ue() // seq_parameter_set_id
+
+	chroma, depth := uint64(1), 8
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = b.ue()
+		if chroma == 3 {
+			b.skip(1) // separate_colour_plane_flag
+		}
+		depth = int(b.ue()) + 8
+		b.ue()    // bit_depth_chroma_minus8
+		b.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if b.bits(1) == 1 {
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if b.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int64(8), int64(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + b.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	if chroma > 3 || depth > 16 {
+		return false
+	}
+
+	b.ue() // log2_max_frame_num_minus4
+	switch b.ue() {
+	case 0:
+		b.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		b.skip(1)
+		b.se()
+		b.se()
+		for i, n := uint64(0), b.ue(); i < n && !b.overrun; i++ {
+			b.se()
+		}
+	}
+	b.ue()    // max_num_ref_frames
+	b.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := int(b.ue()) + 1
+	heightUnits := int(b.ue()) + 1
+	frameMbsOnly := int(b.bits(1))
+	if frameMbsOnly == 0 {
+		b.skip(1) // mb_adaptive_frame_field_flag
+	}
+	b.skip(1) // direct_8x8_inference_flag
+
+	cropX, cropY := 1, 2-frameMbsOnly
+	if chroma == 1 || chroma == 2 {
+		cropX = 2
+	}
+	if chroma == 1 {
+		cropY *= 2
+	}
+	var left, right, top, bottom int
+	if b.bits(1) == 1 {
+		left, right, top, bottom = int(b.ue()), int(b.ue()), int(b.ue()), int(b.ue())
+	}
+	if b.overrun {
+		return false
+	}
+
+	stream.CodedWidth = widthMbs * 16
+	stream.CodedHeight = heightUnits * 16 * (2 - frameMbsOnly)
+	stream.Width = stream.CodedWidth - cropX*(left+right)
+	stream.Height = stream.CodedHeight - cropY*(top+bottom)
+	stream.PixFmt = pixelFormat(int(chroma), depth)
+	stream.IsAVC = "false"
+	stream.NalLengthSize = "0"
+	if frameMbsOnly == 1 {
+		stream.FieldOrder = "progressive"
+	}
+	if chroma == 1 {
+		stream.ChromaLocation = "left"
+	}
+
+	sar := [2]int64{1, 1}
+	if b.bits(1) == 1 { // vui_parameters_present_flag
+		sar = readVUIHead(b, stream)
+		if b.bits(1) == 1 { // chroma_loc_info_present_flag
+			b.ue()
+			b.ue()
+		}
+		if b.bits(1) == 1 { // timing_info_present_flag
+			units, scale := int64(b.bits(32)), int64(b.bits(32))
+			if units > 0 && scale > 0 && !b.overrun {
+				g := gcd(scale, 2*units)
+				stream.RFrameRate = fmt.Sprintf("%d/%d", scale/g, 2*units/g)
+			}
+		}
+	}
+	setAspectRatios(stream, sar)
+	return true
+}
+
+// Aspect ratio, overscan and video signal type of a VUI, the start H.264 and
+// HEVC share; returns the sample aspect ratio
+func readVUIHead(b *bitReader, stream *Stream) [2]int64 {
+	sar := [2]int64{1, 1}
+	if b.bits(1) == 1 { // aspect_ratio_info_present_flag
+		idc := int(b.bits(8))
+		if idc == 255 {
+			sar = [2]int64{int64(b.bits(16)), int64(b.bits(16))}
+		} else if idc < len(VUI_ASPECT_RATIOS) {
+			sar = VUI_ASPECT_RATIOS[idc]
+		}
+	}
+	if b.bits(1) == 1 { // overscan_info_present_flag
+		b.skip(1)
+	}
+	if b.bits(1) == 1 { // video_signal_type_present_flag
+		b.skip(3) // video_format
+		stream.ColorRange = "tv"
+		if b.bits(1) == 1 {
+			stream.ColorRange = "pc"
+		}
+		if b.bits(1) == 1 { // colour_description_present_flag
+			stream.ColorPrimaries = COLOR_PRIMARIES[b.bits(8)]
+			stream.ColorTransfer = COLOR_TRANSFERS[b.bits(8)]
+			stream.ColorSpace = COLOR_SPACES[b.bits(8)]
+		}
+	}
+	return sar
+}
+
+func setAspectRatios(stream *Stream, sar [2]int64) {
+	if sar[0] <= 0 || sar[1] <= 0 {
+		sar = [2]int64{1, 1}
+	}
+	stream.SampleAspectRatio = reducedRatio(sar[0], sar[1])
+	stream.DisplayAspectRatio = reducedRatio(int64(stream.Width)*sar[0], int64(stream.Height)*sar[1])
+}
+
+// HEVC sequence parameter set (ITU-T H.265 7.3.2.2)
+func parseHEVCSPS(stream *Stream, sps []byte) bool {
+	b := &bitReader{data: sps}
+	b.skip(4) // sps_video_parameter_set_id
+	maxSubLayers := int(b.bits(3))
+	b.skip(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level
+	b.skip(3) // general_profile_space, general_tier_flag
+	stream.Profile = HEVC_PROFILES[byte(b.bits(5))]
+	b.skip(32 + 48)
+	stream.Level = int(b.bits(8))
+	subLayerProfile := make([]bool, maxSubLayers)
+	subLayerLevel := make([]bool, maxSubLayers)
+	for i := 0; i < maxSubLayers; i++ {
+		subLayerProfile[i] = b.bits(1) == 1
+		subLayerLevel[i] = b.bits(1) == 1
+	}
+	if maxSubLayers > 0 {
+		b.skip(2 * (8 - maxSubLayers))
+	}
+	for i := 0; i < maxSubLayers; i++ {
+		if subLayerProfile[i] {
+			b.skip(88)
+		}
+		if subLayerLevel[i] {
+			b.skip(8)
+		}
+	}
+
+	b.ue() // sps_seq_parameter_set_id
+	chroma := b.ue()
+	if chroma == 3 {
+		b.skip(1) // separate_colour_plane_flag
+	}
+	width, height := int(b.ue()), int(b.ue())
+	var left, right, top, bottom int
+	if b.bits(1) == 1 {
+		left, right, top, bottom = int(b.ue()), int(b.ue()), int(b.ue()), int(b.ue())
+	}
+	depth := int(b.ue()) + 8
+	b.ue() // bit_depth_chroma_minus8
+	if b.overrun || chroma > 3 || depth > 16 {
+		return false
+	}
+
+	cropX, cropY := 1, 1
+	if chroma == 1 || chroma == 2 {
+		cropX = 2
+	}
+	if chroma == 1 {
+		cropY = 2
+	}
+	stream.CodedWidth, stream.CodedHeight = width, height
+	stream.Width = width - cropX*(left+right)
+	stream.Height = height - cropY*(top+bottom)
+	stream.PixFmt = pixelFormat(int(chroma), depth)
+	if chroma == 1 {
+		stream.ChromaLocation = "left"
+	}
+	setAspectRatios(stream, readHEVCVUI(b, stream, maxSubLayers))
+	return true
+}
+
+// Skip from log2_max_pic_order_cnt_lsb_minus4 of an HEVC SPS to its VUI and
+// read the start of it; returns the sample aspect ratio
+func readHEVCVUI(b *bitReader, stream *Stream, maxSubLayers int) [2]int64 {
+	pocBits := int(b.ue()) + 4
+	first := maxSubLayers
+	if b.bits(1) == 1 { // sps_sub_layer_ordering_info_present_flag
+		first = 0
+	}
+	for i := first; i <= maxSubLayers; i++ {
+		b.ue()
+		b.ue()
+		b.ue()
+	}
+	for i := 0; i < 6; i++ { // coding, transform block sizes and depths
+		b.ue()
+	}
+	if b.bits(1) == 1 && b.bits(1) == 1 { // scaling_list_enabled_flag, sps_scaling_list_data_present_flag
+		for size := 0; size < 4; size++ {
+			step := 1
+			if size == 3 {
+				step = 3
+			}
+			for matrix := 0; matrix < 6; matrix += step {
+				if b.bits(1) == 0 {
+					b.ue()
+					continue
+				}
+				coefficients := min(64, 1<<(4+size<<1))
+				if size > 1 {
+					b.se()
+				}
+				for i := 0; i < coefficients; i++ {
+					b.se()
+				}
+			}
+		}
+	}
+	b.skip(2)           // amp_enabled_flag, sample_adaptive_offset_enabled_flag
+	if b.bits(1) == 1 { // pcm_enabled_flag
+		b.skip(8)
+		b.ue()
+		b.ue()
+		b.skip(1)
+	}
+
+	sets := int(b.ue())
+	if sets > 64 {
+		return [2]int64{1, 1}
+	}
+	deltaPocs := make([]int, sets)
+	for i := 0; i < sets && !b.overrun; i++ {
+		if i > 0 && b.bits(1) == 1 { // inter_ref_pic_set_prediction_flag
+			b.skip(1)
+			b.ue()
+			for j := 0; j <= deltaPocs[i-1]; j++ {
+				used := b.bits(1) == 1
+				if used || b.bits(1) == 1 {
+					deltaPocs[i]++
+				}
+			}
+			continue
+		}
+		negative, positive := int(b.ue()), int(b.ue())
+		if negative+positive > 32 {
+			return [2]int64{1, 1}
+		}
+		for j := 0; j < negative+positive; j++ {
+			b.ue()
+			b.skip(1)
+		}
+		deltaPocs[i] = negative + positive
+	}
+	if b.bits(1) == 1 { // long_term_ref_pics_present_flag
+		for i, n := 0, int(b.ue()); i < n && i < 33; i++ {
+			b.skip(pocBits + 1)
+		}
+	}
+	b.skip(2)                        // sps_temporal_mvp_enabled_flag, strong_intra_smoothing_enabled_flag
+	if b.bits(1) == 0 || b.overrun { // vui_parameters_present_flag
+		return [2]int64{1, 1}
+	}
+	return readVUIHead(b, stream)
+}
+
+// MPEG-1/2 video sequence header, and the sequence extension after it
+func parseMPEG2SequenceHeader(stream *Stream, data []byte) bool {
+	at := bytes.Index(data, []byte{0, 0, 1, 0xb3})
+	if at < 0 || len(data) < at+12 {
+		return false
+	}
+	header := data[at+4:]
+	stream.Width = int(header[0])<<4 | int(header[1]>>4)
+	stream.Height = int(header[1]&0xf)<<8 | int(header[2])
+	stream.CodedWidth, stream.CodedHeight = stream.Width, stream.Height
+	if code := int(header[3] & 0xf); code < len(MPEG2_FRAME_RATES) {
+		stream.RFrameRate = MPEG2_FRAME_RATES[code]
+	}
+	stream.PixFmt = "yuv420p"
+	stream.ChromaLocation = "left"
+
+	dar := [2]int64{1, 1}
+	if code := int(header[3] >> 4); code > 1 && code < len(MPEG2_ASPECT_RATIOS) {
+		dar = MPEG2_ASPECT_RATIOS[code]
+	}
+	sar := [2]int64{1, 1}
+	if dar != [2]int64{1, 1} && stream.Width > 0 && stream.Height > 0 {
+		sar = [2]int64{dar[0] * int64(stream.Height), dar[1] * int64(stream.Width)}
+	}
+	setAspectRatios(stream, sar)
+
+	if ext := bytes.Index(data[at:], []byte{0, 0, 1, 0xb5}); ext >= 0 && len(data) >= at+ext+6 && data[at+ext+4]>>4 == 1 {
+		b := &bitReader{data: data[at+ext+4:]}
+		b.skip(5) // extension_start_code_identifier, escape bit
+		stream.Profile = map[uint64]string{1: "High", 2: "Spatially Scalable", 3: "SNR Scalable", 4: "Main", 5: "Simple"}[b.bits(3)]
+		stream.Level = int(b.bits(4))
+		if b.bits(1) == 1 {
+			stream.FieldOrder = "progressive"
+		}
+		if b.bits(2) == 2 {
+			stream.PixFmt = "yuv422p"
+		}
+	}
+	return true
+}
+
+// MPEG-4 Part 2 visual object sequence header, for the profile and level
+func parseMPEG4VisualHeader(stream *Stream, data []byte) bool {
+	for i := 0; i+4 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 || data[i+3] != 0xb0 {
+			continue
+		}
+		indication := data[i+4]
+		for _, profile := range MPEG4_VISUAL_PROFILES {
+			if indication >= profile.First && indication <= profile.Last {
+				stream.Profile = profile.Name
+				stream.Level = int(indication & 0x0f)
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// Fill in an audio stream from the first frame header in data; false if
+// there is none
+func parseAudioHeader(stream *Stream, data []byte) bool {
+	switch stream.CodecName {
+	case "ac3", "eac3":
+		return parseAC3Frame(stream, data)
+	case "aac":
+		return parseADTSFrame(stream, data)
+	case "mp2", "mp3":
+		return parseMPEGAudioFrame(stream, data)
+	case "dts":
+		return parseDTSFrame(stream, data)
+	case "pcm_bluray":
+		return parsePCMBlurayHeader(stream, data)
+	}
+	return false
+}
+
+// AC-3 and E-AC-3 syncframe header (ATSC A/52)
+func parseAC3Frame(stream *Stream, data []byte) bool {
+	at := bytes.Index(data, []byte{0x0b, 0x77})
+	if at < 0 || len(data) < at+8 {
+		return false
+	}
+	frame := data[at:]
+	b := &bitReader{data: frame[5:]}
+	bsid := int(frame[5] >> 3)
+	if bsid > 10 {
+		// E-AC-3 header fields follow the sync word directly
+		b = &bitReader{data: frame[2:]}
+		b.skip(5) // strmtyp, substreamid
+		frameSize := int(b.bits(11)+1) * 2
+		fscod := int(b.bits(2))
+		blocks := 6
+		sampleRate := 0
+		if fscod == 3 {
+			reduced := int(b.bits(2)) // fscod2
+			if reduced >= len(AC3_SAMPLE_RATES) {
+				return false
+			}
+			sampleRate = AC3_SAMPLE_RATES[reduced] / 2
+		} else {
+			sampleRate = AC3_SAMPLE_RATES[fscod]
+			blocks = EAC3_BLOCKS[b.bits(2)]
+		}
+		acmod := int(b.bits(3))
+		lfe := int(b.bits(1))
+		stream.CodecName = "eac3"
+		stream.SampleRate = strconv.Itoa(sampleRate)
+		stream.Channels = AC3_CHANNELS[acmod] + lfe
+		stream.BitRate = strconv.Itoa(frameSize * 8 * sampleRate / (256 * blocks))
+		return true
+	}
+
+	fscod := int(frame[4] >> 6)
+	rate := int(frame[4]&0x3f) >> 1
+	if fscod > 2 || rate >= len(AC3_BITRATES) {
+		return false
+	}
+	b.skip(8) // bsid, bsmod
+	acmod := int(b.bits(3))
+	if acmod&1 != 0 && acmod != 1 {
+		b.skip(2) // cmixlev
+	}
+	if acmod&4 != 0 {
+		b.skip(2) // surmixlev
+	}
+	if acmod == 2 {
+		b.skip(2) // dsurmod
+	}
+	lfe := int(b.bits(1))
+	stream.CodecName = "ac3"
+	stream.SampleRate = strconv.Itoa(AC3_SAMPLE_RATES[fscod])
+	stream.Channels = AC3_CHANNELS[acmod] + lfe
+	stream.BitRate = strconv.Itoa(AC3_BITRATES[rate] * 1000)
+	return true
+}
+
+// AAC ADTS frame header (ISO/IEC 13818-7)
+func parseADTSFrame(stream *Stream, data []byte) bool {
+	for i := 0; i+7 <= len(data); i++ {
+		if data[i] != 0xff || data[i+1]&0xf6 != 0xf0 {
+			continue
+		}
+		rateIndex := int(data[i+2] >> 2 & 0xf)
+		if rateIndex >= len(AAC_SAMPLE_RATES) {
+			continue
+		}
+		stream.Profile = AAC_PROFILES[data[i+2]>>6+1]
+		stream.SampleRate = strconv.Itoa(AAC_SAMPLE_RATES[rateIndex])
+		channels := int(data[i+2]&1)<<2 | int(data[i+3]>>6)
+		if channels == 7 {
+			channels = 8
+		}
+		stream.Channels = channels
+		return true
+	}
+	return false
+}
+
+// MPEG audio frame header (ISO/IEC 11172-3)
+func parseMPEGAudioFrame(stream *Stream, data []byte) bool {
+	for i := 0; i+4 <= len(data); i++ {
+		if data[i] != 0xff || data[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		header := binary.BigEndian.Uint32(data[i:])
+		version := header >> 19 & 3 // 3 is MPEG-1, 2 MPEG-2, 0 MPEG-2.5
+		layer := header >> 17 & 3   // 2 is layer II, 1 layer III
+		rateIndex := int(header >> 12 & 0xf)
+		sampleIndex := int(header >> 10 & 3)
+		if version == 1 || (layer != 1 && layer != 2) || rateIndex == 0 || rateIndex == 15 || sampleIndex == 3 {
+			continue
+		}
+
+		table := 2
+		if version == 3 {
+			table = 2 - int(layer)
+		}
+		sampleRate := MPEG_AUDIO_SAMPLE_RATES[sampleIndex]
+		switch version {
+		case 2:
+			sampleRate /= 2
+		case 0:
+			sampleRate /= 4
+		}
+		stream.CodecName = "mp2"
+		if layer == 1 {
+			stream.CodecName = "mp3"
+		}
+		stream.SampleRate = strconv.Itoa(sampleRate)
+		stream.BitRate = strconv.Itoa(MPEG_AUDIO_BITRATES[table][rateIndex] * 1000)
+		stream.Channels = 2
+		if header>>6&3 == 3 {
+			stream.Channels = 1
+		}
+		return true
+	}
+	return false
+}
+
+// DTS core frame header (ETSI TS 102 114)
+func parseDTSFrame(stream *Stream, data []byte) bool {
+	at := bytes.Index(data, []byte{0x7f, 0xfe, 0x80, 0x01})
+	if at < 0 || len(data) < at+11 {
+		return false
+	}
+	b := &bitReader{data: data[at+4:]}
+	b.skip(1 + 5 + 1 + 7 + 14) // FTYPE, SHORT, CPF, NBLKS, FSIZE
+	amode := int(b.bits(6))
+	sampleRate := DTS_SAMPLE_RATES[b.bits(4)]
+	b.skip(5 + 5)     // RATE, MIX/DYNF/TIMEF/AUXF/HDCD
+	b.skip(3 + 1 + 1) // EXT_AUDIO_ID, EXT_AUDIO, ASPF
+	lfe := b.bits(2)
+	if amode >= len(DTS_CHANNELS) || sampleRate == 0 {
+		return false
+	}
+	stream.SampleRate = strconv.Itoa(sampleRate)
+	stream.Channels = DTS_CHANNELS[amode]
+	if lfe != 0 {
+		stream.Channels++
+	}
+	setDefault(&stream.Profile, "DTS")
+	return true
+}
+
+// Header of a Blu-ray LPCM PES payload
+func parsePCMBlurayHeader(stream *Stream, data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	assignment := int(data[2] >> 4)
+	sampleRate, known := PCM_BLURAY_SAMPLE_RATES[data[2]&0xf]
+	bits := []int{0, 16, 20, 24}[data[3]>>6]
+	if assignment >= len(PCM_BLURAY_CHANNELS) || PCM_BLURAY_CHANNELS[assignment] == 0 || !known || bits == 0 {
+		return false
+	}
+	stream.SampleRate = strconv.Itoa(sampleRate)
+	stream.Channels = PCM_BLURAY_CHANNELS[assignment]
+	stream.BitsPerRawSample = strconv.Itoa(bits)
+	stream.SampleFmt = "s16"
+	if bits > 16 {
+		stream.SampleFmt = "s32"
+	}
+	stream.BitRate = strconv.Itoa(sampleRate * bits * stream.Channels)
+	return true
+}
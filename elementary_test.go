@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// bitWriter writes the bits of a bitstream header, most significant first
+type bitWriter struct {
+	data []byte
+	bits int
+}
+
+func (w *bitWriter) put(n int, value uint64) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(value>>i&1) << (7 - w.bits%8)
+		w.bits++
+	}
+}
+
+// Unsigned Exp-Golomb code
+func (w *bitWriter) ue(value uint64) {
+	n := 0
+	for value+1 >= 1<<(n+1) {
+		n++
+	}
+	w.put(n, 0)
+	w.put(n+1, value+1)
+}
+
+// A NAL unit with the RBSP of w, its stop bit, and emulation prevention bytes
+func (w *bitWriter) nal(header ...byte) []byte {
+	w.put(1, 1)
+	out := append([]byte(nil), header...)
+	zeros := 0
+	for _, c := range w.data {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// SPS of a High profile 1920x1080 H.264 stream at level 4.0, with BT.709
+// colors and 24000/1001 frames per second
+func h264SPS() []byte {
+	w := &bitWriter{}
+	w.put(24, 100<<16|40)
+	w.ue(0) // seq_parameter_set_id
+	w.ue(1) // 4:2:0
+	w.ue(0)
+	w.ue(0)
+	w.put(2, 0)
+	w.ue(0)
+	w.ue(0) // pic_order_cnt_type
+	w.ue(2)
+	w.ue(4)
+	w.put(1, 0)
+	w.ue(119) // 120 macroblocks wide
+	w.ue(67)  // 68 high
+	w.put(3, 7)
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(4) // 8 lines cropped at the bottom
+	w.put(1, 1)
+	w.put(9, 1<<8|1) // square pixels
+	w.put(1, 0)
+	w.put(6, 1<<5|5<<2|1) // video signal type with a colour description
+	w.put(24, 0x010101)
+	w.put(1, 0)
+	w.put(1, 1)
+	w.put(32, 1001)
+	w.put(32, 48000)
+	return w.nal(0x67)
+}
+
+// SPS of a Main 10 3840x2160 HEVC stream at level 5.1, with BT.2020 PQ colors
+func hevcSPS() []byte {
+	w := &bitWriter{}
+	w.put(8, 1) // one sub-layer, temporal ID nesting
+	w.put(8, 2) // Main 10
+	w.put(80, 0)
+	w.put(8, 153)
+	w.ue(0)
+	w.ue(1)
+	w.ue(3840)
+	w.ue(2160)
+	w.put(1, 0)
+	w.ue(2)
+	w.ue(2)
+	w.ue(4) // log2_max_pic_order_cnt_lsb_minus4
+	w.put(1, 1)
+	for i := 0; i < 9; i++ {
+		w.ue(0)
+	}
+	w.put(4, 0) // no scaling lists, AMP, SAO or PCM
+	w.ue(0)     // short-term reference picture sets
+	w.put(3, 0)
+	w.put(1, 1)
+	w.put(9, 1<<8|1)
+	w.put(1, 0)
+	w.put(6, 1<<5|5<<2|1)
+	w.put(24, 9<<16|16<<8|9)
+	return w.nal(0x42, 0x01)
+}
+
+// NAL units in an Annex B byte stream
+func annexB(units ...[]byte) []byte {
+	var out []byte
+	for _, unit := range units {
+		out = append(append(out, 0, 0, 0, 1), unit...)
+	}
+	return out
+}
+
+// A DTS core frame header with 5.1 channels at 48 kHz
+func dtsHeader() []byte {
+	w := &bitWriter{data: []byte{0x7f, 0xfe, 0x80, 0x01}, bits: 32}
+	w.put(1+5+1, 1<<6|31<<1)
+	w.put(7, 15)
+	w.put(14, 2012)
+	w.put(6, 9)  // 5 channels
+	w.put(4, 13) // 48 kHz
+	w.put(15, 0)
+	w.put(2, 1) // LFE
+	w.put(8, 0)
+	return w.data
+}
+
+func TestParseVideoHeader(t *testing.T) {
+	tests := []struct {
+		codec string
+		data  []byte
+		want  string // Size, profile, level, pixel format, frame rate, aspect ratio and colors; empty if rejected
+	}{
+		{"h264", annexB([]byte{0x09, 0xf0}, h264SPS(), []byte{0x68, 0xce}),
+			"1920x1080 High 40 yuv420p 24000/1001 16:9 progressive bt709/bt709/bt709/tv"},
+		{"h264", annexB([]byte{0x09, 0xf0}), ""},
+		{"h264", annexB(h264SPS()[:6]), ""},
+		{"hevc", annexB(hevcSPS()), "3840x2160 Main 10 153 yuv420p10le  16:9  bt2020/smpte2084/bt2020nc/tv"},
+		// 720x576 at 25 frames per second, 4:3 Main profile at Main level
+		{"mpeg2video", []byte{0, 0, 1, 0xb3, 0x2d, 0x02, 0x40, 0x23, 0xff, 0xff, 0xe0, 0x18, 0, 0, 1, 0xb5, 0x14, 0x8a},
+			"720x576 Main 8 yuv420p 25/1 4:3 progressive ///"},
+		{"mpeg1video", []byte{0, 0, 1, 0xb3, 0x16, 0x01, 0x20, 0x11, 0xff, 0xff, 0xe0, 0x18}, "352x288  0 yuv420p 24000/1001 11:9  ///"},
+		{"mpeg2video", []byte{0, 0, 1, 0xb3, 0x2d, 0x02}, ""},
+		{"mpeg4", []byte{0, 0, 1, 0xb0, 0xf5}, "0x0 Advanced Simple Profile 5     ///"},
+		{"mpeg4", []byte{0, 0, 1, 0xb0, 0x50}, ""},
+		{"vc1", []byte{0, 0, 1, 0x0f}, ""},
+	}
+	for _, test := range tests {
+		stream := Stream{CodecName: test.codec}
+		got := ""
+		if parseVideoHeader(&stream, test.data) {
+			got = fmt.Sprintf("%dx%d %s %d %s %s %s %s %s/%s/%s/%s", stream.Width, stream.Height, stream.Profile, stream.Level,
+				stream.PixFmt, stream.RFrameRate, stream.DisplayAspectRatio, stream.FieldOrder,
+				stream.ColorPrimaries, stream.ColorTransfer, stream.ColorSpace, stream.ColorRange)
+		}
+		if got != test.want {
+			t.Errorf("%s header % x gave %q, want %q", test.codec, test.data, got, test.want)
+		}
+	}
+}
+
+func TestParseAudioHeader(t *testing.T) {
+	tests := []struct {
+		codec string
+		data  []byte
+		want  string // Codec, profile, sample rate, channels, bit rate and bits; empty if rejected
+	}{
+		// 5.1 at 640 kbit/s, and stereo with Dolby Surround at 44.1 kHz
+		{"ac3", []byte{0xff, 0x0b, 0x77, 0, 0, 36, 0x40, 0xe1, 0}, "ac3  48000 6 640000 "},
+		{"ac3", []byte{0x0b, 0x77, 0, 0, 0x5c, 0x40, 0x40, 0}, "ac3  44100 2 384000 "},
+		{"ac3", []byte{0x0b, 0x77, 0, 0, 0xc0, 0x40, 0, 0}, ""},
+		{"ac3", []byte{0x0b, 0x77, 0, 0}, ""},
+		// E-AC-3 5.1 with 1536-byte frames of 6 blocks
+		{"ac3", []byte{0x0b, 0x77, 0x02, 0xff, 0x3f, 0x80, 0, 0}, "eac3  48000 6 384000 "},
+		{"eac3", []byte{0x0b, 0x77, 0x30, 0x30, 0xff, 0x58, 0x30, 0x30}, ""},
+		{"aac", []byte{0, 0xff, 0xf1, 0x4c, 0x80, 0x2e, 0x7f, 0xfc}, "aac LC 48000 2  "},
+		{"aac", []byte{0xff, 0xf1, 0x7c, 0x80, 0x2e, 0x7f, 0xfc}, ""},
+		{"mp3", []byte{0xff, 0xfb, 0x90, 0x64}, "mp3  44100 2 128000 "},
+		{"mp2", []byte{0xff, 0xfd, 0x84, 0xc0}, "mp2  48000 1 128000 "},
+		{"mp2", []byte{0xff, 0xf5, 0x84, 0xc0}, "mp2  24000 1 64000 "},
+		{"mp2", []byte{0xff, 0xfd, 0xf4, 0xc0}, ""},
+		{"dts", dtsHeader(), "dts DTS 48000 6  "},
+		{"dts", dtsHeader()[:10], ""},
+		{"pcm_bluray", []byte{0, 0, 0x31, 0x40}, "pcm_bluray  48000 2 1536000 16"},
+		{"pcm_bluray", []byte{0, 0, 0x94, 0xc0}, "pcm_bluray  96000 6 13824000 24"},
+		{"pcm_bluray", []byte{0, 0, 0x21, 0x40}, ""},
+		{"truehd", []byte{0xf8, 0x72, 0x6f, 0xba}, ""},
+	}
+	for _, test := range tests {
+		stream := Stream{CodecName: test.codec}
+		got := ""
+		if parseAudioHeader(&stream, test.data) {
+			got = fmt.Sprintf("%s %s %s %d %s %s", stream.CodecName, stream.Profile, stream.SampleRate, stream.Channels,
+				stream.BitRate, stream.BitsPerRawSample)
+		}
+		if got != test.want {
+			t.Errorf("%s header % x gave %q, want %q", test.codec, test.data, got, test.want)
+		}
+	}
+}
+
+func TestBitReader(t *testing.T) {
+	w := &bitWriter{}
+	for _, value := range []uint64{0, 1, 2, 7, 119, 1 << 20} {
+		w.ue(value)
+	}
+	w.put(7, 0b1010011)
+	b := &bitReader{data: w.data}
+	for _, want := range []uint64{0, 1, 2, 7, 119, 1 << 20} {
+		if got := b.ue(); got != want {
+			t.Errorf("ue() = %d, want %d", got, want)
+		}
+	}
+	for _, want := range []int64{0, 1, -1} {
+		// The codes of 0, 1 and -1 are 1, 010 and 011
+		if got := b.se(); got != want {
+			t.Errorf("se() = %d, want %d", got, want)
+		}
+	}
+	if b.overrun {
+		t.Error("overrun within the data")
+	}
+	b.bits(16)
+	if !b.overrun {
+		t.Error("no overrun past the end")
+	}
+}
+
+func TestAnnexBUnits(t *testing.T) {
+	units := annexBUnits([]byte{0xff, 0, 0, 0, 1, 0x09, 0xf0, 0, 0, 1, 0x67, 0, 0, 3, 1, 0, 0, 0, 1, 0x68})
+	want := [][]byte{{0x09, 0xf0}, {0x67, 0, 0, 3, 1}, {0x68}}
+	if fmt.Sprint(units) != fmt.Sprint(want) {
+		t.Errorf("units %v, want %v", units, want)
+	}
+	if got := unescapeRBSP(units[1]); !bytes.Equal(got, []byte{0x67, 0, 0, 1}) {
+		t.Errorf("unescaped % x", got)
+	}
+	if units := annexBUnits([]byte{1, 2, 3}); units != nil {
+		t.Errorf("units %v without a start code", units)
+	}
+}
+
+func FuzzParseHeaders(f *testing.F) {
+	f.Add(annexB(h264SPS()))
+	f.Add(annexB(hevcSPS()))
+	f.Add(dtsHeader())
+	f.Add([]byte{0x0b, 0x77, 0x02, 0xff, 0x3f, 0x80, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, codec := range []string{"h264", "hevc", "mpeg2video", "mpeg4"} {
+			parseVideoHeader(&Stream{CodecName: codec}, data)
+		}
+		for _, codec := range []string{"ac3", "aac", "mp2", "dts", "pcm_bluray"} {
+			parseAudioHeader(&Stream{CodecName: codec}, data)
+		}
+	})
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	ptn "github.com/middelink/go-parse-torrent-name"
@@ -22,6 +28,45 @@ var REAL_FFPROBE = func() string {
 	return "/usr/bin/ffprobe.real" // Default value
 }()
 
+// Read a setting from the environment, with a default
+func envOrDefault(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
+
+// Problems with settings found before logging is initialized, logged by init
+var configWarnings []string
+
+// Read an integer setting from the environment, with a default
+func envInt(key string, defaultValue int) int {
+	value := envOrDefault(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		configWarnings = append(configWarnings, fmt.Sprintf("Invalid %s %q, using %d: %v", key, value, defaultValue, err))
+		return defaultValue
+	}
+	return n
+}
+
+// Read a duration setting (such as "30s") from the environment, with a default
+func envDuration(key string, defaultValue time.Duration) time.Duration {
+	value := envOrDefault(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		configWarnings = append(configWarnings, fmt.Sprintf("Invalid %s %q, using %s: %v", key, value, defaultValue, err))
+		return defaultValue
+	}
+	return d
+}
+
 // Init logging
 func init() {
 	logFile, err := os.OpenFile("/tmp/ffprobe-shim.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -33,12 +78,17 @@ func init() {
 	log.SetOutput(logFile)
 	log.Println("Logging initialized")
 	log.Printf("Using REAL_FFPROBE path: %s", REAL_FFPROBE)
+	for _, warning := range configWarnings {
+		log.Println(warning)
+	}
+	loadConfig()
 }
 
 // Pattern and template types
 type PatternInfo struct {
-	Pattern  string
-	Template string
+	Pattern  string   `json:"pattern"`
+	Template string   `json:"template"`
+	Overlays []string `json:"overlays,omitempty"`
 }
 
 // Stream represents an ffprobe media stream
@@ -68,6 +118,12 @@ type Stream struct {
 	ChromaLocation     string            `json:"chroma_location,omitempty"`
 	FieldOrder         string            `json:"field_order,omitempty"`
 	Refs               int               `json:"refs,omitempty"`
+	SampleFmt          string            `json:"sample_fmt,omitempty"`
+	SampleRate         string            `json:"sample_rate,omitempty"`
+	Channels           int               `json:"channels,omitempty"`
+	ChannelLayout      string            `json:"channel_layout,omitempty"`
+	BitsPerSample      int               `json:"bits_per_sample,omitempty"`
+	InitialPadding     int               `json:"initial_padding,omitempty"`
 	IsAVC              string            `json:"is_avc,omitempty"`
 	NalLengthSize      string            `json:"nal_length_size,omitempty"`
 	ID                 string            `json:"id,omitempty"`
@@ -79,21 +135,25 @@ type Stream struct {
 	DurationTS         int64             `json:"duration_ts,omitempty"`
 	Duration           string            `json:"duration,omitempty"`
 	BitRate            string            `json:"bit_rate,omitempty"`
+	MaxBitRate         string            `json:"max_bit_rate,omitempty"`
 	BitsPerRawSample   string            `json:"bits_per_raw_sample,omitempty"`
 	NbFrames           string            `json:"nb_frames,omitempty"`
+	NbReadFrames       string            `json:"nb_read_frames,omitempty"`
+	NbReadPackets      string            `json:"nb_read_packets,omitempty"`
 	ExtradataSize      int               `json:"extradata_size,omitempty"`
 	Disposition        map[string]int    `json:"disposition,omitempty"`
 	Tags               map[string]string `json:"tags,omitempty"`
 	SideDataList       []SideData        `json:"side_data_list,omitempty"`
-	Channels           int               `json:"channels,omitempty"`       // Add this field
-	SampleRate         string            `json:"sample_rate,omitempty"`    // Add this field
+
+	// The stream as the real ffprobe printed it, when it comes from one
+	raw jsonObject
 }
 
 // Format represents ffprobe format information
 type Format struct {
 	Filename       string            `json:"filename"`
 	NbStreams      int               `json:"nb_streams"`
-	NbPrograms     int               `json:"nb_programs,omitempty"`
+	NbPrograms     int               `json:"nb_programs"`
 	FormatName     string            `json:"format_name"`
 	FormatLongName string            `json:"format_long_name"`
 	StartTime      string            `json:"start_time,omitempty"`
@@ -102,27 +162,129 @@ type Format struct {
 	BitRate        string            `json:"bit_rate,omitempty"`
 	ProbeScore     int               `json:"probe_score,omitempty"`
 	Tags           map[string]string `json:"tags,omitempty"`
+
+	raw jsonObject
 }
 
 // Chapter represents a media chapter
 type Chapter struct {
-	Index int     `json:"index"`
-	Start float64 `json:"start"`
-	End   float64 `json:"end"`
-	Title string  `json:"title"`
+	ID        int64             `json:"id"`
+	TimeBase  string            `json:"time_base"`
+	Start     int64             `json:"start"`
+	StartTime string            `json:"start_time"`
+	End       int64             `json:"end"`
+	EndTime   string            `json:"end_time"`
+	Tags      map[string]string `json:"tags,omitempty"`
+
+	raw jsonObject
+}
+
+// Program represents a program (service) of a multi-program container
+type Program struct {
+	ProgramID  int               `json:"program_id"`
+	ProgramNum int               `json:"program_num"`
+	NbStreams  int               `json:"nb_streams"`
+	PmtPid     int               `json:"pmt_pid"`
+	PcrPid     int               `json:"pcr_pid"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Streams    []Stream          `json:"streams"`
+
+	raw jsonObject
 }
 
 // SideData represents side data information
 type SideData struct {
 	SideDataType string `json:"side_data_type"`
 	ServiceType  int    `json:"service_type,omitempty"`
+
+	// Fields specific to the side data type (DOVI configuration, mastering
+	// display metadata, ...), in the order ffprobe prints them
+	Fields []SideDataField `json:"-"`
+}
+
+// SideDataField is a type-specific side data value, either a string or an int64
+type SideDataField struct {
+	Key   string
+	Value interface{}
+}
+
+// Marshal side data with the type-specific fields inline
+func (sd SideData) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"side_data_type":`)
+	value, err := json.Marshal(sd.SideDataType)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(value)
+	if sd.ServiceType != 0 {
+		fmt.Fprintf(&buf, `,"service_type":%d`, sd.ServiceType)
+	}
+	for _, field := range sd.Fields {
+		key, err := json.Marshal(field.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Unmarshal side data, keeping type-specific fields in their original order
+func (sd *SideData) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := token.(string)
+
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return err
+		}
+
+		switch v := value.(type) {
+		case string:
+			if key == "side_data_type" {
+				sd.SideDataType = v
+			} else {
+				sd.Fields = append(sd.Fields, SideDataField{Key: key, Value: v})
+			}
+		case json.Number:
+			n, err := v.Int64()
+			if err != nil {
+				// Non-integer numbers are kept in their textual form
+				sd.Fields = append(sd.Fields, SideDataField{Key: key, Value: v.String()})
+			} else if key == "service_type" {
+				sd.ServiceType = int(n)
+			} else {
+				sd.Fields = append(sd.Fields, SideDataField{Key: key, Value: n})
+			}
+		}
+	}
+	return nil
 }
 
 // FFProbeResponse represents the full ffprobe output structure
 type FFProbeResponse struct {
+	Programs []Program `json:"programs,omitempty"`
 	Streams  []Stream  `json:"streams"`
-	Format   Format    `json:"format"`
 	Chapters []Chapter `json:"chapters,omitempty"`
+	Format   Format    `json:"format"`
 }
 
 // Define pattern matching for different file types
@@ -139,6 +301,41 @@ var PATTERNS = []PatternInfo{
 	},
 }
 
+// A pattern compiled once per process, rather than on every match
+type compiledPattern struct {
+	Regexp   *regexp.Regexp
+	Template string
+}
+
+var compiledPatterns = compilePatterns(PATTERNS)
+
+// Years that look like a movie release year
+var YEAR_PATTERN = regexp.MustCompile(`(19|20)\d{2}`)
+
+// Compile patterns, skipping invalid ones
+func compilePatterns(patterns []PatternInfo) []compiledPattern {
+	var compiled []compiledPattern
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern.Pattern)
+		if err != nil {
+			log.Printf("Ignoring invalid pattern %q: %v", pattern.Pattern, err)
+			continue
+		}
+		compiled = append(compiled, compiledPattern{Regexp: re, Template: pattern.Template})
+	}
+	return compiled
+}
+
+// Template of the first pattern matching a file name
+func matchPatterns(filename string) string {
+	for _, pattern := range compiledPatterns {
+		if pattern.Regexp.MatchString(filename) {
+			return pattern.Template
+		}
+	}
+	return ""
+}
+
 // Base template responses
 var TEMPLATES = map[string]FFProbeResponse{
 	"tv_show": {
@@ -240,8 +437,9 @@ var AUDIO_CODEC_MAP = map[string]string{
 	"7.1":       "dts",    // Assuming 7.1 is often DTS
 }
 
-// Extract resolution and info from PTN metadata
-func enhanceResponseWithPTN(response *FFProbeResponse, filepath string) {
+// Extract resolution and info from PTN metadata, and fit the response to
+// the real size of the file
+func enhanceResponseWithPTN(response *FFProbeResponse, filepath string, size int64) {
     // Extract just the filename if it's a full path
     filename := filepath
     if strings.Contains(filepath, "/") {
@@ -402,37 +600,114 @@ func enhanceResponseWithPTN(response *FFProbeResponse, filepath string) {
         }
     }
 
-    // Set size based on quality and duration
-    fileSize := "0"
-    switch {
-    case info.Quality == "720p":
-        fileSize = "1000000000" // ~1GB for 720p
-    case info.Quality == "1080p":
-        fileSize = "3500000000" // ~3.5GB for 1080p
-    case info.Quality == "2160p" || info.Quality == "4K":
-        fileSize = "15000000000" // ~15GB for 4K
-    default:
-        fileSize = "2000000000" // Default ~2GB
-    }
+    // The bitrate of the video is known from its resolution, so the size
+    // tells the duration; otherwise the guessed duration tells the bitrate
+    applyFileSize(response, size, width != 0 && height != 0)
+}
 
-    response.Format.Size = fileSize
+// Fill the fields a configured template leaves empty with the guesses made
+// from the file name, then fit it to the size of the file
+func fillFromFilename(response *FFProbeResponse, filepath string, size int64) {
+	guessed := *response
+	guessed.Streams = append([]Stream(nil), response.Streams...)
+	enhanceResponseWithPTN(&guessed, filepath, size)
+
+	// Captured templates have bitrates but no duration, so the size tells it
+	bitrateKnown := false
+	if response.Format.Duration == "" {
+		for _, stream := range response.Streams {
+			if br, err := strconv.ParseInt(stream.BitRate, 10, 64); err == nil && br > 0 {
+				bitrateKnown = true
+			}
+		}
+		// Matroska streams have no bitrate of their own, only the file
+		if br, err := strconv.ParseInt(response.Format.BitRate, 10, 64); !bitrateKnown && err == nil && br > 0 && size > 0 {
+			response.Format.Duration = fmt.Sprintf("%.6f", float64(size)*8/float64(br))
+		}
+	}
 
-    // Set total bitrate (sum of audio and video)
-    totalBitRate := 0
-    for _, stream := range response.Streams {
-        br, err := strconv.Atoi(stream.BitRate)
-        if err == nil {
-            totalBitRate += br
-        }
-    }
+	for i := range response.Streams {
+		stream, guess := &response.Streams[i], guessed.Streams[i]
+		setDefault(&stream.CodecName, guess.CodecName)
+		setDefault(&stream.Profile, guess.Profile)
+		if stream.Width == 0 && stream.Height == 0 {
+			stream.Width, stream.Height = guess.Width, guess.Height
+		}
+		if stream.Channels == 0 {
+			stream.Channels = guess.Channels
+		}
+		if !bitrateKnown {
+			setDefault(&stream.BitRate, guess.BitRate)
+			// The template's own duration is better than a guess
+			if response.Format.Duration != "" && guess.Duration != "" {
+				guess.Duration = response.Format.Duration
+			}
+			setDefault(&stream.Duration, guess.Duration)
+		}
+	}
+	if !bitrateKnown {
+		setDefault(&response.Format.Duration, guessed.Format.Duration)
+	}
+	applyFileSize(response, size, bitrateKnown)
+}
 
-    if totalBitRate > 0 {
-        response.Format.BitRate = strconv.Itoa(totalBitRate)
-    }
+// Set the size of a response, and make its duration and bitrates agree with it
+func applyFileSize(response *FFProbeResponse, size int64, bitrateInferred bool) {
+	response.Format.Size = strconv.FormatInt(size, 10)
+
+	totalBitRate := int64(0)
+	for _, stream := range response.Streams {
+		if br, err := strconv.ParseInt(stream.BitRate, 10, 64); err == nil {
+			totalBitRate += br
+		}
+	}
+	duration, _ := strconv.ParseFloat(response.Format.Duration, 64)
+
+	switch {
+	case size > 0 && bitrateInferred && totalBitRate > 0:
+		seconds := fmt.Sprintf("%.6f", float64(size)*8/float64(totalBitRate))
+		response.Format.Duration = seconds
+		for i := range response.Streams {
+			if response.Streams[i].CodecType == "video" || response.Streams[i].CodecType == "audio" {
+				response.Streams[i].Duration = seconds
+			}
+		}
+		response.Format.BitRate = strconv.FormatInt(totalBitRate, 10)
+	case size > 0 && duration > 0:
+		bitRate := int64(float64(size) * 8 / duration)
+		scaleStreamBitRates(response.Streams, totalBitRate, bitRate)
+		response.Format.BitRate = strconv.FormatInt(bitRate, 10)
+	case totalBitRate > 0:
+		response.Format.BitRate = strconv.FormatInt(totalBitRate, 10)
+	}
+}
+
+// Scale the bitrates of streams that have one so that they sum to a total;
+// the last one takes the rounding error
+func scaleStreamBitRates(streams []Stream, currentTotal, total int64) {
+	if currentTotal <= 0 {
+		return
+	}
+	last := -1
+	remaining := total
+	for i := range streams {
+		br, err := strconv.ParseInt(streams[i].BitRate, 10, 64)
+		if err != nil {
+			continue
+		}
+		scaled := br * total / currentTotal
+		streams[i].BitRate = strconv.FormatInt(scaled, 10)
+		remaining -= scaled
+		last = i
+	}
+	if last >= 0 {
+		br, _ := strconv.ParseInt(streams[last].BitRate, 10, 64)
+		streams[last].BitRate = strconv.FormatInt(br+remaining, 10)
+	}
 }
 
 // Detect which template to use based on file path
-func detectFileTemplate(filepath string) string {
+func detectFileTemplate(filepath string, container containerFormat) string {
 	filename := filepath
 
 	// Extract just the filename if it's a full path
@@ -440,6 +715,16 @@ func detectFileTemplate(filepath string) string {
 		filename = filepath[strings.LastIndex(filepath, "/")+1:]
 	}
 
+	// Patterns go by extension, so a misnamed file is matched by its container
+	filename = templateFilename(filename, container)
+
+	// Rules from the configuration file are meant to win over any guess
+	if rulesFirst {
+		if template := matchPatterns(filename); template != "" {
+			return template
+		}
+	}
+
 	// Try to parse with PTN first
 	info, err := ptn.Parse(filename)
 	if err == nil {
@@ -451,11 +736,8 @@ func detectFileTemplate(filepath string) string {
 	}
 
 	// Fall back to regex patterns if PTN doesn't yield clear results
-	for _, pattern := range PATTERNS {
-		matched, err := regexp.MatchString(pattern.Pattern, filename)
-		if err == nil && matched {
-			return pattern.Template
-		}
+	if template := matchPatterns(filename); template != "" {
+		return template
 	}
 
 	// If the filename contains "S01E01" format but regex didn't catch it
@@ -467,8 +749,7 @@ func detectFileTemplate(filepath string) string {
 	}
 
 	// If filename contains a year that looks like a movie year
-	yearPattern := regexp.MustCompile(`(19|20)\d{2}`)
-	if yearPattern.MatchString(filename) {
+	if YEAR_PATTERN.MatchString(filename) {
 		return "movie"
 	}
 
@@ -476,7 +757,7 @@ func detectFileTemplate(filepath string) string {
 }
 
 // Generate a static ffprobe response based on template and enhance with PTN data
-func generateResponse(filepath, templateName string, analyzeDuration bool) interface{} {
+func generateResponse(filepath, templateName string, size int64, container containerFormat) *FFProbeResponse {
 	template, exists := TEMPLATES[templateName]
 	if (!exists) {
 		return nil
@@ -498,6 +779,13 @@ func generateResponse(filepath, templateName string, analyzeDuration bool) inter
 	// Fill in filename
 	response.Format.Filename = filepath
 
+	// The container the file turned out to be in wins over the template's
+	if container.Name != "" {
+		response.Format.FormatName = container.Name
+		response.Format.FormatLongName = container.LongName
+		response.Format.ProbeScore = container.Score
+	}
+
 	// Ensure the Tags map is initialized
 	if response.Format.Tags == nil {
 		response.Format.Tags = make(map[string]string)
@@ -507,192 +795,433 @@ func generateResponse(filepath, templateName string, analyzeDuration bool) inter
 	filename := filepath[strings.LastIndex(filepath, "/")+1:]
 	response.Format.Tags["title"] = filename
 
-	// Enhance response with PTN data
-	enhanceResponseWithPTN(&response, filepath)
+	// Guesses from the file name stand in for what the built-in templates
+	// cannot know; configured templates describe the release, so the guesses
+	// only fill in what they leave out
+	if configuredTemplates[templateName] {
+		fillFromFilename(&response, filepath, size)
+	} else {
+		enhanceResponseWithPTN(&response, filepath, size)
+	}
 
-	// Add additional fields for streams
+	// Add additional fields for streams, where the template leaves them out
 	for i := range response.Streams {
-		if response.Streams[i].CodecType == "video" {
-			response.Streams[i].CodecLongName = "H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10"
-			response.Streams[i].Profile = "Main"
-			response.Streams[i].CodecTagString = "avc1"
-			response.Streams[i].CodecTag = "0x31637661"
-			response.Streams[i].PixFmt = "yuv420p"
-			response.Streams[i].ColorRange = "tv"
-			response.Streams[i].ColorSpace = "bt709"
-			response.Streams[i].ColorTransfer = "bt709"
-			response.Streams[i].ColorPrimaries = "bt709"
-			response.Streams[i].ChromaLocation = "left"
-			response.Streams[i].FieldOrder = "progressive"
-			response.Streams[i].RFrameRate = "24000/1001"
-			response.Streams[i].AvgFrameRate = "24000/1001"
-			response.Streams[i].TimeBase = "1/24000"
-			response.Streams[i].StartTime = "0:00:00.000000"
-			response.Streams[i].Duration = formatDuration(response.Streams[i].Duration)
-			response.Streams[i].Disposition = map[string]int{
-				"default": 1,
-				"dub":     0,
-				"original": 0,
-				// Add other disposition fields as needed
+		stream := &response.Streams[i]
+		if stream.CodecType == "video" {
+			setDefault(&stream.CodecLongName, CODEC_LONG_NAMES[stream.CodecName])
+			// What an x264 encode has; other codecs would not say so
+			if stream.CodecName == "h264" {
+				setDefault(&stream.Profile, "Main")
+				setDefault(&stream.CodecTagString, "avc1")
+				setDefault(&stream.CodecTag, "0x31637661")
 			}
-			response.Streams[i].Tags = map[string]string{
-				"creation_time": "2024-10-22T13:48:39.000000Z",
-				"language":      "und",
-				"encoder":       "JVT/AVC Coding",
+			setDefault(&stream.PixFmt, "yuv420p")
+			setDefault(&stream.ColorRange, "tv")
+			setDefault(&stream.ColorSpace, "bt709")
+			setDefault(&stream.ColorTransfer, "bt709")
+			setDefault(&stream.ColorPrimaries, "bt709")
+			setDefault(&stream.ChromaLocation, "left")
+			setDefault(&stream.FieldOrder, "progressive")
+			setDefault(&stream.RFrameRate, "24000/1001")
+			setDefault(&stream.AvgFrameRate, "24000/1001")
+			setDefault(&stream.TimeBase, "1/24000")
+			setDefault(&stream.StartTime, "0.000000")
+			if stream.Disposition == nil {
+				stream.Disposition = map[string]int{
+					"default": 1,
+					"dub":     0,
+					"original": 0,
+					// Add other disposition fields as needed
+				}
+			}
+			if stream.Tags == nil {
+				stream.Tags = make(map[string]string)
+			}
+			setDefaultTag(stream.Tags, "creation_time", "2024-10-22T13:48:39.000000Z")
+			setDefaultTag(stream.Tags, "language", "und")
+			if stream.CodecName == "h264" {
+				setDefaultTag(stream.Tags, "encoder", "JVT/AVC Coding")
 			}
 		}
 	}
 
-	// Add additional fields for format
-	response.Format.Tags["major_brand"] = "mp42"
-	response.Format.Tags["minor_version"] = "0"
-	response.Format.Tags["compatible_brands"] = "mp42isomavc1"
-	response.Format.Tags["creation_time"] = "2024-10-22T13:48:39.000000Z"
-	response.Format.Tags["encoder"] = "DVDFab 12.0.7.0"
+	// Add additional fields for format; only MP4 files have brands
+	if response.Format.FormatName == FORMAT_MOV.Name {
+		setDefaultTag(response.Format.Tags, "major_brand", "mp42")
+		setDefaultTag(response.Format.Tags, "minor_version", "0")
+		setDefaultTag(response.Format.Tags, "compatible_brands", "mp42isomavc1")
+	}
+	setDefaultTag(response.Format.Tags, "creation_time", "2024-10-22T13:48:39.000000Z")
+	setDefaultTag(response.Format.Tags, "encoder", "DVDFab 12.0.7.0")
 
 	return &response
 }
 
-func formatDuration(duration string) string {
-	seconds, err := strconv.ParseFloat(duration, 64)
-	if err != nil {
-		log.Printf("Error parsing duration: %v", err)
-		return duration
+// Set a field the template left empty
+func setDefault(field *string, value string) {
+	if *field == "" {
+		*field = value
 	}
+}
 
-	hours := int(seconds) / 3600
-	minutes := (int(seconds) % 3600) / 60
-	secs := seconds - float64(hours*3600+minutes*60)
-
-	return fmt.Sprintf("%d:%02d:%06.3f", hours, minutes, secs)
+func setDefaultTag(tags map[string]string, key, value string) {
+	if _, exists := tags[key]; !exists {
+		tags[key] = value
+	}
 }
 
-// Parse ffprobe arguments to extract the file path
-func parseFFProbeArgs() (string, bool, bool) {
-	var inputFile string
-	analyzeDuration := false
-	showPixelFormats := false
+// Template for synthetic answers about files that match no pattern
+var DEFAULT_TEMPLATE = envOrDefault("FFPROBE_SHIM_DEFAULT_TEMPLATE", "movie")
 
-	log.Println("Parsing ffprobe arguments")
+// Generate a synthetic response for any file, for when the real ffprobe
+// cannot answer in time
+func syntheticResponse(inputFile string, size int64) *FFProbeResponse {
+	container, _ := detectContainer(inputFile)
+	if container.AudioCodec != "" {
+		return audioResponse(inputFile, size, container)
+	}
+	templateName := detectFileTemplate(inputFile, container)
+	if templateName == "" {
+		templateName = DEFAULT_TEMPLATE
+	}
+	return generateResponse(inputFile, templateName, size, container)
+}
 
-	// Detect flags
-	for i, arg := range os.Args {
-		log.Printf("Argument %d: %s", i, arg)
+// invocation is a single ffprobe call, made either directly or by a client
+// of the daemon
+type invocation struct {
+	Args   []string // Arguments, without the program name
+	Env    []string
+	Cwd    string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Signals for the real ffprobe child; nil for those sent to this process
+	Signals <-chan os.Signal
+}
 
-		// Detect -analyzeduration flag
-		if arg == "-analyzeduration" {
-			analyzeDuration = true
-			log.Println("Detected -analyzeduration flag")
-		}
+// The invocation of this process
+func localInvocation() *invocation {
+	cwd, _ := os.Getwd()
+	return &invocation{
+		Args:   os.Args[1:],
+		Env:    os.Environ(),
+		Cwd:    cwd,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
 
-		// Detect -show_pixel_formats flag
-		if arg == "-show_pixel_formats" {
-			showPixelFormats = true
-			log.Println("Detected -show_pixel_formats flag")
+// Look up a variable in the caller's environment
+func (inv *invocation) lookupEnv(key string) (string, bool) {
+	for i := len(inv.Env) - 1; i >= 0; i-- {
+		if name, value, found := strings.Cut(inv.Env[i], "="); found && name == key {
+			return value, true
 		}
 	}
+	return "", false
+}
 
-	// Treat the last argument as the input file
-	if len(os.Args) > 1 {
-		inputFile = os.Args[len(os.Args)-1]
-		log.Printf("Last argument is treated as the input file: %s", inputFile)
-
-		// Wait up to 30 seconds for the file to become available
-		for i := 0; i < 30; i++ {
-			if fileInfo, err := os.Stat(inputFile); err == nil {
-				if !fileInfo.IsDir() {
-					log.Printf("Detected input file: %s", inputFile)
-					return inputFile, analyzeDuration, showPixelFormats
-				} else {
-					log.Printf("Argument is a directory, not a file: %s", inputFile)
-					break
-				}
-			} else {
-				log.Printf("File does not exist or cannot be accessed: %s, error: %v", inputFile, err)
+// Probe a file with the real ffprobe once, cache the result and answer from
+// it; pass the request through if that is not possible, or if the caller's
+// options make the real ffprobe read the file differently from the canonical
+// probe
+func serveRealProbe(inv *invocation, inputFile string, fileInfo os.FileInfo, opts *ProbeOptions) int {
+	inputOptions := opts.inputOptions()
+	if len(inputOptions) > 0 {
+		log.Printf("Detected input options %v, passing request for %s to real ffprobe", inputOptions, inputFile)
+	}
+	if CACHE_DIR == "" || len(inputOptions) > 0 {
+		// A synthetic answer is only possible while nothing has been printed
+		stdout := &trackingWriter{w: inv.Stdout}
+		passthrough := *inv
+		passthrough.Stdout = stdout
+
+		code, err := runRealFFProbe(&passthrough)
+		if err == errRealProbeMissing {
+			return failProbe(inv, opts, ERROR_INPUT_OUTPUT)
+		} else if err == errSlotTimeout {
+			return answerTimeout(inv, inputFile, fileInfo, opts, QUEUE_TIMEOUT_POLICY, err)
+		} else if err == errRealProbeTimeout {
+			if stdout.written {
+				return 1
 			}
-			time.Sleep(1 * time.Second)
+			return answerTimeout(inv, inputFile, fileInfo, opts, REAL_TIMEOUT_POLICY, err)
 		}
+		return code
+	}
 
-		log.Printf("File %s did not become available within 30 seconds", inputFile)
+	response, err := probeAndCache(inputFile, fileInfo, inv.slotRequest())
+	if err == errSlotTimeout {
+		return answerTimeout(inv, inputFile, fileInfo, opts, QUEUE_TIMEOUT_POLICY, err)
+	} else if err == errRealProbeTimeout {
+		return answerTimeout(inv, inputFile, fileInfo, opts, REAL_TIMEOUT_POLICY, err)
+	} else if err != nil {
+		log.Printf("Error probing %s: %v. Passing request to real ffprobe.", inputFile, err)
+		return fallbackToRealFFProbe(inv)
 	}
+	return writeProbeResponse(inv, response, opts)
+}
 
-	return "", analyzeDuration, showPixelFormats
+// Answer a call the real ffprobe could not answer in time, as the policy says
+func answerTimeout(inv *invocation, inputFile string, fileInfo os.FileInfo, opts *ProbeOptions, policy string, err error) int {
+	if policy == timeoutPolicySynthetic {
+		if response := syntheticResponse(inputFile, fileInfo.Size()); response != nil {
+			log.Printf("%v for %s, answering from a template", err, inputFile)
+			return writeProbeResponse(inv, response, opts)
+		}
+	}
+	log.Printf("%v for %s, failing", err, inputFile)
+	fmt.Fprintf(inv.Stderr, "%s: %v\n", opts.Input, err)
+	return 1
+}
+
+// Print a response the way the caller asked for it
+func writeProbeResponse(inv *invocation, response *FFProbeResponse, opts *ProbeOptions) int {
+	// ffprobe reports the input exactly as it was given
+	response.Format.Filename = opts.Input
+
+	if err := writeResponse(inv.Stdout, response, opts); err != nil {
+		log.Printf("Error writing response: %v", err)
+		return fallbackToRealFFProbe(inv)
+	}
+	return 0
 }
 
 // Execute the real ffprobe binary with the original arguments
-func fallbackToRealFFProbe() {
-	log.Printf("Checking if REAL_FFPROBE exists at: %s", REAL_FFPROBE)
-	if _, err := os.Stat(REAL_FFPROBE); err == nil {
-		log.Printf("Falling back to real ffprobe: %s %v", REAL_FFPROBE, os.Args[1:])
+func fallbackToRealFFProbe(inv *invocation) int {
+	code, err := runRealFFProbe(inv)
+	if err == errRealProbeMissing {
+		return reportRealProbeMissing(inv)
+	} else if err == errSlotTimeout || err == errRealProbeTimeout {
+		fmt.Fprintf(inv.Stderr, "%v\n", err)
+		return 1
+	}
+	return code
+}
 
-		cmd := exec.Command(REAL_FFPROBE, os.Args[1:]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = os.Stdin
+// Returned when there is no real ffprobe to fall back to
+var errRealProbeMissing = errors.New("real ffprobe not found")
 
-		err := cmd.Run()
-		if err != nil {
-			log.Printf("Error executing real ffprobe: %v", err)
-			os.Exit(1)
-		}
-		os.Exit(0)
+// Execute the real ffprobe binary with the original arguments once a slot is
+// free, and return its exit status. errSlotTimeout is returned if no slot
+// frees up in time, errRealProbeTimeout if the real ffprobe has to be
+// killed, and errRealProbeMissing if it does not exist.
+func runRealFFProbe(inv *invocation) (int, error) {
+	log.Printf("Checking if REAL_FFPROBE exists at: %s", REAL_FFPROBE)
+	if _, err := os.Stat(REAL_FFPROBE); err != nil {
+		log.Printf("Real ffprobe not found at %s: %v", REAL_FFPROBE, err)
+		return 1, errRealProbeMissing
+	}
+
+	release, err := acquireRealProbeSlot(inv.slotRequest())
+	if err == errSlotTimeout {
+		log.Printf("Timed out waiting for a real ffprobe slot")
+		return 1, err
+	} else if err != nil {
+		log.Printf("Error waiting for a real ffprobe slot, running anyway: %v", err)
 	} else {
-		log.Printf("Real ffprobe not found at %s. Exiting gracefully.", REAL_FFPROBE)
-		os.Exit(0) // Exit successfully if REAL_FFPROBE is not found
+		defer release()
+	}
+
+	log.Printf("Falling back to real ffprobe: %s %v", REAL_FFPROBE, inv.Args)
+
+	cmd := exec.Command(REAL_FFPROBE, inv.Args...)
+	cmd.Dir = inv.Cwd
+	cmd.Env = inv.Env
+	cmd.Stdout = inv.Stdout
+	cmd.Stderr = inv.Stderr
+	cmd.Stdin = inv.Stdin
+
+	err = runChild(cmd, inv.Signals)
+	if err == nil {
+		return 0, nil
+	} else if err == errRealProbeTimeout {
+		return 1, err
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		log.Printf("Error executing real ffprobe: %v", err)
+		return 1, nil
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		log.Printf("Real ffprobe exited with status %d", exitErr.ExitCode())
+		return exitErr.ExitCode(), nil
 	}
+
+	// Die the same way, so the caller sees what happened to the real ffprobe;
+	// a daemon client is told through the shell's convention instead
+	sig := status.Signal()
+	log.Printf("Real ffprobe was killed by %v", sig)
+	if inv.Signals == nil {
+		signal.Reset(sig)
+		syscall.Kill(os.Getpid(), sig)
+		time.Sleep(100 * time.Millisecond)
+	}
+	return 128 + int(sig), nil
 }
 
-func main() {
+// Fail the way ffprobe fails to open an input when there is no real ffprobe
+// to ask, rather than succeed with no output
+func reportRealProbeMissing(inv *invocation) int {
+	opts, err := parseFFProbeArgs(inv.Args)
+	if err != nil || opts.Input == "" || opts.isInfoRequest() {
+		fmt.Fprintf(inv.Stderr, "%s: %s\n", REAL_FFPROBE, ERROR_NO_SUCH_FILE.String)
+		return 1
+	}
+	return failProbe(inv, opts, ERROR_INPUT_OUTPUT)
+}
+
+// Report an input that cannot be probed like ffprobe does: a message on
+// stderr at the error log level, the error section under -show_error, and
+// exit status 1
+func failProbe(inv *invocation, opts *ProbeOptions, probeError ProbeError) int {
+	if opts.LogLevel >= LOG_LEVELS["error"] {
+		fmt.Fprintf(inv.Stderr, "%s: %s\n", opts.Input, probeError.String)
+	}
+	if err := writeErrorResponse(inv.Stdout, probeError, opts); err != nil {
+		log.Printf("Error writing error response: %v", err)
+	}
+	return 1
+}
+
+// Answer an ffprobe call and return its exit code
+func runShim(inv *invocation) int {
     // Check if the shim should be used
-    if _, useShim := os.LookupEnv("USE_FFPROBE_SHIM"); !useShim {
+    if _, useShim := inv.lookupEnv("USE_FFPROBE_SHIM"); !useShim {
         log.Println("USE_FFPROBE_SHIM not set. Passing through to real ffprobe.")
-        fallbackToRealFFProbe()
-        return
+        return fallbackToRealFFProbe(inv)
     }
 
-    log.Printf("FFProbe shim called with args: %s", strings.Join(os.Args, " "))
+    log.Printf("FFProbe shim called with args: %s", strings.Join(inv.Args, " "))
 
-    inputFile, analyzeDuration, showPixelFormats := parseFFProbeArgs()
+    opts, err := parseFFProbeArgs(inv.Args)
+    if err != nil {
+        log.Printf("Error parsing arguments: %v. Passing request to real ffprobe.", err)
+        return fallbackToRealFFProbe(inv)
+    }
+    log.Printf("Parsed options: %+v", *opts)
 
-    // Pass -show_pixel_formats directly to the real ffprobe
-    if showPixelFormats {
-        log.Println("Detected -show_pixel_formats. Passing request to real ffprobe.")
-        fallbackToRealFFProbe()
-        return
+    // Pass informational requests (-version, -show_pixel_formats, ...) directly to the real ffprobe
+    if opts.isInfoRequest() {
+        log.Printf("Detected %v. Passing request to real ffprobe.", opts.InfoOptions)
+        return fallbackToRealFFProbe(inv)
+    }
+
+    // Packets, frames and the like cannot be synthesized
+    if unsupported := opts.unsupportedOptions(); len(unsupported) > 0 {
+        log.Printf("Detected unsupported options %v. Passing request to real ffprobe.", unsupported)
+        return fallbackToRealFFProbe(inv)
     }
 
-    if inputFile == "" {
+    // Relative inputs are relative to the caller, which may not be this process
+    if opts.InputPath != "" && !filepath.IsAbs(opts.InputPath) {
+        opts.InputPath = filepath.Join(inv.Cwd, opts.InputPath)
+    }
+
+    // Pipes and URLs are left to the real ffprobe
+    if opts.InputPath == "" {
         log.Printf("No input file found, falling back to real ffprobe")
-        fallbackToRealFFProbe()
-        return
+        return fallbackToRealFFProbe(inv)
     }
 
+    if pathModeFor(opts.InputPath) == pathModePassthrough {
+        log.Printf("Path policy for %s is passthrough", opts.InputPath)
+        return fallbackToRealFFProbe(inv)
+    }
+
+    // The real ffprobe would fail on a file that is not there or not readable
+    // just the same, so fail like it without asking it
+    fileInfo, err := waitForInputFile(opts.InputPath)
+    if err != nil {
+        return failProbe(inv, opts, probeErrorFor(err))
+    }
+    inputFile := opts.InputPath
+
     log.Printf("Processing file: %s", inputFile)
 
-    // Detect template to use
-    templateName := detectFileTemplate(inputFile)
+    // A real result from an earlier probe beats any synthetic answer
+    if response, found := loadCachedResponse(inputFile, fileInfo); found {
+        return writeProbeResponse(inv, response, opts)
+    }
+
+    if pathModeFor(inputFile) == pathModeReal {
+        log.Printf("Path policy for %s is real, probing with real ffprobe", inputFile)
+        return serveRealProbe(inv, inputFile, fileInfo, opts)
+    }
+
+    // The container headers tell more than any guess
+    if response, found := serveNativeProbe(inputFile, fileInfo); found {
+        code := writeProbeResponse(inv, response, opts)
+        enqueueBackgroundProbe(inputFile, fileInfo)
+        return code
+    }
+
+    // Episodes of a release share the layout of any one that was probed
+    if response, found := deriveFromSibling(inputFile, fileInfo); found {
+        code := writeProbeResponse(inv, response, opts)
+        enqueueBackgroundProbe(inputFile, fileInfo)
+        return code
+    }
+
+    // Detect template to use, by the container the file's first bytes show
+    container, _ := detectContainer(inputFile)
+
+    // The templates describe video releases, which songs are not
+    if container.AudioCodec != "" {
+        log.Printf("%s is %s audio, probing with real ffprobe", inputFile, container.Name)
+        return serveRealProbe(inv, inputFile, fileInfo, opts)
+    }
+
+    templateName := detectFileTemplate(inputFile, container)
     log.Printf("Detected template: %s", templateName)
 
     if templateName == "" {
-        log.Printf("No matching template for %s, falling back to real ffprobe", inputFile)
-        fallbackToRealFFProbe()
-        return
+        log.Printf("No matching template for %s, probing with real ffprobe", inputFile)
+        return serveRealProbe(inv, inputFile, fileInfo, opts)
     }
 
     // Generate response
-    response := generateResponse(inputFile, templateName, analyzeDuration)
+    response := generateResponse(inputFile, templateName, fileInfo.Size(), container)
     if response == nil {
         log.Printf("Failed to generate response for %s", templateName)
-        fallbackToRealFFProbe()
-        return
+        return serveRealProbe(inv, inputFile, fileInfo, opts)
     }
 
-    // Always output JSON
-    responseJSON, err := json.MarshalIndent(response, "", "    ")
-    if err != nil {
-        log.Printf("Error encoding response to JSON: %v", err)
-        fallbackToRealFFProbe() // Correct function name
-        return
+    // Only the requested sections are printed to stdout
+    code := writeProbeResponse(inv, response, opts)
+
+    // Replace the synthetic answer with a real one for the next scan
+    enqueueBackgroundProbe(inputFile, fileInfo)
+    return code
+}
+
+func main() {
+    if len(os.Args) >= 2 {
+        switch os.Args[1] {
+        // Detached worker draining the background probe queue
+        case refreshWorkerCommand:
+            runRefreshWorker()
+            return
+        case daemonCommand:
+            os.Exit(runDaemon())
+        case checkConfigCommand:
+            os.Exit(runCheckConfig(os.Args[2:]))
+        case captureCommand:
+            os.Exit(runCapture(os.Args[2:]))
+        }
+    }
+
+    inv := localInvocation()
+
+    // Let the daemon answer if it is running
+    if code, forwarded := forwardToDaemon(inv); forwarded {
+        os.Exit(code)
     }
-    fmt.Print(string(responseJSON)) // Only JSON is printed to stdout
-}
\ No newline at end of file
+
+    os.Exit(runShim(inv))
+}
@@ -2,4 +2,7 @@ module ffprobe-shim
 
 go 1.23
 
-require github.com/middelink/go-parse-torrent-name v0.0.0-20190301154245-3ff4efacd4c4
+require (
+	github.com/middelink/go-parse-torrent-name v0.0.0-20190301154245-3ff4efacd4c4
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Returned by tryLockFile when another process holds the lock
+var errLocked = errors.New("lock is held by another process")
+
+// Returned by lockFirst when no lock came free before the deadline
+var errLockTimeout = errors.New("timed out waiting for a lock")
+
+// Take an exclusive advisory lock on a file, creating it if needed, and wait
+// for it if another process holds it. Closing the file releases the lock,
+// as does the death of the process; holders may remove the file first.
+func lockFile(path string) (*os.File, error) {
+	return openLocked(path, syscall.LOCK_EX, os.O_CREATE)
+}
+
+// Like lockFile, but fail with errLocked instead of waiting
+func tryLockFile(path string) (*os.File, error) {
+	return openLocked(path, syscall.LOCK_EX|syscall.LOCK_NB, os.O_CREATE)
+}
+
+// The outcome of one of the waits of lockFirst
+type lockResult struct {
+	file  *os.File
+	index int
+	err   error
+}
+
+// Lock whichever of several files comes free first, waiting until a deadline
+// (zero waits forever), and return it with its index. Files that do not
+// exist are only created if create is set; otherwise the wait for them fails
+// with an error satisfying os.IsNotExist. Waits that lose, or outlive the
+// deadline, still take their lock in the end and release it straight away.
+func lockFirst(paths []string, create bool, deadline time.Time) (*os.File, int, error) {
+	flags := 0
+	if create {
+		flags = os.O_CREATE
+	}
+	results := make(chan lockResult, len(paths))
+	for i, path := range paths {
+		go func(i int, path string) {
+			file, err := openLocked(path, syscall.LOCK_EX, flags)
+			results <- lockResult{file: file, index: i, err: err}
+		}(i, path)
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	for pending := len(paths); pending > 0; pending-- {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				err = result.err
+				continue
+			}
+			go releaseLocks(results, pending-1)
+			return result.file, result.index, nil
+		case <-timeout:
+			go releaseLocks(results, pending)
+			return nil, -1, errLockTimeout
+		}
+	}
+	return nil, -1, err
+}
+
+// Release the locks of waits nobody wants any more, as they are taken
+func releaseLocks(results <-chan lockResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.file != nil {
+			result.file.Close()
+		}
+	}
+}
+
+func openLocked(path string, how int, flags int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	for {
+		file, err := os.OpenFile(path, flags|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(file.Fd()), how); err != nil {
+			file.Close()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, errLocked
+			}
+			return nil, err
+		}
+
+		// The holder may have removed the file before releasing it, in which
+		// case the lock is on a file nobody else will ever see
+		if locked, err := file.Stat(); err == nil {
+			if current, err := os.Stat(path); err == nil && os.SameFile(locked, current) {
+				return file, nil
+			}
+		}
+		file.Close()
+	}
+}
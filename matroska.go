@@ -0,0 +1,1104 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matroska element IDs, as in the specification (RFC 9559)
+const (
+	mkvEBML            = 0x1A45DFA3
+	mkvDocType         = 0x4282
+	mkvSegment         = 0x18538067
+	mkvSeekHead        = 0x114D9B74
+	mkvSeek            = 0x4DBB
+	mkvSeekID          = 0x53AB
+	mkvSeekPosition    = 0x53AC
+	mkvInfo            = 0x1549A966
+	mkvTimestampScale  = 0x2AD7B1
+	mkvDuration        = 0x4489
+	mkvDateUTC         = 0x4461
+	mkvTitle           = 0x7BA9
+	mkvMuxingApp       = 0x4D80
+	mkvTracks          = 0x1654AE6B
+	mkvTrackEntry      = 0xAE
+	mkvTrackNumber     = 0xD7
+	mkvTrackUID        = 0x73C5
+	mkvTrackType       = 0x83
+	mkvFlagEnabled     = 0xB9
+	mkvFlagDefault     = 0x88
+	mkvFlagForced      = 0x55AA
+	mkvFlagHearing     = 0x55AB
+	mkvFlagVisual      = 0x55AC
+	mkvFlagDescription = 0x55AD
+	mkvFlagOriginal    = 0x55AE
+	mkvFlagCommentary  = 0x55AF
+	mkvDefaultDuration = 0x23E383
+	mkvName            = 0x536E
+	mkvLanguage        = 0x22B59C
+	mkvLanguageBCP47   = 0x22B59D
+	mkvCodecID         = 0x86
+	mkvCodecPrivate    = 0x63A2
+	mkvCodecDelay      = 0x56AA
+	mkvBlockAddMapping = 0x41E4
+	mkvBlockAddIDType  = 0x41E7
+	mkvBlockAddIDExtra = 0x41ED
+	mkvVideo           = 0xE0
+	mkvFlagInterlaced  = 0x9A
+	mkvFieldOrder      = 0x9D
+	mkvPixelWidth      = 0xB0
+	mkvPixelHeight     = 0xBA
+	mkvDisplayWidth    = 0x54B0
+	mkvDisplayHeight   = 0x54BA
+	mkvDisplayUnit     = 0x54B2
+	mkvColour          = 0x55B0
+	mkvMatrix          = 0x55B1
+	mkvChromaSitingH   = 0x55B7
+	mkvChromaSitingV   = 0x55B8
+	mkvRange           = 0x55B9
+	mkvTransfer        = 0x55BA
+	mkvPrimaries       = 0x55BB
+	mkvMaxCLL          = 0x55BC
+	mkvMaxFALL         = 0x55BD
+	mkvMastering       = 0x55D0
+	mkvAudio           = 0xE1
+	mkvSamplingFreq    = 0xB5
+	mkvOutputFreq      = 0x78B5
+	mkvChannels        = 0x9F
+	mkvBitDepth        = 0x6264
+	mkvChapters        = 0x1043A770
+	mkvEditionEntry    = 0x45B9
+	mkvChapterAtom     = 0xB6
+	mkvChapterUID      = 0x73C4
+	mkvChapterStart    = 0x91
+	mkvChapterEnd      = 0x92
+	mkvChapterDisplay  = 0x80
+	mkvChapString      = 0x85
+	mkvAttachments     = 0x1941A469
+	mkvAttachedFile    = 0x61A7
+	mkvFileName        = 0x466E
+	mkvFileMediaType   = 0x4660
+	mkvFileData        = 0x465C
+	mkvTags            = 0x1254C367
+	mkvTag             = 0x7373
+	mkvTargets         = 0x63C0
+	mkvTagTrackUID     = 0x63C5
+	mkvTagChapterUID   = 0x63C4
+	mkvTagAttachUID    = 0x63C6
+	mkvSimpleTag       = 0x67C8
+	mkvTagName         = 0x45A3
+	mkvTagLanguage     = 0x447A
+	mkvTagDefault      = 0x4484
+	mkvTagString       = 0x4487
+	mkvCluster         = 0x1F43B675
+)
+
+// Codec names by Matroska CodecID; IDs are also matched by their prefix up
+// to a "/", so that "A_AAC/MPEG4/LC" is found as "A_AAC"
+var MATROSKA_CODECS = map[string]string{
+	"V_MPEG4/ISO/AVC":  "h264",
+	"V_MPEGH/ISO/HEVC": "hevc",
+	"V_AV1":            "av1",
+	"V_VP8":            "vp8",
+	"V_VP9":            "vp9",
+	"V_MPEG1":          "mpeg1video",
+	"V_MPEG2":          "mpeg2video",
+	"V_MPEG4/ISO/ASP":  "mpeg4",
+	"V_MPEG4/ISO/SP":   "mpeg4",
+	"V_MPEG4/ISO/AP":   "mpeg4",
+	"V_MPEG4/MS/V3":    "msmpeg4v3",
+	"V_THEORA":         "theora",
+	"V_PRORES":         "prores",
+	"V_MJPEG":          "mjpeg",
+	"A_AAC":            "aac",
+	"A_AC3":            "ac3",
+	"A_EAC3":           "eac3",
+	"A_DTS":            "dts",
+	"A_TRUEHD":         "truehd",
+	"A_FLAC":           "flac",
+	"A_OPUS":           "opus",
+	"A_VORBIS":         "vorbis",
+	"A_MPEG/L2":        "mp2",
+	"A_MPEG/L3":        "mp3",
+	"A_ALAC":           "alac",
+	"A_PCM/FLOAT/IEEE": "pcm_f32le",
+	"S_TEXT/UTF8":      "subrip",
+	"S_TEXT/ASS":       "ass",
+	"S_TEXT/SSA":       "ass",
+	"S_TEXT/WEBVTT":    "webvtt",
+	"S_HDMV/PGS":       "hdmv_pgs_subtitle",
+	"S_HDMV/TEXTST":    "hdmv_text_subtitle",
+	"S_VOBSUB":         "dvd_subtitle",
+	"S_DVBSUB":         "dvb_subtitle",
+}
+
+// Codec names of attachments by media type; attachments of other types are
+// not listed
+var MATROSKA_ATTACHMENT_CODECS = map[string]string{
+	"application/x-truetype-font": "ttf",
+	"application/x-font-ttf":      "ttf",
+	"font/ttf":                    "ttf",
+	"application/vnd.ms-opentype": "otf",
+	"application/x-font-otf":      "otf",
+	"font/otf":                    "otf",
+	"image/jpeg":                  "mjpeg",
+	"image/png":                   "png",
+}
+
+// Stream types by Matroska TrackType
+var MATROSKA_TRACK_TYPES = map[uint64]string{
+	1:  "video",
+	2:  "audio",
+	17: "subtitle",
+}
+
+// Matroska dates count from the start of the millennium
+var matroskaEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Stops reading the elements of a segment at its first cluster
+var errFirstCluster = errors.New("first cluster reached")
+
+// Largest value element read into memory, such as a CodecPrivate
+const maxMatroskaValue = 1 << 20
+
+// matroskaReader reads EBML elements through a budgetReader
+type matroskaReader struct {
+	r *budgetReader
+}
+
+// matroskaTrack is a track entry with what it says besides its stream
+type matroskaTrack struct {
+	Stream     Stream
+	UID        uint64
+	codecDelay uint64
+}
+
+// Read the stream information of a Matroska or WebM file from its EBML header,
+// Segment Info, Tracks, Chapters, Attachments and Tags. The sections after the
+// first cluster, usually the tags, are found through the SeekHead.
+func probeMatroska(r *budgetReader) (*FFProbeResponse, error) {
+	m := &matroskaReader{r: r}
+	id, size, headerSize, err := m.header(0)
+	if err == errBudgetExceeded {
+		return nil, err
+	} else if err != nil || id != mkvEBML {
+		return nil, errNotThisFormat
+	}
+
+	docType := "matroska"
+	err = m.eachChild(headerSize, headerSize+size, func(id uint32, data, size int64) error {
+		if id == mkvDocType {
+			docType, err = m.readString(data, size)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if docType != "matroska" && docType != "webm" {
+		return nil, errNotThisFormat
+	}
+
+	offset := headerSize + size
+	id, size, headerSize, err = m.header(offset)
+	if err != nil {
+		return nil, err
+	}
+	if id != mkvSegment {
+		return nil, fmt.Errorf("no segment after the EBML header")
+	}
+	segment := offset + headerSize
+	segmentEnd := segment + size
+	if size < 0 || segmentEnd > r.size {
+		segmentEnd = r.size
+	}
+
+	response := &FFProbeResponse{
+		Format: Format{
+			FormatName:     "matroska,webm",
+			FormatLongName: "Matroska / WebM",
+			StartTime:      "0.000000",
+			ProbeScore:     100,
+			Tags:           map[string]string{},
+		},
+	}
+	timestampScale := uint64(1000000)
+	var tracks []matroskaTrack
+	var attachments []Stream
+	var tags []matroskaTag
+
+	// Sections are read where the segment has them, or where the SeekHead
+	// says they are
+	done := map[uint32]bool{}
+	var sought []matroskaSeek
+	readSection := func(id uint32, data, size int64) error {
+		if done[id] {
+			return nil
+		}
+		var err error
+		switch id {
+		case mkvSeekHead:
+			var seeks []matroskaSeek
+			seeks, err = m.readSeekHead(data, size)
+			sought = append(sought, seeks...)
+		case mkvInfo:
+			timestampScale, err = m.readInfo(data, size, &response.Format)
+		case mkvTracks:
+			tracks, err = m.readTracks(data, size)
+		case mkvChapters:
+			response.Chapters, err = m.readChapters(data, size)
+		case mkvAttachments:
+			attachments, err = m.readAttachments(data, size)
+		case mkvTags:
+			tags, err = m.readTags(data, size)
+		case mkvCluster:
+			return errFirstCluster
+		default:
+			return nil
+		}
+		done[id] = true
+		return err
+	}
+	if err := m.eachChild(segment, segmentEnd, readSection); err != nil && err != errFirstCluster {
+		return nil, err
+	}
+	for _, seek := range sought {
+		if done[seek.ID] || seek.ID == mkvSeekHead || seek.ID == mkvCluster {
+			continue
+		}
+		offset := segment + seek.Position
+		id, size, headerSize, err := m.header(offset)
+		if err != nil || id != seek.ID {
+			continue
+		}
+		if err := readSection(id, offset+headerSize, size); err != nil {
+			// Tags are worth a read but not a failure
+			if id == mkvTags && err == errBudgetExceeded {
+				continue
+			}
+			return nil, err
+		}
+	}
+	if !done[mkvTracks] {
+		return nil, fmt.Errorf("no tracks found")
+	}
+
+	// The Info duration is counted in timestamp units
+	if duration, err := strconv.ParseFloat(response.Format.Duration, 64); err == nil {
+		response.Format.Duration = fmt.Sprintf("%.6f", duration*float64(timestampScale)/1e9)
+	}
+	timeBase := fmt.Sprintf("1/%d", 1000000000/max(timestampScale, 1))
+
+	// Chapters without an end last until the next one, or the end of the file
+	for i := range response.Chapters {
+		chapter := &response.Chapters[i]
+		if chapter.End < 0 {
+			if i+1 < len(response.Chapters) {
+				chapter.End = response.Chapters[i+1].Start
+			} else if duration, err := strconv.ParseFloat(response.Format.Duration, 64); err == nil {
+				chapter.End = int64(duration * 1e9)
+			} else {
+				chapter.End = chapter.Start
+			}
+		}
+		chapter.StartTime = fmt.Sprintf("%.6f", float64(chapter.Start)/1e9)
+		chapter.EndTime = fmt.Sprintf("%.6f", float64(chapter.End)/1e9)
+	}
+
+	trackIndex := map[uint64]int{}
+	for _, track := range tracks {
+		stream := track.Stream
+		stream.Index = len(response.Streams)
+		stream.TimeBase = timeBase
+		finishNativeStream(&stream)
+		trackIndex[track.UID] = stream.Index
+		response.Streams = append(response.Streams, stream)
+	}
+	for _, stream := range attachments {
+		stream.Index = len(response.Streams)
+		finishNativeStream(&stream)
+		response.Streams = append(response.Streams, stream)
+	}
+
+	for _, tag := range tags {
+		target := response.Format.Tags
+		if tag.TrackUID != 0 {
+			index, exists := trackIndex[tag.TrackUID]
+			if !exists {
+				continue
+			}
+			if response.Streams[index].Tags == nil {
+				response.Streams[index].Tags = map[string]string{}
+			}
+			target = response.Streams[index].Tags
+		}
+		for key, value := range tag.Values {
+			target[key] = value
+		}
+	}
+	return response, nil
+}
+
+// Read the header of the element at an offset: its ID, the size of its data
+// (-1 if unknown) and the size of the header itself
+func (m *matroskaReader) header(offset int64) (uint32, int64, int64, error) {
+	var buf [12]byte
+	n, err := m.r.ReadAt(buf[:], offset)
+	if n == 0 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, 0, err
+	}
+	if err != nil && err != io.EOF {
+		return 0, 0, 0, err
+	}
+
+	idLength := vintLength(buf[0])
+	if idLength == 0 || idLength > 4 || idLength >= n {
+		return 0, 0, 0, fmt.Errorf("invalid element ID at %d", offset)
+	}
+	var id uint32
+	for _, b := range buf[:idLength] {
+		id = id<<8 | uint32(b)
+	}
+
+	sizeLength := vintLength(buf[idLength])
+	if sizeLength == 0 || idLength+sizeLength > n {
+		return 0, 0, 0, fmt.Errorf("invalid element size at %d", offset)
+	}
+	size := int64(buf[idLength] & (0xff >> sizeLength))
+	unknown := size == int64(0xff>>sizeLength)
+	for _, b := range buf[idLength+1 : idLength+sizeLength] {
+		size = size<<8 | int64(b)
+		unknown = unknown && b == 0xff
+	}
+	if unknown {
+		size = -1
+	}
+	return id, size, int64(idLength + sizeLength), nil
+}
+
+// Length of a variable-size integer from its first byte; 0 if invalid
+func vintLength(first byte) int {
+	for i := 0; i < 8; i++ {
+		if first&(0x80>>i) != 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Call fn for each element between two offsets; elements of unknown size
+// extend to the end
+func (m *matroskaReader) eachChild(start, end int64, fn func(id uint32, data, size int64) error) error {
+	for offset := start; offset < end; {
+		id, size, headerSize, err := m.header(offset)
+		if err != nil {
+			return err
+		}
+		data := offset + headerSize
+		if data > end {
+			return fmt.Errorf("element at %d runs past its parent", offset)
+		}
+		if size < 0 || data+size > end {
+			size = end - data
+		}
+		if err := fn(id, data, size); err != nil {
+			return err
+		}
+		offset = data + size
+	}
+	return nil
+}
+
+func (m *matroskaReader) readBytes(data, size int64) ([]byte, error) {
+	if size < 0 || size > maxMatroskaValue {
+		return nil, fmt.Errorf("element of %d bytes at %d is invalid", size, data)
+	}
+	buf := make([]byte, size)
+	if _, err := m.r.ReadAt(buf, data); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (m *matroskaReader) readUint(data, size int64) (uint64, error) {
+	if size > 8 {
+		return 0, fmt.Errorf("integer of %d bytes at %d", size, data)
+	}
+	buf, err := m.readBytes(data, size)
+	var value uint64
+	for _, b := range buf {
+		value = value<<8 | uint64(b)
+	}
+	return value, err
+}
+
+func (m *matroskaReader) readFloat(data, size int64) (float64, error) {
+	buf, err := m.readBytes(data, size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+	case 0:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("float of %d bytes at %d", size, data)
+}
+
+func (m *matroskaReader) readString(data, size int64) (string, error) {
+	buf, err := m.readBytes(data, size)
+	return strings.TrimRight(string(buf), "\x00"), err
+}
+
+// matroskaSeek is a SeekHead entry: a section and its position in the segment
+type matroskaSeek struct {
+	ID       uint32
+	Position int64
+}
+
+func (m *matroskaReader) readSeekHead(data, size int64) ([]matroskaSeek, error) {
+	var seeks []matroskaSeek
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		if id != mkvSeek {
+			return nil
+		}
+		var seek matroskaSeek
+		err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+			switch id {
+			case mkvSeekID:
+				value, err := m.readUint(data, size)
+				seek.ID = uint32(value)
+				return err
+			case mkvSeekPosition:
+				value, err := m.readUint(data, size)
+				seek.Position = int64(value)
+				return err
+			}
+			return nil
+		})
+		seeks = append(seeks, seek)
+		return err
+	})
+	return seeks, err
+}
+
+// Read Segment Info into a format, with the duration still in timestamp
+// units, and return the timestamp scale
+func (m *matroskaReader) readInfo(data, size int64, format *Format) (uint64, error) {
+	timestampScale := uint64(1000000)
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		var err error
+		switch id {
+		case mkvTimestampScale:
+			timestampScale, err = m.readUint(data, size)
+		case mkvDuration:
+			var duration float64
+			duration, err = m.readFloat(data, size)
+			format.Duration = strconv.FormatFloat(duration, 'f', -1, 64)
+		case mkvTitle:
+			format.Tags["title"], err = m.readString(data, size)
+		case mkvMuxingApp:
+			format.Tags["encoder"], err = m.readString(data, size)
+		case mkvDateUTC:
+			var value uint64
+			value, err = m.readUint(data, size)
+			created := matroskaEpoch.Add(time.Duration(int64(value)))
+			format.Tags["creation_time"] = created.Format("2006-01-02T15:04:05.000000Z")
+		}
+		return err
+	})
+	return timestampScale, err
+}
+
+func (m *matroskaReader) readTracks(data, size int64) ([]matroskaTrack, error) {
+	var tracks []matroskaTrack
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		if id != mkvTrackEntry {
+			return nil
+		}
+		track, keep, err := m.readTrackEntry(data, size)
+		if keep {
+			tracks = append(tracks, track)
+		}
+		return err
+	})
+	return tracks, err
+}
+
+// Read a TrackEntry; false for tracks ffprobe would not list as streams
+func (m *matroskaReader) readTrackEntry(data, size int64) (matroskaTrack, bool, error) {
+	var track matroskaTrack
+	stream := &track.Stream
+	stream.Disposition = newDisposition()
+	stream.Disposition["default"] = 1
+	stream.Tags = map[string]string{}
+
+	var trackType uint64
+	var codecID, language, languageBCP47 string
+	var codecPrivate []byte
+	var sideData []SideData
+	enabled := uint64(1)
+	languageSet := false
+
+	flags := map[uint32]string{
+		mkvFlagDefault:     "default",
+		mkvFlagForced:      "forced",
+		mkvFlagHearing:     "hearing_impaired",
+		mkvFlagVisual:      "visual_impaired",
+		mkvFlagDescription: "descriptions",
+		mkvFlagOriginal:    "original",
+		mkvFlagCommentary:  "comment",
+	}
+
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		var err error
+		switch id {
+		case mkvTrackType:
+			trackType, err = m.readUint(data, size)
+		case mkvTrackUID:
+			track.UID, err = m.readUint(data, size)
+		case mkvFlagEnabled:
+			enabled, err = m.readUint(data, size)
+		case mkvCodecID:
+			codecID, err = m.readString(data, size)
+		case mkvCodecPrivate:
+			codecPrivate, err = m.readBytes(data, size)
+		case mkvCodecDelay:
+			var delay uint64
+			delay, err = m.readUint(data, size)
+			track.codecDelay = delay
+		case mkvName:
+			stream.Tags["title"], err = m.readString(data, size)
+		case mkvLanguage:
+			language, err = m.readString(data, size)
+			languageSet = true
+		case mkvLanguageBCP47:
+			languageBCP47, err = m.readString(data, size)
+		case mkvDefaultDuration:
+			var period uint64
+			period, err = m.readUint(data, size)
+			stream.RFrameRate = frameRateFromPeriod(int64(period))
+			stream.AvgFrameRate = stream.RFrameRate
+		case mkvBlockAddMapping:
+			var mapping SideData
+			var ok bool
+			mapping, ok, err = m.readBlockAddMapping(data, size)
+			if ok {
+				sideData = append(sideData, mapping)
+			}
+		case mkvVideo:
+			var videoSideData []SideData
+			videoSideData, err = m.readVideo(data, size, stream)
+			sideData = append(videoSideData, sideData...)
+		case mkvAudio:
+			err = m.readAudio(data, size, stream)
+		default:
+			if key, isFlag := flags[id]; isFlag {
+				var value uint64
+				value, err = m.readUint(data, size)
+				stream.Disposition[key] = int(value)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return track, false, err
+	}
+
+	stream.CodecType = MATROSKA_TRACK_TYPES[trackType]
+	if stream.CodecType == "" || enabled == 0 {
+		return track, false, nil
+	}
+	stream.CodecName = matroskaCodecName(codecID, stream)
+	if stream.CodecName == "" {
+		// ffprobe lists unknown codecs, but with nothing to say about them
+		stream.CodecName = "none"
+	}
+	applyCodecConfig(stream, codecPrivate)
+	stream.SideDataList = sideData
+
+	// ffprobe prints the bit depth of lossless audio as bits_per_raw_sample,
+	// and bits_per_sample only for PCM
+	if !strings.HasPrefix(stream.CodecName, "pcm_") {
+		if stream.BitsPerSample > 0 && (stream.CodecName == "flac" || stream.CodecName == "truehd" || stream.CodecName == "alac") {
+			stream.BitsPerRawSample = strconv.Itoa(stream.BitsPerSample)
+		}
+		stream.BitsPerSample = 0
+	}
+
+	// Matroska's default language is English; ffprobe leaves out "und"
+	switch {
+	case languageBCP47 != "":
+		stream.Tags["language"] = languageBCP47
+	case !languageSet:
+		stream.Tags["language"] = "eng"
+	case language != "und":
+		stream.Tags["language"] = language
+	}
+
+	if stream.CodecType == "video" {
+		stream.Refs = 1
+		if stream.CodecName == "h264" || stream.CodecName == "hevc" {
+			setDefault(&stream.ChromaLocation, "left")
+		}
+	}
+	if stream.CodecType == "audio" && stream.CodecName == "opus" && track.codecDelay > 0 {
+		stream.InitialPadding = int(track.codecDelay * 48000 / 1000000000)
+	}
+	stream.StartPts = 0
+	return track, true, nil
+}
+
+// Codec name of a track; PCM and some IDs need more than the CodecID
+func matroskaCodecName(codecID string, stream *Stream) string {
+	switch codecID {
+	case "A_PCM/INT/LIT":
+		switch stream.BitsPerSample {
+		case 8:
+			return "pcm_u8"
+		case 24:
+			return "pcm_s24le"
+		case 32:
+			return "pcm_s32le"
+		}
+		return "pcm_s16le"
+	case "A_PCM/INT/BIG":
+		switch stream.BitsPerSample {
+		case 24:
+			return "pcm_s24be"
+		case 32:
+			return "pcm_s32be"
+		}
+		return "pcm_s16be"
+	}
+	for id := codecID; id != ""; {
+		if name, known := MATROSKA_CODECS[id]; known {
+			if name == "aac" && stream.Profile == "" {
+				stream.Profile = matroskaAACProfile(codecID)
+			}
+			return name
+		}
+		slash := strings.LastIndex(id, "/")
+		if slash < 0 {
+			break
+		}
+		id = id[:slash]
+	}
+	return ""
+}
+
+// AAC profile of an old-style CodecID such as "A_AAC/MPEG4/LC/SBR", which
+// comes without a configuration record
+func matroskaAACProfile(codecID string) string {
+	switch {
+	case strings.HasSuffix(codecID, "/SBR"):
+		return "HE-AAC"
+	case strings.HasSuffix(codecID, "/LC"):
+		return "LC"
+	case strings.HasSuffix(codecID, "/MAIN"):
+		return "Main"
+	case strings.HasSuffix(codecID, "/SSR"):
+		return "SSR"
+	case strings.HasSuffix(codecID, "/LTP"):
+		return "LTP"
+	}
+	return ""
+}
+
+// Read a BlockAdditionMapping, which carries the Dolby Vision configuration
+func (m *matroskaReader) readBlockAddMapping(data, size int64) (SideData, bool, error) {
+	var idType uint64
+	var extra []byte
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		var err error
+		switch id {
+		case mkvBlockAddIDType:
+			idType, err = m.readUint(data, size)
+		case mkvBlockAddIDExtra:
+			extra, err = m.readBytes(data, size)
+		}
+		return err
+	})
+	if err != nil {
+		return SideData{}, false, err
+	}
+	// 'dvcC' and 'dvvC'
+	if idType != 0x64766343 && idType != 0x64767643 {
+		return SideData{}, false, nil
+	}
+	sideData, ok := doviSideData(extra)
+	return sideData, ok, nil
+}
+
+func (m *matroskaReader) readVideo(data, size int64, stream *Stream) ([]SideData, error) {
+	var displayWidth, displayHeight, displayUnit, interlaced, fieldOrder uint64
+	var sideData []SideData
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		var err error
+		var value uint64
+		switch id {
+		case mkvPixelWidth:
+			value, err = m.readUint(data, size)
+			stream.Width = int(value)
+		case mkvPixelHeight:
+			value, err = m.readUint(data, size)
+			stream.Height = int(value)
+		case mkvDisplayWidth:
+			displayWidth, err = m.readUint(data, size)
+		case mkvDisplayHeight:
+			displayHeight, err = m.readUint(data, size)
+		case mkvDisplayUnit:
+			displayUnit, err = m.readUint(data, size)
+		case mkvFlagInterlaced:
+			interlaced, err = m.readUint(data, size)
+		case mkvFieldOrder:
+			fieldOrder, err = m.readUint(data, size)
+		case mkvColour:
+			sideData, err = m.readColour(data, size, stream)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stream.CodedWidth, stream.CodedHeight = stream.Width, stream.Height
+	if displayUnit != 0 || displayWidth == 0 || displayHeight == 0 {
+		displayWidth, displayHeight = uint64(stream.Width), uint64(stream.Height)
+	}
+	stream.SampleAspectRatio = reducedRatio(int64(displayWidth)*int64(stream.Height), int64(displayHeight)*int64(stream.Width))
+	stream.DisplayAspectRatio = reducedRatio(int64(displayWidth), int64(displayHeight))
+
+	switch {
+	case interlaced == 2:
+		stream.FieldOrder = "progressive"
+	case interlaced == 1:
+		stream.FieldOrder = map[uint64]string{1: "tt", 6: "bb", 9: "tb", 14: "bt"}[fieldOrder]
+	}
+	return sideData, nil
+}
+
+// Read the Colour of a video track, and the HDR metadata it may carry as side data
+func (m *matroskaReader) readColour(data, size int64, stream *Stream) ([]SideData, error) {
+	var sideData []SideData
+	var chromaH, chromaV uint64
+	var maxCLL, maxFALL uint64
+	hasLightLevel := false
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		var err error
+		var value uint64
+		switch id {
+		case mkvMatrix:
+			value, err = m.readUint(data, size)
+			stream.ColorSpace = COLOR_SPACES[value]
+		case mkvTransfer:
+			value, err = m.readUint(data, size)
+			stream.ColorTransfer = COLOR_TRANSFERS[value]
+		case mkvPrimaries:
+			value, err = m.readUint(data, size)
+			stream.ColorPrimaries = COLOR_PRIMARIES[value]
+		case mkvRange:
+			value, err = m.readUint(data, size)
+			stream.ColorRange = map[uint64]string{1: "tv", 2: "pc"}[value]
+		case mkvChromaSitingH:
+			chromaH, err = m.readUint(data, size)
+		case mkvChromaSitingV:
+			chromaV, err = m.readUint(data, size)
+		case mkvMaxCLL:
+			maxCLL, err = m.readUint(data, size)
+			hasLightLevel = true
+		case mkvMaxFALL:
+			maxFALL, err = m.readUint(data, size)
+			hasLightLevel = true
+		case mkvMastering:
+			var mastering SideData
+			var ok bool
+			mastering, ok, err = m.readMastering(data, size)
+			if ok {
+				sideData = append(sideData, mastering)
+			}
+		}
+		return err
+	})
+
+	switch [2]uint64{chromaH, chromaV} {
+	case [2]uint64{1, 1}:
+		stream.ChromaLocation = "topleft"
+	case [2]uint64{1, 2}:
+		stream.ChromaLocation = "left"
+	case [2]uint64{2, 1}:
+		stream.ChromaLocation = "top"
+	case [2]uint64{2, 2}:
+		stream.ChromaLocation = "center"
+	}
+	if hasLightLevel {
+		sideData = append(sideData, SideData{
+			SideDataType: "Content light level metadata",
+			Fields: []SideDataField{
+				{"max_content", int64(maxCLL)},
+				{"max_average", int64(maxFALL)},
+			},
+		})
+	}
+	return sideData, err
+}
+
+// Read MasteringMetadata as ffprobe prints it, in the fixed denominators
+// ffmpeg converts it to
+func (m *matroskaReader) readMastering(data, size int64) (SideData, bool, error) {
+	// PrimaryRChromaticityX to LuminanceMin, in ID order
+	ids := []uint32{0x55D1, 0x55D2, 0x55D3, 0x55D4, 0x55D5, 0x55D6, 0x55D7, 0x55D8, 0x55D9, 0x55DA}
+	values := map[uint32]float64{}
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		for _, known := range ids {
+			if id == known {
+				value, err := m.readFloat(data, size)
+				values[id] = value
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || len(values) == 0 {
+		return SideData{}, false, err
+	}
+
+	chroma := func(id uint32) string {
+		return fmt.Sprintf("%d/50000", int64(math.Round(values[id]*50000)))
+	}
+	luminance := func(id uint32) string {
+		return fmt.Sprintf("%d/10000", int64(math.Round(values[id]*10000)))
+	}
+	return SideData{
+		SideDataType: "Mastering display metadata",
+		Fields: []SideDataField{
+			{"red_x", chroma(0x55D1)},
+			{"red_y", chroma(0x55D2)},
+			{"green_x", chroma(0x55D3)},
+			{"green_y", chroma(0x55D4)},
+			{"blue_x", chroma(0x55D5)},
+			{"blue_y", chroma(0x55D6)},
+			{"white_point_x", chroma(0x55D7)},
+			{"white_point_y", chroma(0x55D8)},
+			{"min_luminance", luminance(0x55DA)},
+			{"max_luminance", luminance(0x55D9)},
+		},
+	}, true, nil
+}
+
+func (m *matroskaReader) readAudio(data, size int64, stream *Stream) error {
+	var sampleRate, outputRate float64
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		var err error
+		var value uint64
+		switch id {
+		case mkvSamplingFreq:
+			sampleRate, err = m.readFloat(data, size)
+		case mkvOutputFreq:
+			outputRate, err = m.readFloat(data, size)
+		case mkvChannels:
+			value, err = m.readUint(data, size)
+			stream.Channels = int(value)
+		case mkvBitDepth:
+			value, err = m.readUint(data, size)
+			stream.BitsPerSample = int(value)
+		}
+		return err
+	})
+	if outputRate > 0 {
+		sampleRate = outputRate
+	}
+	if sampleRate == 0 {
+		sampleRate = 8000
+	}
+	if stream.Channels == 0 {
+		stream.Channels = 1
+	}
+	stream.SampleRate = strconv.Itoa(int(sampleRate))
+	return err
+}
+
+func (m *matroskaReader) readChapters(data, size int64) ([]Chapter, error) {
+	var chapters []Chapter
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		// ffprobe lists the chapters of the first edition
+		if id != mkvEditionEntry || chapters != nil {
+			return nil
+		}
+		chapters = []Chapter{}
+		return m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+			if id != mkvChapterAtom {
+				return nil
+			}
+			chapter, err := m.readChapterAtom(data, size)
+			chapters = append(chapters, chapter)
+			return err
+		})
+	})
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	return chapters, err
+}
+
+func (m *matroskaReader) readChapterAtom(data, size int64) (Chapter, error) {
+	chapter := Chapter{TimeBase: "1/1000000000"}
+	hasEnd := false
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		var err error
+		var value uint64
+		switch id {
+		case mkvChapterUID:
+			value, err = m.readUint(data, size)
+			chapter.ID = int64(value)
+		case mkvChapterStart:
+			value, err = m.readUint(data, size)
+			chapter.Start = int64(value)
+		case mkvChapterEnd:
+			value, err = m.readUint(data, size)
+			chapter.End = int64(value)
+			hasEnd = true
+		case mkvChapterDisplay:
+			if chapter.Tags != nil {
+				return nil
+			}
+			err = m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+				if id != mkvChapString {
+					return nil
+				}
+				title, err := m.readString(data, size)
+				chapter.Tags = map[string]string{"title": title}
+				return err
+			})
+		}
+		return err
+	})
+	if !hasEnd {
+		chapter.End = -1
+	}
+	return chapter, err
+}
+
+// Read the attachments ffprobe lists as streams; their data is not read
+func (m *matroskaReader) readAttachments(data, size int64) ([]Stream, error) {
+	var streams []Stream
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		if id != mkvAttachedFile {
+			return nil
+		}
+		stream := Stream{Tags: map[string]string{}, TimeBase: "1/90000"}
+		err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+			var err error
+			switch id {
+			case mkvFileName:
+				stream.Tags["filename"], err = m.readString(data, size)
+			case mkvFileMediaType:
+				stream.Tags["mimetype"], err = m.readString(data, size)
+			case mkvFileData:
+				stream.ExtradataSize = int(size)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		codecName, known := MATROSKA_ATTACHMENT_CODECS[strings.ToLower(stream.Tags["mimetype"])]
+		if !known {
+			return nil
+		}
+		stream.CodecName = codecName
+		stream.CodecType = "attachment"
+		if codecName == "mjpeg" || codecName == "png" {
+			// Cover art is a video stream with a single picture
+			stream.CodecType = "video"
+			stream.ExtradataSize = 0
+			stream.Disposition = newDisposition()
+			stream.Disposition["attached_pic"] = 1
+		}
+		streams = append(streams, stream)
+		return nil
+	})
+	return streams, err
+}
+
+// matroskaTag is a Tag of the segment (TrackUID 0) or of a track
+type matroskaTag struct {
+	TrackUID uint64
+	Values   map[string]string
+}
+
+func (m *matroskaReader) readTags(data, size int64) ([]matroskaTag, error) {
+	var tags []matroskaTag
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		if id != mkvTag {
+			return nil
+		}
+		tag := matroskaTag{Values: map[string]string{}}
+		otherTarget := false
+		err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+			switch id {
+			case mkvTargets:
+				return m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+					var err error
+					switch id {
+					case mkvTagTrackUID:
+						tag.TrackUID, err = m.readUint(data, size)
+					case mkvTagChapterUID, mkvTagAttachUID:
+						otherTarget = true
+					}
+					return err
+				})
+			case mkvSimpleTag:
+				return m.readSimpleTag(data, size, tag.Values)
+			}
+			return nil
+		})
+		if !otherTarget {
+			tags = append(tags, tag)
+		}
+		return err
+	})
+	return tags, err
+}
+
+// Read a SimpleTag under the key ffprobe gives it: its name, with the
+// language appended for tags that are not the default
+func (m *matroskaReader) readSimpleTag(data, size int64, values map[string]string) error {
+	var name, value string
+	language := "und"
+	isDefault := uint64(1)
+	err := m.eachChild(data, data+size, func(id uint32, data, size int64) error {
+		var err error
+		switch id {
+		case mkvTagName:
+			name, err = m.readString(data, size)
+		case mkvTagString:
+			value, err = m.readString(data, size)
+		case mkvTagLanguage:
+			language, err = m.readString(data, size)
+		case mkvTagDefault:
+			isDefault, err = m.readUint(data, size)
+		}
+		return err
+	})
+	if err != nil || name == "" {
+		return err
+	}
+	if isDefault == 0 && language != "und" {
+		name += "-" + language
+	}
+	values[name] = value
+	return nil
+}
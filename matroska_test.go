@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// An EBML element with 8-byte size, holding its children one after another
+func ebml(id uint32, children ...[]byte) []byte {
+	var out []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(out) > 0 {
+			out = append(out, b)
+		}
+	}
+	data := bytes.Join(children, nil)
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(data)))
+	out = append(append(out, 0x01), size[1:]...)
+	return append(out, data...)
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	return ebml(id, binary.BigEndian.AppendUint64(nil, value))
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	return ebml(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebml(id, []byte(value))
+}
+
+// HEVCDecoderConfigurationRecord of a Main 10 stream at level 5.1
+func hevcMain10Config() []byte {
+	config := make([]byte, 23)
+	config[1] = 2
+	config[12] = 153
+	config[16] = 0xfd // 4:2:0
+	config[17] = 0xfa // 10 bits
+	config[21] = 0x0f // 4-byte NAL lengths
+	return config
+}
+
+// A Matroska file with an HEVC video, an E-AC-3 audio, a forced subtitle and
+// a disabled track, two chapters, and tags after the first cluster that are
+// found through the SeekHead
+func matroskaFixture() []byte {
+	return matroskaFixtureWith(nil)
+}
+
+// The Matroska fixture with padding before the tags
+func matroskaFixtureWith(padding []byte) []byte {
+	header := ebml(mkvEBML, ebmlString(mkvDocType, "matroska"))
+	info := ebml(mkvInfo,
+		ebmlUint(mkvTimestampScale, 1000000),
+		ebmlFloat(mkvDuration, 5400500),
+		ebmlString(mkvTitle, "A Movie"),
+		ebmlString(mkvMuxingApp, "libebml v1.4.4"),
+	)
+	tracks := ebml(mkvTracks,
+		ebml(mkvTrackEntry,
+			ebmlUint(mkvTrackNumber, 1),
+			ebmlUint(mkvTrackUID, 11),
+			ebmlUint(mkvTrackType, 1),
+			ebmlString(mkvCodecID, "V_MPEGH/ISO/HEVC"),
+			ebml(mkvCodecPrivate, hevcMain10Config()),
+			ebmlUint(mkvDefaultDuration, 41708333),
+			ebml(mkvVideo, ebmlUint(mkvPixelWidth, 3840), ebmlUint(mkvPixelHeight, 2160)),
+		),
+		ebml(mkvTrackEntry,
+			ebmlUint(mkvTrackNumber, 2),
+			ebmlUint(mkvTrackUID, 12),
+			ebmlUint(mkvTrackType, 2),
+			ebmlString(mkvCodecID, "A_EAC3"),
+			ebmlString(mkvLanguage, "ger"),
+			ebmlString(mkvName, "Deutsch"),
+			ebmlUint(mkvFlagDefault, 0),
+			ebml(mkvAudio, ebmlFloat(mkvSamplingFreq, 48000), ebmlUint(mkvChannels, 6)),
+		),
+		ebml(mkvTrackEntry,
+			ebmlUint(mkvTrackNumber, 3),
+			ebmlUint(mkvTrackUID, 13),
+			ebmlUint(mkvTrackType, 17),
+			ebmlString(mkvCodecID, "S_TEXT/UTF8"),
+			ebmlString(mkvLanguage, "und"),
+			ebmlUint(mkvFlagForced, 1),
+		),
+		ebml(mkvTrackEntry,
+			ebmlUint(mkvTrackNumber, 4),
+			ebmlUint(mkvTrackUID, 14),
+			ebmlUint(mkvTrackType, 2),
+			ebmlString(mkvCodecID, "A_AAC"),
+			ebmlUint(mkvFlagEnabled, 0),
+		),
+	)
+	chapters := ebml(mkvChapters, ebml(mkvEditionEntry,
+		ebml(mkvChapterAtom,
+			ebmlUint(mkvChapterUID, 2),
+			ebmlUint(mkvChapterStart, 600000000000),
+		),
+		ebml(mkvChapterAtom,
+			ebmlUint(mkvChapterUID, 1),
+			ebmlUint(mkvChapterStart, 0),
+			ebml(mkvChapterDisplay, ebmlString(mkvChapString, "Intro")),
+		),
+	))
+	cluster := ebml(mkvCluster, padding)
+	tags := ebml(mkvTags, ebml(mkvTag,
+		ebml(mkvTargets, ebmlUint(mkvTagTrackUID, 12)),
+		ebml(mkvSimpleTag, ebmlString(mkvTagName, "BPS"), ebmlString(mkvTagString, "640000")),
+	))
+
+	seekHead := func(tagsPosition uint64) []byte {
+		return ebml(mkvSeekHead, ebml(mkvSeek,
+			ebmlUint(mkvSeekID, mkvTags),
+			ebmlUint(mkvSeekPosition, tagsPosition),
+		))
+	}
+	before := [][]byte{info, tracks, chapters, cluster}
+	position := len(seekHead(0))
+	for _, section := range before {
+		position += len(section)
+	}
+	segment := ebml(mkvSegment, append(append([][]byte{seekHead(uint64(position))}, before...), tags)...)
+	return append(header, segment...)
+}
+
+func TestProbeMatroska(t *testing.T) {
+	response, err := probeBytes(probeMatroska, matroskaFixture(), int64(NATIVE_PROBE_BUDGET))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	format := response.Format
+	if format.FormatName != "matroska,webm" || format.Duration != "5400.500000" ||
+		format.Tags["title"] != "A Movie" || format.Tags["encoder"] != "libebml v1.4.4" {
+		t.Errorf("format %+v", format)
+	}
+
+	if len(response.Streams) != 3 {
+		t.Fatalf("%d streams, want 3 without the disabled track", len(response.Streams))
+	}
+	tests := []struct {
+		field, got, want string
+	}{
+		{"video codec", response.Streams[0].CodecName, "hevc"},
+		{"video profile", response.Streams[0].Profile, "Main 10"},
+		{"video pixel format", response.Streams[0].PixFmt, "yuv420p10le"},
+		{"video frame rate", response.Streams[0].RFrameRate, "24000/1001"},
+		{"video aspect ratio", response.Streams[0].DisplayAspectRatio, "16:9"},
+		{"video language", response.Streams[0].Tags["language"], "eng"},
+		{"audio codec", response.Streams[1].CodecName, "eac3"},
+		{"audio sample rate", response.Streams[1].SampleRate, "48000"},
+		{"audio channel layout", response.Streams[1].ChannelLayout, "5.1(side)"},
+		{"audio language", response.Streams[1].Tags["language"], "ger"},
+		{"audio title", response.Streams[1].Tags["title"], "Deutsch"},
+		{"audio tag after the cluster", response.Streams[1].Tags["BPS"], "640000"},
+		{"subtitle codec", response.Streams[2].CodecName, "subrip"},
+		{"subtitle language", response.Streams[2].Tags["language"], ""},
+		{"time base", response.Streams[0].TimeBase, "1/1000"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s is %q, want %q", test.field, test.got, test.want)
+		}
+	}
+	if video := response.Streams[0]; video.Width != 3840 || video.Height != 2160 || video.Level != 153 {
+		t.Errorf("video is %dx%d at level %d", video.Width, video.Height, video.Level)
+	}
+	if got := response.Streams[1].Channels; got != 6 {
+		t.Errorf("audio has %d channels, want 6", got)
+	}
+	for i, want := range []map[string]int{
+		{"default": 1, "forced": 0},
+		{"default": 0, "forced": 0},
+		{"default": 1, "forced": 1},
+	} {
+		for key, value := range want {
+			if got := response.Streams[i].Disposition[key]; got != value {
+				t.Errorf("stream %d disposition %s is %d, want %d", i, key, got, value)
+			}
+		}
+	}
+
+	// Chapters come in time order, and the last one ends with the file
+	chapters := response.Chapters
+	if len(chapters) != 2 || chapters[0].Tags["title"] != "Intro" ||
+		chapters[0].EndTime != "600.000000" || chapters[1].EndTime != "5400.500000" {
+		t.Errorf("chapters %+v", chapters)
+	}
+}
+
+func TestProbeMatroskaBudget(t *testing.T) {
+	// Tags beyond the budget are left out
+	data := matroskaFixtureWith(make([]byte, 4*nativeChunkSize))
+	response, err := probeBytes(probeMatroska, data, nativeChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := response.Streams[1].Tags["BPS"]; exists {
+		t.Error("tags beyond the budget were read")
+	}
+	if response, err := probeBytes(probeMatroska, data, int64(len(data))); err != nil || response.Streams[1].Tags["BPS"] != "640000" {
+		t.Errorf("tags within the budget were not read: %v", err)
+	}
+
+	// Tracks beyond it fail the probe
+	header := ebml(mkvEBML, ebmlString(mkvDocType, "webm"))
+	void := ebml(0xEC, make([]byte, 2*nativeChunkSize))
+	tracks := ebml(mkvTracks, ebml(mkvTrackEntry, ebmlUint(mkvTrackType, 1), ebmlString(mkvCodecID, "V_VP9")))
+	data = append(header, ebml(mkvSegment, void, tracks)...)
+	if _, err := probeBytes(probeMatroska, data, nativeChunkSize); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("tracks beyond the budget gave %v, want %v", err, errBudgetExceeded)
+	}
+	if response, err := probeBytes(probeMatroska, data, int64(NATIVE_PROBE_BUDGET)); err != nil || response.Streams[0].CodecName != "vp9" {
+		t.Errorf("tracks within the budget were not read: %v", err)
+	}
+}
+
+func TestProbeMatroskaErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"not EBML", []byte("RIFF....AVI LIST"), errNotThisFormat},
+		{"other document type", ebml(mkvEBML, ebmlString(mkvDocType, "other")), errNotThisFormat},
+		{"no segment", ebml(mkvEBML, ebmlString(mkvDocType, "matroska")), nil},
+		{"no tracks", append(ebml(mkvEBML), ebml(mkvSegment, ebml(mkvInfo))...), nil},
+		{"truncated", matroskaFixture()[:200], nil},
+		{"oversized value", append(ebml(mkvEBML), ebml(mkvSegment, ebml(mkvTracks, ebml(mkvTrackEntry,
+			ebml(mkvCodecPrivate, make([]byte, maxMatroskaValue+1)))))...), nil},
+	}
+	for _, test := range tests {
+		_, err := probeBytes(probeMatroska, test.data, 1<<24)
+		if err == nil || test.want != nil && err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func FuzzProbeMatroska(f *testing.F) {
+	fuzzReader(f, probeMatroska, matroskaFixture(), ebml(mkvEBML, ebmlString(mkvDocType, "webm")))
+}
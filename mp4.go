@@ -0,0 +1,761 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Codec names by MP4 sample entry type
+var MP4_CODECS = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"dvh1": "hevc",
+	"dvhe": "hevc",
+	"av01": "av1",
+	"vp08": "vp8",
+	"vp09": "vp9",
+	"mp4v": "mpeg4",
+	"jpeg": "mjpeg",
+	"mjpa": "mjpeg",
+	"apch": "prores",
+	"apcn": "prores",
+	"apcs": "prores",
+	"apco": "prores",
+	"ap4h": "prores",
+	"mp4a": "aac",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+	"Opus": "opus",
+	"fLaC": "flac",
+	"alac": "alac",
+	"mlpa": "truehd",
+	"dtsc": "dts",
+	"dtsh": "dts",
+	"dtsl": "dts",
+	"dtse": "dts",
+	"sowt": "pcm_s16le",
+	"twos": "pcm_s16be",
+	"in24": "pcm_s24be",
+	"fl32": "pcm_f32be",
+	"tx3g": "mov_text",
+	"wvtt": "webvtt",
+	"c608": "eia_608",
+}
+
+// Codec names by MPEG-4 objectTypeIndication, for "mp4a" and "mp4v" entries
+var MP4_OBJECT_TYPES = map[byte]string{
+	0x20: "mpeg4",
+	0x40: "aac",
+	0x60: "mpeg2video",
+	0x61: "mpeg2video",
+	0x62: "mpeg2video",
+	0x63: "mpeg2video",
+	0x64: "mpeg2video",
+	0x65: "mpeg2video",
+	0x66: "aac",
+	0x67: "aac",
+	0x68: "aac",
+	0x69: "mp3",
+	0x6A: "mpeg1video",
+	0x6B: "mp3",
+	0x6C: "mjpeg",
+	0xA5: "ac3",
+	0xA6: "eac3",
+	0xA9: "dts",
+	0xAD: "opus",
+	0xDD: "vorbis",
+}
+
+// Stream types by handler type; tracks of other types, such as timecodes,
+// are not listed
+var MP4_HANDLER_TYPES = map[string]string{
+	"vide": "video",
+	"soun": "audio",
+	"sbtl": "subtitle",
+	"subt": "subtitle",
+	"text": "subtitle",
+	"clcp": "subtitle",
+}
+
+// Format tags by iTunes metadata item
+var MP4_METADATA_TAGS = map[string]string{
+	"\xa9nam": "title",
+	"\xa9ART": "artist",
+	"\xa9alb": "album",
+	"\xa9day": "date",
+	"\xa9gen": "genre",
+	"\xa9cmt": "comment",
+	"\xa9too": "encoder",
+	"desc":    "description",
+}
+
+// Channels of an AC-3 audio coding mode
+var AC3_CHANNELS = []int{2, 1, 2, 3, 3, 4, 4, 5}
+
+// Largest sample size table read to work out the bitrate of a track; the
+// bitrate is left out for tracks with larger ones
+const mp4MaxSampleSizes = 256 * 1024
+
+// Largest box whose content is read whole
+const mp4MaxBoxContent = 1 << 20
+
+// MP4 times count from the start of 1904
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// mp4Reader reads ISO base media file format boxes through a budgetReader
+type mp4Reader struct {
+	r *budgetReader
+}
+
+// mp4Box is the position of a box: its type, and where its content starts and ends
+type mp4Box struct {
+	Type  string
+	Start int64
+	End   int64
+}
+
+// Read the stream information of an MP4 or QuickTime file from its ftyp and
+// moov boxes. The moov box is found by skipping over the boxes before it, so
+// that one at the end of a file costs a read at the end rather than reading
+// the media data.
+func probeMP4(r *budgetReader) (*FFProbeResponse, error) {
+	m := &mp4Reader{r: r}
+	first, err := m.box(0, r.size)
+	if err == errBudgetExceeded {
+		return nil, err
+	} else if err != nil {
+		return nil, errNotThisFormat
+	}
+	if !isTopLevelBox(first.Type) {
+		return nil, errNotThisFormat
+	}
+
+	response := &FFProbeResponse{
+		Format: Format{
+			FormatName:     "mov,mp4,m4a,3gp,3g2,mj2",
+			FormatLongName: "QuickTime / MOV",
+			StartTime:      "0.000000",
+			ProbeScore:     100,
+			Tags:           map[string]string{},
+		},
+	}
+
+	foundMoov := false
+	err = m.eachBox(0, r.size, func(box mp4Box) error {
+		switch box.Type {
+		case "ftyp":
+			return m.readFtyp(box, &response.Format)
+		case "moov":
+			foundMoov = true
+			return m.readMoov(box, response)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !foundMoov {
+		return nil, fmt.Errorf("no moov box found")
+	}
+	return response, nil
+}
+
+// Read the header of the box at an offset, which must end before end
+func (m *mp4Reader) box(offset, end int64) (mp4Box, error) {
+	var header [16]byte
+	n, err := m.r.ReadAt(header[:], offset)
+	if n < 8 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return mp4Box{}, err
+	}
+
+	box := mp4Box{Type: string(header[4:8]), Start: offset + 8}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	switch size {
+	case 0:
+		size = end - offset
+	case 1:
+		if n < 16 {
+			return mp4Box{}, io.ErrUnexpectedEOF
+		}
+		size = int64(binary.BigEndian.Uint64(header[8:16]))
+		box.Start += 8
+	}
+	box.End = offset + size
+	if box.End < box.Start || box.End > end {
+		return mp4Box{}, fmt.Errorf("invalid %q box at %d", box.Type, offset)
+	}
+	return box, nil
+}
+
+// Call fn for each box between two offsets
+func (m *mp4Reader) eachBox(start, end int64, fn func(box mp4Box) error) error {
+	for offset := start; offset+8 <= end; {
+		box, err := m.box(offset, end)
+		if err != nil {
+			return err
+		}
+		if err := fn(box); err != nil {
+			return err
+		}
+		offset = box.End
+	}
+	return nil
+}
+
+// Call fn for each child box of a box, whose children start skip bytes in
+func (m *mp4Reader) eachChild(parent mp4Box, skip int64, fn func(box mp4Box) error) error {
+	return m.eachBox(parent.Start+skip, parent.End, fn)
+}
+
+// Read the content of a box, starting skip bytes in
+func (m *mp4Reader) content(box mp4Box, skip int64) ([]byte, error) {
+	size := box.End - box.Start - skip
+	if size < 0 {
+		return nil, fmt.Errorf("truncated %q box", box.Type)
+	}
+	if size > mp4MaxBoxContent {
+		return nil, fmt.Errorf("%q box of %d bytes is too large", box.Type, size)
+	}
+	buf := make([]byte, size)
+	if _, err := m.r.ReadAt(buf, box.Start+skip); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (m *mp4Reader) readFtyp(box mp4Box, format *Format) error {
+	data, err := m.content(box, 0)
+	if err != nil || len(data) < 8 {
+		return err
+	}
+	format.Tags["major_brand"] = strings.TrimRight(string(data[:4]), "\x00")
+	format.Tags["minor_version"] = strconv.FormatUint(uint64(binary.BigEndian.Uint32(data[4:8])), 10)
+	var brands strings.Builder
+	for i := 8; i+4 <= len(data); i += 4 {
+		brands.WriteString(strings.TrimRight(string(data[i:i+4]), "\x00"))
+	}
+	format.Tags["compatible_brands"] = brands.String()
+	return nil
+}
+
+func (m *mp4Reader) readMoov(moov mp4Box, response *FFProbeResponse) error {
+	return m.eachChild(moov, 0, func(box mp4Box) error {
+		switch box.Type {
+		case "mvhd":
+			data, err := m.content(box, 0)
+			if err != nil {
+				return err
+			}
+			created, timescale, duration := mp4TimeHeader(data)
+			if timescale > 0 && duration > 0 {
+				response.Format.Duration = fmt.Sprintf("%.6f", float64(duration)/float64(timescale))
+			}
+			if created != "" {
+				response.Format.Tags["creation_time"] = created
+			}
+		case "trak":
+			stream, keep, err := m.readTrak(box)
+			if err != nil {
+				return err
+			}
+			if keep {
+				stream.Index = len(response.Streams)
+				finishNativeStream(&stream)
+				response.Streams = append(response.Streams, stream)
+			}
+		case "udta":
+			return m.readUserData(box, response.Format.Tags)
+		}
+		return nil
+	})
+}
+
+// Creation time, timescale and duration of an mvhd or mdhd box
+func mp4TimeHeader(data []byte) (string, uint32, uint64) {
+	var created uint64
+	var timescale uint32
+	var duration uint64
+	switch {
+	case len(data) >= 32 && data[0] == 1:
+		created = binary.BigEndian.Uint64(data[4:12])
+		timescale = binary.BigEndian.Uint32(data[20:24])
+		duration = binary.BigEndian.Uint64(data[24:32])
+	case len(data) >= 20:
+		created = uint64(binary.BigEndian.Uint32(data[4:8]))
+		timescale = binary.BigEndian.Uint32(data[12:16])
+		duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	default:
+		return "", 0, 0
+	}
+	if created == 0 {
+		return "", timescale, duration
+	}
+	return mp4Epoch.Add(time.Duration(created) * time.Second).Format("2006-01-02T15:04:05.000000Z"), timescale, duration
+}
+
+// Read a track; false for tracks ffprobe would not list as streams
+func (m *mp4Reader) readTrak(trak mp4Box) (Stream, bool, error) {
+	stream := Stream{Tags: map[string]string{}, Disposition: newDisposition()}
+	var timescale uint32
+	var duration, sampleCount uint64
+	var sampleDelta uint32
+	var dataSize int64 = -1
+
+	var walk func(parent mp4Box) error
+	walk = func(parent mp4Box) error {
+		return m.eachChild(parent, 0, func(box mp4Box) error {
+			switch box.Type {
+			case "mdia", "minf", "stbl":
+				return walk(box)
+			case "tkhd":
+				data, err := m.content(box, 0)
+				if err != nil || len(data) < 4 {
+					return err
+				}
+				// Enabled tracks are the default ones
+				if data[3]&1 != 0 {
+					stream.Disposition["default"] = 1
+				}
+				idOffset := 12
+				if data[0] == 1 {
+					idOffset = 20
+				}
+				if len(data) >= idOffset+4 {
+					stream.ID = fmt.Sprintf("0x%x", binary.BigEndian.Uint32(data[idOffset:idOffset+4]))
+				}
+			case "mdhd":
+				data, err := m.content(box, 0)
+				if err != nil {
+					return err
+				}
+				var created string
+				created, timescale, duration = mp4TimeHeader(data)
+				if created != "" {
+					stream.Tags["creation_time"] = created
+				}
+				languageOffset := 20
+				if len(data) > 0 && data[0] == 1 {
+					languageOffset = 32
+				}
+				if len(data) >= languageOffset+2 {
+					if language := mp4Language(binary.BigEndian.Uint16(data[languageOffset:])); language != "und" && language != "" {
+						stream.Tags["language"] = language
+					}
+				}
+			case "hdlr":
+				data, err := m.content(box, 0)
+				if err != nil || len(data) < 12 {
+					return err
+				}
+				stream.CodecType = MP4_HANDLER_TYPES[string(data[8:12])]
+				if len(data) > 24 {
+					name := strings.TrimRight(string(data[24:]), "\x00")
+					// QuickTime writes the name as a Pascal string
+					if len(name) > 0 && int(name[0]) == len(name)-1 {
+						name = name[1:]
+					}
+					if name != "" {
+						stream.Tags["handler_name"] = name
+					}
+				}
+			case "stsd":
+				return m.readSampleDescription(box, &stream)
+			case "stts":
+				data, err := m.content(box, 0)
+				if err != nil || len(data) < 8 {
+					return err
+				}
+				entries := int(binary.BigEndian.Uint32(data[4:8]))
+				for i := 0; i < entries && 8+i*8+8 <= len(data); i++ {
+					count := binary.BigEndian.Uint32(data[8+i*8:])
+					delta := binary.BigEndian.Uint32(data[12+i*8:])
+					sampleCount += uint64(count)
+					if i == 0 {
+						sampleDelta = delta
+					}
+				}
+			case "stsz":
+				var err error
+				dataSize, err = m.sampleDataSize(box)
+				return err
+			}
+			return nil
+		})
+	}
+	if err := walk(trak); err != nil {
+		return stream, false, err
+	}
+	if stream.CodecType == "" || stream.CodecName == "" {
+		return stream, false, nil
+	}
+
+	if timescale > 0 {
+		stream.TimeBase = fmt.Sprintf("1/%d", timescale)
+		stream.DurationTS = int64(duration)
+		stream.Duration = fmt.Sprintf("%.6f", float64(duration)/float64(timescale))
+		if dataSize >= 0 && duration > 0 {
+			stream.BitRate = strconv.FormatInt(dataSize*8*int64(timescale)/int64(duration), 10)
+		}
+	}
+	if stream.CodecType == "video" {
+		stream.Refs = 1
+		stream.NbFrames = strconv.FormatUint(sampleCount, 10)
+		if timescale > 0 && sampleDelta > 0 {
+			stream.RFrameRate = frameRateFromPeriod(int64(sampleDelta) * 1e9 / int64(timescale))
+		}
+		if duration > 0 && sampleCount > 0 {
+			num, den := int64(sampleCount)*int64(timescale), int64(duration)
+			g := gcd(num, den)
+			stream.AvgFrameRate = fmt.Sprintf("%d/%d", num/g, den/g)
+		}
+	} else if stream.CodecType == "audio" {
+		stream.NbFrames = strconv.FormatUint(sampleCount, 10)
+	}
+	if stream.CodecType == "video" || stream.CodecType == "audio" {
+		stream.Tags["vendor_id"] = "[0][0][0][0]"
+	}
+	stream.StartTime = "0.000000"
+	return stream, true, nil
+}
+
+// Total size of the samples of a track, from its stsz box; -1 if the table
+// is too large to read
+func (m *mp4Reader) sampleDataSize(box mp4Box) (int64, error) {
+	header, err := m.content(mp4Box{Type: box.Type, Start: box.Start, End: min(box.End, box.Start+12)}, 0)
+	if err != nil || len(header) < 12 {
+		return -1, err
+	}
+	sampleSize := int64(binary.BigEndian.Uint32(header[4:8]))
+	count := int64(binary.BigEndian.Uint32(header[8:12]))
+	if sampleSize != 0 {
+		return sampleSize * count, nil
+	}
+	if count*4 > mp4MaxSampleSizes {
+		return -1, nil
+	}
+	table, err := m.content(box, 12)
+	if err != nil {
+		return -1, err
+	}
+	var total int64
+	for i := 0; i+4 <= len(table); i += 4 {
+		total += int64(binary.BigEndian.Uint32(table[i:]))
+	}
+	return total, nil
+}
+
+// Language of a track, packed as three 5-bit letters; QuickTime language codes
+// below 0x400 are not ISO 639 and say nothing ffprobe would print
+func mp4Language(packed uint16) string {
+	if packed < 0x400 || packed == 0x7fff {
+		return ""
+	}
+	return string([]byte{
+		byte(packed>>10&0x1f) + 0x60,
+		byte(packed>>5&0x1f) + 0x60,
+		byte(packed&0x1f) + 0x60,
+	})
+}
+
+// Read the first sample entry of a track's stsd box
+func (m *mp4Reader) readSampleDescription(stsd mp4Box, stream *Stream) error {
+	entry, err := m.box(stsd.Start+8, stsd.End)
+	if err != nil {
+		return err
+	}
+	stream.CodecTagString = entry.Type
+	tag := []byte(entry.Type)
+	stream.CodecTag = fmt.Sprintf("0x%08x", binary.LittleEndian.Uint32(tag))
+	stream.CodecName = MP4_CODECS[entry.Type]
+
+	switch stream.CodecType {
+	case "video":
+		return m.readVisualSampleEntry(entry, stream)
+	case "audio":
+		return m.readAudioSampleEntry(entry, stream)
+	}
+	return nil
+}
+
+func (m *mp4Reader) readVisualSampleEntry(entry mp4Box, stream *Stream) error {
+	data, err := m.content(mp4Box{Type: entry.Type, Start: entry.Start, End: min(entry.End, entry.Start+78)}, 0)
+	if err != nil || len(data) < 78 {
+		return err
+	}
+	stream.Width = int(binary.BigEndian.Uint16(data[24:26]))
+	stream.Height = int(binary.BigEndian.Uint16(data[26:28]))
+	stream.CodedWidth, stream.CodedHeight = stream.Width, stream.Height
+	if length := int(data[42]); length > 0 && length < 32 {
+		stream.Tags["encoder"] = string(data[43 : 43+length])
+	}
+
+	sarNum, sarDen := int64(1), int64(1)
+	var mastering, lightLevel, dovi *SideData
+	err = m.eachChild(entry, 78, func(box mp4Box) error {
+		data, err := m.content(box, 0)
+		if err != nil {
+			return err
+		}
+		switch box.Type {
+		case "avcC", "hvcC", "av1C":
+			applyCodecConfig(stream, data)
+		case "esds":
+			m.applyESDescriptor(stream, data)
+		case "pasp":
+			if len(data) >= 8 {
+				sarNum = int64(binary.BigEndian.Uint32(data[0:4]))
+				sarDen = int64(binary.BigEndian.Uint32(data[4:8]))
+			}
+		case "colr":
+			if len(data) >= 10 && (string(data[:4]) == "nclx" || string(data[:4]) == "nclc") {
+				stream.ColorPrimaries = COLOR_PRIMARIES[uint64(binary.BigEndian.Uint16(data[4:6]))]
+				stream.ColorTransfer = COLOR_TRANSFERS[uint64(binary.BigEndian.Uint16(data[6:8]))]
+				stream.ColorSpace = COLOR_SPACES[uint64(binary.BigEndian.Uint16(data[8:10]))]
+				if string(data[:4]) == "nclx" && len(data) >= 11 {
+					stream.ColorRange = "tv"
+					if data[10]&0x80 != 0 {
+						stream.ColorRange = "pc"
+					}
+				}
+			}
+		case "dvcC", "dvvC":
+			if sideData, ok := doviSideData(data); ok {
+				dovi = &sideData
+			}
+		case "mdcv":
+			if sideData, ok := mdcvSideData(data); ok {
+				mastering = &sideData
+			}
+		case "clli":
+			if len(data) >= 4 {
+				lightLevel = &SideData{
+					SideDataType: "Content light level metadata",
+					Fields: []SideDataField{
+						{"max_content", int64(binary.BigEndian.Uint16(data[0:2]))},
+						{"max_average", int64(binary.BigEndian.Uint16(data[2:4]))},
+					},
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sideData := range []*SideData{mastering, lightLevel, dovi} {
+		if sideData != nil {
+			stream.SideDataList = append(stream.SideDataList, *sideData)
+		}
+	}
+	if sarNum <= 0 || sarDen <= 0 {
+		sarNum, sarDen = 1, 1
+	}
+	stream.SampleAspectRatio = reducedRatio(sarNum, sarDen)
+	stream.DisplayAspectRatio = reducedRatio(int64(stream.Width)*sarNum, int64(stream.Height)*sarDen)
+	if stream.CodecName == "h264" || stream.CodecName == "hevc" {
+		setDefault(&stream.ChromaLocation, "left")
+	}
+	return nil
+}
+
+// Side data for a mastering display colour volume box, whose primaries come
+// in the order green, blue, red
+func mdcvSideData(data []byte) (SideData, bool) {
+	if len(data) < 24 {
+		return SideData{}, false
+	}
+	value := func(i int) int64 { return int64(binary.BigEndian.Uint16(data[i*2:])) }
+	chroma := func(i int) string { return fmt.Sprintf("%d/50000", value(i)) }
+	luminance := func(offset int) string {
+		return fmt.Sprintf("%d/10000", binary.BigEndian.Uint32(data[offset:]))
+	}
+	return SideData{
+		SideDataType: "Mastering display metadata",
+		Fields: []SideDataField{
+			{"red_x", chroma(4)},
+			{"red_y", chroma(5)},
+			{"green_x", chroma(0)},
+			{"green_y", chroma(1)},
+			{"blue_x", chroma(2)},
+			{"blue_y", chroma(3)},
+			{"white_point_x", chroma(6)},
+			{"white_point_y", chroma(7)},
+			{"min_luminance", luminance(20)},
+			{"max_luminance", luminance(16)},
+		},
+	}, true
+}
+
+func (m *mp4Reader) readAudioSampleEntry(entry mp4Box, stream *Stream) error {
+	data, err := m.content(mp4Box{Type: entry.Type, Start: entry.Start, End: min(entry.End, entry.Start+28)}, 0)
+	if err != nil || len(data) < 28 {
+		return err
+	}
+	version := binary.BigEndian.Uint16(data[8:10])
+	stream.Channels = int(binary.BigEndian.Uint16(data[16:18]))
+	stream.SampleRate = strconv.Itoa(int(binary.BigEndian.Uint32(data[24:28]) >> 16))
+
+	// QuickTime sound descriptions are longer in later versions
+	skip := int64(28)
+	switch version {
+	case 1:
+		skip += 16
+	case 2:
+		skip += 36
+		extended, err := m.content(mp4Box{Type: entry.Type, Start: entry.Start, End: min(entry.End, entry.Start+skip)}, 0)
+		if err != nil || len(extended) < 48 {
+			return err
+		}
+		rate := math.Float64frombits(binary.BigEndian.Uint64(extended[32:40]))
+		stream.SampleRate = strconv.Itoa(int(rate))
+		stream.Channels = int(binary.BigEndian.Uint32(extended[40:44]))
+	}
+
+	return m.eachChild(entry, skip, func(box mp4Box) error {
+		data, err := m.content(box, 0)
+		if err != nil {
+			return err
+		}
+		switch box.Type {
+		case "esds":
+			m.applyESDescriptor(stream, data)
+		case "dac3":
+			if len(data) >= 3 {
+				acmod := data[1] >> 3 & 7
+				lfe := int(data[1] >> 2 & 1)
+				stream.Channels = AC3_CHANNELS[acmod] + lfe
+			}
+		case "dec3":
+			if len(data) >= 5 {
+				acmod := data[3] >> 1 & 7
+				lfe := int(data[3] & 1)
+				stream.Channels = AC3_CHANNELS[acmod] + lfe
+			}
+		case "dOps":
+			if len(data) >= 4 {
+				stream.Channels = int(data[1])
+				stream.InitialPadding = int(binary.BigEndian.Uint16(data[2:4]))
+				stream.SampleRate = "48000"
+			}
+		case "dfLa", "alac":
+			stream.ExtradataSize = len(data)
+		}
+		return nil
+	})
+}
+
+// Apply an ES_Descriptor: the codec it names and its decoder configuration
+func (m *mp4Reader) applyESDescriptor(stream *Stream, data []byte) {
+	if len(data) < 4 {
+		return
+	}
+	rest := data[4:] // version and flags
+	for len(rest) > 0 {
+		tag := rest[0]
+		length, n := mp4DescriptorLength(rest[1:])
+		body := rest[1+n:]
+		if length > len(body) {
+			length = len(body)
+		}
+		switch tag {
+		case 0x03: // ES_Descriptor
+			if length < 3 {
+				return
+			}
+			flags := body[2]
+			skip := 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && skip < length {
+				skip += 1 + int(body[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if skip > length {
+				return
+			}
+			rest = body[skip:length]
+			continue
+		case 0x04: // DecoderConfigDescriptor
+			if length < 13 {
+				return
+			}
+			if name, known := MP4_OBJECT_TYPES[body[0]]; known {
+				stream.CodecName = name
+			}
+			rest = body[13:length]
+			continue
+		case 0x05: // DecoderSpecificInfo
+			config := body[:length]
+			applyCodecConfig(stream, config)
+			if stream.CodecName == "aac" && len(config) >= 2 {
+				if channels := int(config[1] >> 3 & 0xf); channels > 0 && channels < 7 {
+					stream.Channels = channels
+				} else if channels == 7 {
+					stream.Channels = 8
+				}
+			}
+		}
+		rest = body[length:]
+	}
+}
+
+// Length of a descriptor, in up to four bytes of seven bits
+func mp4DescriptorLength(data []byte) (int, int) {
+	length := 0
+	for i := 0; i < 4 && i < len(data); i++ {
+		length = length<<7 | int(data[i]&0x7f)
+		if data[i]&0x80 == 0 {
+			return length, i + 1
+		}
+	}
+	return length, min(4, len(data))
+}
+
+// Read the iTunes metadata of a movie into format tags
+func (m *mp4Reader) readUserData(udta mp4Box, tags map[string]string) error {
+	return m.eachChild(udta, 0, func(box mp4Box) error {
+		if box.Type != "meta" {
+			return nil
+		}
+		// meta is a full box in MP4, but not in QuickTime
+		skip := int64(4)
+		if child, err := m.box(box.Start, box.End); err == nil && child.Type == "hdlr" {
+			skip = 0
+		}
+		return m.eachChild(box, skip, func(box mp4Box) error {
+			if box.Type != "ilst" {
+				return nil
+			}
+			return m.eachChild(box, 0, func(item mp4Box) error {
+				key, known := MP4_METADATA_TAGS[item.Type]
+				if !known {
+					return nil
+				}
+				return m.eachChild(item, 0, func(box mp4Box) error {
+					if box.Type != "data" {
+						return nil
+					}
+					data, err := m.content(box, 8)
+					if err == nil {
+						tags[key] = string(data)
+					}
+					return err
+				})
+			})
+		})
+	})
+}
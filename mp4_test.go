@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// An MP4 box holding its content, or its children one after another
+func newMP4Box(boxType string, content ...interface{}) []byte {
+	data := mp4Fields(content...)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	return append(append(box, boxType...), data...)
+}
+
+// Fields of a box one after another: uint16 and uint32 values big-endian,
+// strings and byte slices as they are
+func mp4Fields(fields ...interface{}) []byte {
+	var out []byte
+	for _, field := range fields {
+		switch value := field.(type) {
+		case uint16:
+			out = binary.BigEndian.AppendUint16(out, value)
+		case uint32:
+			out = binary.BigEndian.AppendUint32(out, value)
+		case string:
+			out = append(out, value...)
+		case []byte:
+			out = append(out, value...)
+		}
+	}
+	return out
+}
+
+// A track of an MP4 fixture
+func mp4Track(id uint32, handler string, timescale, duration uint32, language uint16, entry []byte, stts, stsz []byte) []byte {
+	return newMP4Box("trak",
+		newMP4Box("tkhd", mp4Fields(uint32(3), uint32(0), uint32(0), id, make([]byte, 68))),
+		newMP4Box("mdia",
+			newMP4Box("mdhd", mp4Fields(uint32(0), uint32(0), uint32(0), timescale, duration, language, uint16(0))),
+			newMP4Box("hdlr", mp4Fields(uint32(0), uint32(0), handler, make([]byte, 12), "Handler\x00")),
+			newMP4Box("minf", newMP4Box("stbl",
+				newMP4Box("stsd", mp4Fields(uint32(0), uint32(1)), entry),
+				newMP4Box("stts", stts),
+				newMP4Box("stsz", stsz),
+			)),
+		),
+	)
+}
+
+// An MP4 file with an H.264 video, an AAC audio and a timecode track, and
+// iTunes metadata, whose moov box follows padding in its mdat box
+func mp4FixtureWith(padding []byte) []byte {
+	avcConfig := []byte{1, 100, 0, 40, 0xff, 0xe0, 0}
+	video := newMP4Box("avc1",
+		make([]byte, 24), mp4Fields(uint16(1920), uint16(1080)), make([]byte, 14),
+		[]byte{8}, "x264 enc", make([]byte, 23), mp4Fields(uint16(24), uint16(0xffff)),
+		newMP4Box("avcC", avcConfig),
+		newMP4Box("pasp", mp4Fields(uint32(1), uint32(1))),
+		newMP4Box("colr", "nclx", mp4Fields(uint16(1), uint16(1), uint16(1)), []byte{0}),
+	)
+	// ES_Descriptor holding a DecoderConfigDescriptor for AAC with an LC
+	// stereo AudioSpecificConfig
+	esds := mp4Fields(uint32(0), []byte{0x03, 22, 0, 1, 0, 0x04, 17, 0x40, 0x15}, make([]byte, 11), []byte{0x05, 2, 0x12, 0x10})
+	audio := newMP4Box("mp4a",
+		make([]byte, 16), mp4Fields(uint16(6), uint16(16), uint32(0), uint32(48000<<16)),
+		newMP4Box("esds", esds),
+	)
+	moov := newMP4Box("moov",
+		newMP4Box("mvhd", mp4Fields(uint32(0), uint32(0), uint32(0), uint32(1000), uint32(41708), make([]byte, 80))),
+		// 1000 frames of 1001/24000 s, 5000 bytes each
+		mp4Track(1, "vide", 24000, 1001000, 0x15c7, video,
+			mp4Fields(uint32(0), uint32(1), uint32(1000), uint32(1001)),
+			mp4Fields(uint32(0), uint32(5000), uint32(1000))),
+		mp4Track(2, "soun", 48000, 2002000, 0x1cb2, audio,
+			mp4Fields(uint32(0), uint32(1), uint32(2), uint32(1024)),
+			mp4Fields(uint32(0), uint32(0), uint32(2), uint32(100), uint32(200))),
+		mp4Track(3, "tmcd", 24000, 1001000, 0x55c4, newMP4Box("tmcd", make([]byte, 8)), nil, nil),
+		newMP4Box("udta", newMP4Box("meta", mp4Fields(uint32(0)),
+			newMP4Box("ilst", newMP4Box("\xa9nam", newMP4Box("data", mp4Fields(uint32(1), uint32(0)), "A Movie"))),
+		)),
+	)
+	return bytes.Join([][]byte{
+		newMP4Box("ftyp", "isom", mp4Fields(uint32(512)), "isomiso2avc1mp41"),
+		newMP4Box("free"),
+		newMP4Box("mdat", padding),
+		moov,
+	}, nil)
+}
+
+func TestProbeMP4(t *testing.T) {
+	response, err := probeBytes(probeMP4, mp4FixtureWith(nil), int64(NATIVE_PROBE_BUDGET))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	format := response.Format
+	if format.Duration != "41.708000" || format.Tags["major_brand"] != "isom" || format.Tags["minor_version"] != "512" ||
+		format.Tags["compatible_brands"] != "isomiso2avc1mp41" || format.Tags["title"] != "A Movie" {
+		t.Errorf("format %+v", format)
+	}
+
+	if len(response.Streams) != 2 {
+		t.Fatalf("%d streams, want 2 without the timecode track", len(response.Streams))
+	}
+	video, audio := response.Streams[0], response.Streams[1]
+	tests := []struct {
+		field, got, want string
+	}{
+		{"video codec", video.CodecName, "h264"},
+		{"video tag", video.CodecTagString, "avc1"},
+		{"video profile", video.Profile, "High"},
+		{"video pixel format", video.PixFmt, "yuv420p"},
+		{"video frame rate", video.RFrameRate, "24000/1001"},
+		{"video average frame rate", video.AvgFrameRate, "24000/1001"},
+		{"video frames", video.NbFrames, "1000"},
+		{"video duration", video.Duration, "41.708333"},
+		{"video bit rate", video.BitRate, "959040"},
+		{"video aspect ratio", video.DisplayAspectRatio, "16:9"},
+		{"video colors", video.ColorPrimaries + " " + video.ColorTransfer + " " + video.ColorSpace + " " + video.ColorRange, "bt709 bt709 bt709 tv"},
+		{"video language", video.Tags["language"], "eng"},
+		{"video encoder", video.Tags["encoder"], "x264 enc"},
+		{"video handler", video.Tags["handler_name"], "Handler"},
+		{"video ID", video.ID, "0x1"},
+		{"audio codec", audio.CodecName, "aac"},
+		{"audio profile", audio.Profile, "LC"},
+		{"audio sample rate", audio.SampleRate, "48000"},
+		{"audio channel layout", audio.ChannelLayout, "stereo"},
+		{"audio time base", audio.TimeBase, "1/48000"},
+		{"audio bit rate", audio.BitRate, "57"},
+		{"audio language", audio.Tags["language"], "ger"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s is %q, want %q", test.field, test.got, test.want)
+		}
+	}
+	if video.Width != 1920 || video.Height != 1080 || video.Level != 40 {
+		t.Errorf("video is %dx%d at level %d", video.Width, video.Height, video.Level)
+	}
+	if audio.Channels != 2 {
+		t.Errorf("audio has %d channels, want those of its configuration", audio.Channels)
+	}
+	for _, stream := range response.Streams {
+		if stream.Disposition["default"] != 1 {
+			t.Errorf("enabled stream %d is not default", stream.Index)
+		}
+	}
+}
+
+func TestProbeMP4Budget(t *testing.T) {
+	// The media data before the moov box is skipped, not read
+	data := mp4FixtureWith(make([]byte, 8*nativeChunkSize))
+	r := newBudgetReader(bytes.NewReader(data), int64(len(data)), 3*nativeChunkSize)
+	if _, err := probeMP4(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.used > 2*nativeChunkSize {
+		t.Errorf("read %d bytes, want the chunks at the start and the end only", r.used)
+	}
+	if _, err := probeBytes(probeMP4, data, nativeChunkSize); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("moov beyond the budget gave %v, want %v", err, errBudgetExceeded)
+	}
+}
+
+func TestProbeMP4Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"not MP4", []byte("\x1aE\xdf\xa3 a matroska file"), errNotThisFormat},
+		{"short", []byte{0, 0, 0}, errNotThisFormat},
+		{"no moov", newMP4Box("ftyp", "isom", mp4Fields(uint32(0))), nil},
+		{"box past the end", append(newMP4Box("ftyp", "isom", mp4Fields(uint32(0))), mp4Fields(uint32(100), "moov")...), nil},
+		{"truncated", mp4FixtureWith(nil)[:300], nil},
+	}
+	for _, test := range tests {
+		_, err := probeBytes(probeMP4, test.data, int64(NATIVE_PROBE_BUDGET))
+		if err == nil || test.want != nil && err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestMP4Language(t *testing.T) {
+	tests := map[uint16]string{0x15c7: "eng", 0x1cb2: "ger", 0x55c4: "und", 0: "", 0x7fff: ""}
+	for packed, want := range tests {
+		if got := mp4Language(packed); got != want {
+			t.Errorf("mp4Language(%#x) = %q, want %q", packed, got, want)
+		}
+	}
+}
+
+func FuzzProbeMP4(f *testing.F) {
+	fuzzReader(f, probeMP4, mp4FixtureWith(nil), mp4FixtureWith(make([]byte, 64)))
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// Codec types and names by PMT stream_type, including the Blu-ray (HDMV) and
+// ATSC private types
+var TS_STREAM_TYPES = map[byte][2]string{
+	0x01: {"video", "mpeg1video"},
+	0x02: {"video", "mpeg2video"},
+	0x03: {"audio", "mp2"},
+	0x04: {"audio", "mp2"},
+	0x0f: {"audio", "aac"},
+	0x10: {"video", "mpeg4"},
+	0x11: {"audio", "aac_latm"},
+	0x1b: {"video", "h264"},
+	0x24: {"video", "hevc"},
+	0x80: {"audio", "pcm_bluray"},
+	0x81: {"audio", "ac3"},
+	0x82: {"audio", "dts"},
+	0x83: {"audio", "truehd"},
+	0x84: {"audio", "eac3"},
+	0x85: {"audio", "dts"},
+	0x86: {"audio", "dts"},
+	0x87: {"audio", "eac3"},
+	0x90: {"subtitle", "hdmv_pgs_subtitle"},
+	0x92: {"subtitle", "hdmv_text_subtitle"},
+	0xa1: {"audio", "eac3"},
+	0xa2: {"audio", "dts"},
+	0xea: {"video", "vc1"},
+}
+
+// Profiles of the DTS-HD stream types
+var TS_DTS_PROFILES = map[byte]string{
+	0x85: "DTS-HD HRA",
+	0x86: "DTS-HD MA",
+}
+
+// Codecs by the format identifier of a registration descriptor
+var TS_REGISTRATION_CODECS = map[string][2]string{
+	"AC-3": {"audio", "ac3"},
+	"EAC3": {"audio", "eac3"},
+	"DTS1": {"audio", "dts"},
+	"DTS2": {"audio", "dts"},
+	"DTS3": {"audio", "dts"},
+	"Opus": {"audio", "opus"},
+	"HEVC": {"video", "hevc"},
+	"VC-1": {"video", "vc1"},
+}
+
+// Codecs of private data streams (stream_type 0x06) by DVB descriptor tag
+var TS_DESCRIPTOR_CODECS = map[byte][2]string{
+	0x56: {"subtitle", "dvb_teletext"},
+	0x59: {"subtitle", "dvb_subtitle"},
+	0x6a: {"audio", "ac3"},
+	0x7a: {"audio", "eac3"},
+	0x7b: {"audio", "dts"},
+}
+
+// Dispositions by the audio_type of an ISO 639 language descriptor
+var TS_AUDIO_TYPES = map[byte]string{
+	1: "clean_effects",
+	2: "hearing_impaired",
+	3: "visual_impaired",
+}
+
+// Timestamps of a transport stream wrap around at 33 bits
+const tsTimestampWrap = 1 << 33
+
+// Bytes of each PES packet kept to find the codec header of its stream
+const tsHeaderBytes = 4096
+
+// Bytes at the end of a file searched for the last timestamps of its streams
+const tsTailBytes = 2 * nativeChunkSize
+
+// Decode timestamps of a video stream used to work out its frame rate
+const tsRateSamples = 16
+
+// tsReader reads the program tables and stream headers of a transport stream
+type tsReader struct {
+	r          *budgetReader
+	packetSize int64
+	syncOffset int64
+	sections   map[int][]byte
+	programs   []*tsProgram
+	pmtPIDs    map[int]bool
+	streams    []*tsStream
+	pids       map[int]*tsStream
+	services   map[int]map[string]string
+	patDone    bool
+}
+
+type tsProgram struct {
+	Number  int
+	PmtPID  int
+	PcrPID  int
+	Streams []*tsStream
+	parsed  bool
+}
+
+type tsStream struct {
+	Stream
+	pid        int
+	streamType byte
+	firstPTS   int64
+	lastPTS    int64
+	tailPTS    []int64
+	dts        []int64
+	pes        []byte
+	headerDone bool
+}
+
+// Read the stream information of an MPEG transport stream, with 188-byte
+// packets or the 192-byte ones of Blu-ray M2TS files: the programs from the
+// PAT and PMTs, the codec parameters from the first headers of each elementary
+// stream, and the duration from the timestamps at its start and end
+func probeMPEGTS(r *budgetReader) (*FFProbeResponse, error) {
+	m := &tsReader{
+		r:        r,
+		sections: map[int][]byte{},
+		pmtPIDs:  map[int]bool{},
+		pids:     map[int]*tsStream{},
+		services: map[int]map[string]string{},
+	}
+	if err := m.sync(); err != nil {
+		return nil, err
+	}
+
+	offset, err := m.scan(0, r.size, false, m.tablesDone)
+	if err != nil {
+		return nil, err
+	}
+	if !m.tablesDone() {
+		return nil, fmt.Errorf("no program map table found")
+	}
+
+	// The last timestamps come first, so that the budget left after them goes
+	// to finding codec headers
+	tail := max(offset, r.size-tsTailBytes)
+	tail -= tail % m.packetSize
+	if _, err := m.scan(tail, r.size, true, func() bool { return false }); err != nil && err != errBudgetExceeded {
+		return nil, err
+	}
+	if _, err := m.scan(offset, tail, false, m.headersDone); err != nil && err != errBudgetExceeded {
+		return nil, err
+	}
+	for _, s := range m.streams {
+		if !s.headerDone && len(s.pes) > 0 {
+			s.readHeader()
+		}
+		for _, pts := range s.tailPTS {
+			s.seeTimestamp(pts)
+		}
+	}
+	return m.response(), nil
+}
+
+// Find the packet size from the sync bytes at the start of the file
+func (m *tsReader) sync() error {
+	head := make([]byte, 5*192)
+	n, err := m.r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+	for _, layout := range []struct{ size, offset int64 }{{188, 0}, {192, 4}} {
+		packets := int64(0)
+		for pos := layout.offset; pos < int64(len(head)) && head[pos] == 0x47; pos += layout.size {
+			packets++
+		}
+		if packets >= min(5, int64(len(head))/layout.size) && packets >= 2 {
+			m.packetSize, m.syncOffset = layout.size, layout.offset
+			return nil
+		}
+	}
+	return errNotThisFormat
+}
+
+// Read the packets between two offsets until done returns true; returns the
+// offset reached. In the tail only the timestamps of known streams are read.
+func (m *tsReader) scan(start, end int64, tail bool, done func() bool) (int64, error) {
+	packet := make([]byte, m.packetSize)
+	offset := start
+	for ; offset+m.packetSize <= end && !done(); offset += m.packetSize {
+		if _, err := m.r.ReadAt(packet, offset); err != nil {
+			return offset, err
+		}
+		m.packet(packet[m.syncOffset:], tail)
+	}
+	return offset, nil
+}
+
+func (m *tsReader) tablesDone() bool {
+	if !m.patDone {
+		return false
+	}
+	for _, program := range m.programs {
+		if !program.parsed {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *tsReader) headersDone() bool {
+	for _, s := range m.streams {
+		if !s.headerDone {
+			return false
+		}
+		if s.CodecType == "video" && s.RFrameRate == "" && len(s.dts) < tsRateSamples {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *tsReader) packet(p []byte, tail bool) {
+	if len(p) < 4 || p[0] != 0x47 {
+		return
+	}
+	start := p[1]&0x40 != 0
+	pid := int(p[1]&0x1f)<<8 | int(p[2])
+	control := p[3] >> 4 & 3
+	payload := p[4:]
+	if control&2 != 0 {
+		if len(payload) == 0 || 1+int(payload[0]) > len(payload) {
+			return
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+	if control&1 == 0 {
+		return
+	}
+
+	s := m.pids[pid]
+	switch {
+	case tail:
+		if s != nil && start {
+			if _, pts, _, ok := pesHeader(payload); ok && pts >= 0 {
+				s.tailPTS = append(s.tailPTS, pts)
+			}
+		}
+	case s != nil:
+		s.packet(payload, start)
+	case pid == 0 || pid == 0x11 || m.pmtPIDs[pid]:
+		m.section(pid, payload, start)
+	}
+}
+
+// Collect the PSI section carried by a packet, and read it once complete
+func (m *tsReader) section(pid int, payload []byte, start bool) {
+	if start {
+		if len(payload) == 0 || 1+int(payload[0]) > len(payload) {
+			return
+		}
+		m.sections[pid] = append([]byte(nil), payload[1+int(payload[0]):]...)
+	} else if buf, found := m.sections[pid]; found {
+		m.sections[pid] = append(buf, payload...)
+	} else {
+		return
+	}
+
+	buf := m.sections[pid]
+	if len(buf) < 3 {
+		return
+	}
+	length := int(buf[1]&0x0f)<<8 | int(buf[2])
+	if len(buf) < 3+length {
+		return
+	}
+	delete(m.sections, pid)
+	if length < 9 {
+		return
+	}
+	m.table(pid, buf[:3+length])
+}
+
+func (m *tsReader) table(pid int, section []byte) {
+	tableID := section[0]
+	number := int(binary.BigEndian.Uint16(section[3:5]))
+	body := section[8 : len(section)-4] // without the CRC
+
+	switch {
+	case pid == 0 && tableID == 0x00 && !m.patDone:
+		for i := 0; i+4 <= len(body); i += 4 {
+			program := int(binary.BigEndian.Uint16(body[i:]))
+			pmtPID := int(binary.BigEndian.Uint16(body[i+2:]) & 0x1fff)
+			if program == 0 { // the network information table
+				continue
+			}
+			m.programs = append(m.programs, &tsProgram{Number: program, PmtPID: pmtPID})
+			m.pmtPIDs[pmtPID] = true
+		}
+		m.patDone = true
+	case pid == 0x11 && tableID == 0x42:
+		m.readSDT(section)
+	case tableID == 0x02:
+		for _, program := range m.programs {
+			if program.PmtPID == pid && program.Number == number && !program.parsed {
+				m.readPMT(program, body)
+			}
+		}
+	}
+}
+
+func (m *tsReader) readPMT(program *tsProgram, body []byte) {
+	if len(body) < 4 {
+		return
+	}
+	program.parsed = true
+	program.PcrPID = int(binary.BigEndian.Uint16(body) & 0x1fff)
+	infoLength := int(binary.BigEndian.Uint16(body[2:]) & 0xfff)
+	if 4+infoLength > len(body) {
+		return
+	}
+	for rest := body[4+infoLength:]; len(rest) >= 5; {
+		streamType := rest[0]
+		pid := int(binary.BigEndian.Uint16(rest[1:]) & 0x1fff)
+		length := int(binary.BigEndian.Uint16(rest[3:]) & 0xfff)
+		if 5+length > len(rest) {
+			return
+		}
+		s := m.pids[pid]
+		if s == nil {
+			s = newTSStream(streamType, pid, rest[5:5+length])
+			if s != nil {
+				m.streams = append(m.streams, s)
+				m.pids[pid] = s
+			}
+		}
+		if s != nil {
+			program.Streams = append(program.Streams, s)
+		}
+		rest = rest[5+length:]
+	}
+}
+
+// Read the service names of a DVB service description table
+func (m *tsReader) readSDT(section []byte) {
+	if len(section) < 15 {
+		return
+	}
+	for rest := section[11 : len(section)-4]; len(rest) >= 5; {
+		service := int(binary.BigEndian.Uint16(rest))
+		length := int(binary.BigEndian.Uint16(rest[3:]) & 0xfff)
+		if 5+length > len(rest) {
+			return
+		}
+		eachDescriptor(rest[5:5+length], func(tag byte, data []byte) {
+			if tag != 0x48 || len(data) < 2 {
+				return
+			}
+			providerEnd := 2 + int(data[1])
+			if providerEnd >= len(data) || providerEnd+1+int(data[providerEnd]) > len(data) {
+				return
+			}
+			m.services[service] = map[string]string{
+				"service_provider": dvbText(data[2:providerEnd]),
+				"service_name":     dvbText(data[providerEnd+1 : providerEnd+1+int(data[providerEnd])]),
+			}
+		})
+		rest = rest[5+length:]
+	}
+}
+
+// Text of a DVB string, without its character table selector; text that is
+// not UTF-8 is read as Latin-1
+func dvbText(data []byte) string {
+	if len(data) > 0 && data[0] < 0x20 {
+		if data[0] == 0x10 && len(data) >= 3 {
+			data = data[3:]
+		} else {
+			data = data[1:]
+		}
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, c := range data {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// Call fn for each descriptor of a descriptor loop
+func eachDescriptor(data []byte, fn func(tag byte, data []byte)) {
+	for len(data) >= 2 {
+		length := int(data[1])
+		if 2+length > len(data) {
+			return
+		}
+		fn(data[0], data[2:2+length])
+		data = data[2+length:]
+	}
+}
+
+// A stream as a PMT describes it; nil for streams ffprobe would not list
+func newTSStream(streamType byte, pid int, descriptors []byte) *tsStream {
+	codec, known := TS_STREAM_TYPES[streamType]
+	tag := uint32(streamType)
+	s := &tsStream{
+		Stream: Stream{
+			ID:          fmt.Sprintf("0x%x", pid),
+			TimeBase:    "1/90000",
+			Tags:        map[string]string{},
+			Disposition: newDisposition(),
+		},
+		pid:        pid,
+		streamType: streamType,
+		firstPTS:   -1,
+		lastPTS:    -1,
+	}
+
+	eachDescriptor(descriptors, func(descriptor byte, data []byte) {
+		switch descriptor {
+		case 0x05: // registration
+			if len(data) >= 4 {
+				tag = binary.LittleEndian.Uint32(data)
+				if named, found := TS_REGISTRATION_CODECS[string(data[:4])]; found && (!known || streamType == 0x06) {
+					codec, known = named, true
+				}
+			}
+		case 0x0a: // ISO 639 language
+			if len(data) >= 4 {
+				setLanguageTag(s.Tags, data[:3])
+				if disposition, found := TS_AUDIO_TYPES[data[3]]; found {
+					s.Disposition[disposition] = 1
+				}
+			}
+		case 0x56, 0x59: // teletext, subtitling
+			if len(data) >= 4 {
+				setLanguageTag(s.Tags, data[:3])
+			}
+			if descriptor == 0x59 && len(data) >= 4 && data[3] >= 0x20 && data[3] <= 0x25 {
+				s.Disposition["hearing_impaired"] = 1
+			}
+		}
+		if named, found := TS_DESCRIPTOR_CODECS[descriptor]; found && streamType == 0x06 {
+			codec, known = named, true
+		}
+	})
+	if !known {
+		return nil
+	}
+
+	s.CodecType, s.CodecName = codec[0], codec[1]
+	s.CodecTag = fmt.Sprintf("0x%04x", tag)
+	s.CodecTagString = fourccString(tag)
+	if profile, found := TS_DTS_PROFILES[streamType]; found {
+		s.Profile = profile
+	}
+	switch s.CodecName {
+	case "h264", "hevc", "mpeg1video", "mpeg2video", "ac3", "eac3", "aac", "mp2", "dts", "pcm_bluray":
+	default:
+		// Nothing more to read for these
+		s.headerDone = true
+	}
+	return s
+}
+
+func setLanguageTag(tags map[string]string, code []byte) {
+	language := strings.ToLower(string(code))
+	for _, c := range language {
+		if c < 'a' || c > 'z' {
+			return
+		}
+	}
+	if language != "und" {
+		tags["language"] = language
+	}
+}
+
+// A codec tag as ffprobe prints it, with bytes that are not printable in
+// brackets, e.g. "[27][0][0][0]"
+func fourccString(tag uint32) string {
+	var out strings.Builder
+	for i := 0; i < 4; i++ {
+		c := byte(tag >> (8 * i))
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte(". -_", c) >= 0 {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(&out, "[%d]", c)
+		}
+	}
+	return out.String()
+}
+
+// Read a packet of the stream: the timestamps of the PES packets starting in
+// it, and the start of their payloads until the codec header is found
+func (s *tsStream) packet(payload []byte, start bool) {
+	if start {
+		if !s.headerDone && len(s.pes) > 0 {
+			s.readHeader()
+		}
+		s.pes = nil
+		headerLength, pts, dts, ok := pesHeader(payload)
+		if !ok {
+			return
+		}
+		if pts >= 0 {
+			s.seeTimestamp(pts)
+		}
+		if dts < 0 {
+			dts = pts
+		}
+		if s.CodecType == "video" && dts >= 0 && len(s.dts) < tsRateSamples {
+			s.dts = append(s.dts, dts)
+		}
+		payload = payload[headerLength:]
+		s.pes = []byte{}
+	}
+	if s.headerDone || s.pes == nil {
+		return
+	}
+	s.pes = append(s.pes, payload[:min(len(payload), tsHeaderBytes-len(s.pes))]...)
+	if len(s.pes) >= tsHeaderBytes {
+		s.readHeader()
+		s.pes = nil
+	}
+}
+
+func (s *tsStream) readHeader() {
+	if s.CodecType == "video" {
+		s.headerDone = parseVideoHeader(&s.Stream, s.pes)
+	} else {
+		s.headerDone = parseAudioHeader(&s.Stream, s.pes)
+	}
+}
+
+// Note a presentation timestamp of the stream; the last one is kept past the
+// 33-bit wrap, but not for frames that are only reordered before the first
+func (s *tsStream) seeTimestamp(pts int64) {
+	if s.firstPTS < 0 {
+		s.firstPTS, s.lastPTS = pts, pts
+		return
+	}
+	if pts < s.firstPTS-tsTimestampWrap/2 {
+		pts += tsTimestampWrap
+	}
+	s.lastPTS = max(s.lastPTS, pts)
+}
+
+// Length of a PES header, and its PTS and DTS, which are -1 when missing
+func pesHeader(payload []byte) (int, int64, int64, bool) {
+	if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return 0, -1, -1, false
+	}
+	switch payload[3] {
+	case 0xbc, 0xbe, 0xbf, 0xf0, 0xf1, 0xf2, 0xf8, 0xff:
+		// Streams without the optional header
+		return 6, -1, -1, true
+	}
+	length := 9 + int(payload[8])
+	if length > len(payload) {
+		return 0, -1, -1, false
+	}
+	pts, dts := int64(-1), int64(-1)
+	flags := payload[7] >> 6
+	if flags&2 != 0 && length >= 14 {
+		pts = pesTimestamp(payload[9:])
+	}
+	if flags == 3 && length >= 19 {
+		dts = pesTimestamp(payload[14:])
+	}
+	return length, pts, dts, true
+}
+
+func pesTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&7)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func (m *tsReader) response() *FFProbeResponse {
+	response := &FFProbeResponse{
+		Format: Format{
+			FormatName:     "mpegts",
+			FormatLongName: "MPEG-TS (MPEG-2 Transport Stream)",
+			NbPrograms:     len(m.programs),
+			ProbeScore:     50,
+		},
+	}
+
+	first, last := int64(-1), int64(-1)
+	for i, s := range m.streams {
+		s.Index = i
+		if s.CodecType == "video" {
+			if s.RFrameRate == "" && len(s.dts) > 1 {
+				ticks := float64(s.dts[len(s.dts)-1]-s.dts[0]) / float64(len(s.dts)-1)
+				s.RFrameRate = frameRateFromPeriod(int64(math.Round(ticks * 1e9 / 90000)))
+			}
+			setDefault(&s.AvgFrameRate, s.RFrameRate)
+			s.Refs = 1
+		}
+		if s.firstPTS >= 0 {
+			s.StartPts = s.firstPTS
+			s.StartTime = fmt.Sprintf("%.6f", float64(s.firstPTS)/90000)
+			if first < 0 || s.firstPTS < first {
+				first = s.firstPTS
+			}
+			if s.lastPTS > s.firstPTS {
+				s.DurationTS = s.lastPTS - s.firstPTS
+				s.Duration = fmt.Sprintf("%.6f", float64(s.DurationTS)/90000)
+				last = max(last, s.lastPTS)
+			}
+		}
+		finishNativeStream(&s.Stream)
+		response.Streams = append(response.Streams, s.Stream)
+	}
+	if first >= 0 {
+		response.Format.StartTime = fmt.Sprintf("%.6f", float64(first)/90000)
+		if last > first {
+			response.Format.Duration = fmt.Sprintf("%.6f", float64(last-first)/90000)
+		}
+	}
+
+	for _, program := range m.programs {
+		entry := Program{
+			ProgramID:  program.Number,
+			ProgramNum: program.Number,
+			NbStreams:  len(program.Streams),
+			PmtPid:     program.PmtPID,
+			PcrPid:     program.PcrPID,
+			Tags:       m.services[program.Number],
+			Streams:    []Stream{},
+		}
+		for _, s := range program.Streams {
+			entry.Streams = append(entry.Streams, s.Stream)
+		}
+		response.Programs = append(response.Programs, entry)
+	}
+	return response
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// The 188-byte packets carrying a payload, the last one filled up with
+// adaptation field stuffing
+func tsPackets(pid int, payload []byte) []byte {
+	var out []byte
+	for first := true; first || len(payload) > 0; first = false {
+		n := min(len(payload), 184)
+		header := []byte{0x47, byte(pid >> 8 & 0x1f), byte(pid), 0x10}
+		if first {
+			header[1] |= 0x40
+		}
+		if n < 184 {
+			header[3] = 0x30
+			header = append(header, byte(183-n))
+			if n < 183 {
+				header = append(append(header, 0), bytes.Repeat([]byte{0xff}, 182-n)...)
+			}
+		}
+		out = append(append(out, header...), payload[:n]...)
+		payload = payload[n:]
+	}
+	return out
+}
+
+// Null packets
+func tsNulls(count int) []byte {
+	null := append([]byte{0x47, 0x1f, 0xff, 0x10}, bytes.Repeat([]byte{0xff}, 184)...)
+	return bytes.Repeat(null, count)
+}
+
+// The packets of a PSI section, whose CRC is left zero
+func tsSection(pid int, tableID byte, number int, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xb0 | byte(length>>8), byte(length), byte(number >> 8), byte(number), 0xc1, 0, 0}
+	return tsPackets(pid, append(append(section, body...), 0, 0, 0, 0))
+}
+
+// The packets of a PES packet with a PTS, and a DTS unless it is negative
+func tsPES(pid int, streamID byte, pts, dts int64, data []byte) []byte {
+	timestamp := func(prefix byte, ts int64) []byte {
+		return []byte{prefix<<4 | byte(ts>>29&0x0e) | 1, byte(ts >> 22), byte(ts>>14) | 1, byte(ts >> 7), byte(ts<<1) | 1}
+	}
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5}
+	if dts < 0 {
+		header = append(header, timestamp(2, pts)...)
+	} else {
+		header[7], header[8] = 0xc0, 10
+		header = append(append(header, timestamp(3, pts)...), timestamp(1, dts)...)
+	}
+	return tsPackets(pid, append(header, data...))
+}
+
+// A transport stream with an H.264 video, a German AC-3 audio for the visually
+// impaired and a DVB subtitle for the hard of hearing in one program, whose
+// service an SDT names. Null packets between the first PES packets and the
+// last ones keep the stream headers out of the tail. M2TS packets get a
+// 4-byte prefix.
+func tsFixture(packetSize int, nulls int) []byte {
+	ac3Frame := []byte{0x0b, 0x77, 0, 0, 36, 0x40, 0xe1, 0}
+	service := []byte{0x48, 15, 0x01, 3, 'A', 'R', 'D', 9, 'D', 'a', 's', ' ', 'E', 'r', 's', 't', 'e'}
+	data := bytes.Join([][]byte{
+		tsSection(0, 0x00, 1, []byte{0, 0, 0xe0, 0x10, 0, 1, 0xf0, 0x00}),
+		tsSection(0x1000, 0x02, 1, []byte{
+			0xe1, 0x00, 0xf0, 0x00,
+			0x1b, 0xe1, 0x00, 0xf0, 0,
+			0x81, 0xe1, 0x01, 0xf0, 6, 0x0a, 4, 'g', 'e', 'r', 3,
+			0x06, 0xe1, 0x02, 0xf0, 10, 0x59, 8, 'e', 'n', 'g', 0x20, 0, 1, 0, 1,
+			0x05, 0xe1, 0x03, 0xf0, 0, // private sections, which ffprobe does not list
+		}),
+		tsSection(0x11, 0x42, 1, append([]byte{0, 1, 0xff, 0, 1, 0xfc, 0x80, byte(len(service))}, service...)),
+		tsPES(0x100, 0xe0, 126000, 122246, annexB([]byte{0x09, 0xf0}, h264SPS(), []byte{0x68, 0xce})),
+		tsPES(0x101, 0xbd, 126000, -1, ac3Frame),
+		tsPES(0x102, 0xbd, 126000, -1, []byte{0x20, 0x00}),
+		tsNulls(nulls),
+		tsPES(0x100, 0xe0, 5526000, 5522246, annexB([]byte{0x09, 0xf0})),
+		tsPES(0x101, 0xbd, 5527000, -1, ac3Frame),
+	}, nil)
+	if packetSize == 188 {
+		return data
+	}
+	var out []byte
+	for i := 0; i < len(data); i += 188 {
+		out = append(append(out, 0, 0, 0, 0), data[i:i+188]...)
+	}
+	return out
+}
+
+func TestProbeMPEGTS(t *testing.T) {
+	for _, packetSize := range []int{188, 192} {
+		response, err := probeBytes(probeMPEGTS, tsFixture(packetSize, 360), int64(NATIVE_PROBE_BUDGET))
+		if err != nil {
+			t.Fatalf("%d-byte packets: %v", packetSize, err)
+		}
+
+		format := response.Format
+		if format.FormatName != "mpegts" || format.NbPrograms != 1 || format.StartTime != "1.400000" || format.Duration != "60.011111" {
+			t.Errorf("%d-byte packets: format %+v", packetSize, format)
+		}
+		if len(response.Streams) != 3 {
+			t.Fatalf("%d-byte packets: %d streams, want 3 without the private sections", packetSize, len(response.Streams))
+		}
+		video, audio, subtitle := response.Streams[0], response.Streams[1], response.Streams[2]
+		tests := []struct {
+			field, got, want string
+		}{
+			{"video codec", video.CodecName, "h264"},
+			{"video tag", video.CodecTagString, "[27][0][0][0]"},
+			{"video profile", video.Profile, "High"},
+			{"video size", fmt.Sprintf("%dx%d", video.Width, video.Height), "1920x1080"},
+			{"video frame rate", video.RFrameRate, "24000/1001"},
+			{"video ID", video.ID, "0x100"},
+			{"video start", video.StartTime, "1.400000"},
+			{"video duration", video.Duration, "60.000000"},
+			{"video time base", video.TimeBase, "1/90000"},
+			{"audio codec", audio.CodecName, "ac3"},
+			{"audio sample rate", audio.SampleRate, "48000"},
+			{"audio channel layout", audio.ChannelLayout, "5.1(side)"},
+			{"audio bit rate", audio.BitRate, "640000"},
+			{"audio language", audio.Tags["language"], "ger"},
+			{"audio duration", audio.Duration, "60.011111"},
+			{"subtitle codec", subtitle.CodecName, "dvb_subtitle"},
+			{"subtitle language", subtitle.Tags["language"], "eng"},
+		}
+		for _, test := range tests {
+			if test.got != test.want {
+				t.Errorf("%d-byte packets: %s is %q, want %q", packetSize, test.field, test.got, test.want)
+			}
+		}
+		if audio.Disposition["visual_impaired"] != 1 || subtitle.Disposition["hearing_impaired"] != 1 {
+			t.Errorf("%d-byte packets: dispositions %v and %v", packetSize, audio.Disposition, subtitle.Disposition)
+		}
+
+		if len(response.Programs) != 1 {
+			t.Fatalf("%d-byte packets: programs %+v", packetSize, response.Programs)
+		}
+		program := response.Programs[0]
+		if program.ProgramID != 1 || program.PmtPid != 0x1000 || program.PcrPid != 0x100 || program.NbStreams != 3 ||
+			program.Tags["service_name"] != "Das Erste" || program.Tags["service_provider"] != "ARD" {
+			t.Errorf("%d-byte packets: program %+v", packetSize, program)
+		}
+	}
+}
+
+func TestProbeMPEGTSBudget(t *testing.T) {
+	// Timestamps at the end beyond the budget leave the duration out, but not
+	// the stream headers
+	data := tsFixture(188, 8*nativeChunkSize/188)
+	response, err := probeBytes(probeMPEGTS, data, nativeChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Format.Duration != "" || response.Streams[0].Width != 1920 || response.Streams[1].Channels != 6 {
+		t.Errorf("duration %q, video width %d, audio channels %d", response.Format.Duration,
+			response.Streams[0].Width, response.Streams[1].Channels)
+	}
+	if response, err := probeBytes(probeMPEGTS, data, int64(len(data))); err != nil || response.Format.Duration != "60.011111" {
+		t.Errorf("timestamps within the budget were not read: %v", err)
+	}
+
+	// Program tables beyond it fail the probe
+	data = append(tsNulls(2*nativeChunkSize/188), tsFixture(188, 0)...)
+	if _, err := probeBytes(probeMPEGTS, data, nativeChunkSize); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("tables beyond the budget gave %v, want %v", err, errBudgetExceeded)
+	}
+}
+
+func TestProbeMPEGTSErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"not a transport stream", bytes.Repeat([]byte("RIFF....AVI LIST"), 100), errNotThisFormat},
+		{"one packet", tsFixture(188, 0)[:188], errNotThisFormat},
+		{"no program map table", append(tsSection(0, 0x00, 1, []byte{0, 1, 0xf0, 0x00}), tsNulls(10)...), nil},
+	}
+	for _, test := range tests {
+		_, err := probeBytes(probeMPEGTS, test.data, int64(NATIVE_PROBE_BUDGET))
+		if err == nil || test.want != nil && err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestDVBText(t *testing.T) {
+	tests := map[string]string{
+		"Das Erste":               "Das Erste",
+		"\x05Das Erste":           "Das Erste",
+		"\x10\x00\x09Fran\xe7ais": "Français",
+		"M\xfcnchen":              "München",
+	}
+	for text, want := range tests {
+		if got := dvbText([]byte(text)); got != want {
+			t.Errorf("dvbText(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func FuzzProbeMPEGTS(f *testing.F) {
+	fuzzReader(f, probeMPEGTS, tsFixture(188, 0), tsFixture(192, 0))
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Whether to read stream information from the container headers of a file
+// before guessing from its name; set it to an empty value to disable
+var NATIVE_PROBE = envOrDefault("FFPROBE_SHIM_NATIVE_PROBE", "1") != ""
+
+// Bytes a native probe may read from a file, which may be on a remote mount
+var NATIVE_PROBE_BUDGET = envInt("FFPROBE_SHIM_NATIVE_BUDGET", 512*1024)
+
+// Files are read in chunks of this size, each counted in full against the budget
+const nativeChunkSize = 32 * 1024
+
+// Returned by a container reader for files that are not in its format
+var errNotThisFormat = errors.New("not in this format")
+
+// Returned when a native probe would need to read more than its budget
+var errBudgetExceeded = errors.New("read budget exceeded")
+
+// nativeReader reads the stream information of one container format
+type nativeReader struct {
+	Name  string
+	Probe func(r *budgetReader) (*FFProbeResponse, error)
+}
+
+// Container readers, tried in order
+var NATIVE_READERS = []nativeReader{
+	{"matroska", probeMatroska},
+	{"mp4", probeMP4},
+	{"mpegts", probeMPEGTS},
+	{"avi", probeAVI},
+}
+
+// Long names of the codecs the container readers know, as ffprobe prints them
+var CODEC_LONG_NAMES = map[string]string{
+	"h264":               "H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10",
+	"hevc":               "H.265 / HEVC (High Efficiency Video Coding)",
+	"av1":                "Alliance for Open Media AV1",
+	"vp8":                "On2 VP8",
+	"vp9":                "Google VP9",
+	"mpeg1video":         "MPEG-1 video",
+	"mpeg2video":         "MPEG-2 video",
+	"mpeg4":              "MPEG-4 part 2",
+	"msmpeg4v3":          "MPEG-4 part 2 Microsoft variant version 3",
+	"vc1":                "SMPTE VC-1",
+	"wmv3":               "Windows Media Video 9",
+	"rawvideo":           "raw video",
+	"theora":             "Theora",
+	"prores":             "Apple ProRes (iCodec Pro)",
+	"mjpeg":              "Motion JPEG",
+	"png":                "PNG (Portable Network Graphics) image",
+	"aac":                "AAC (Advanced Audio Coding)",
+	"aac_latm":           "AAC LATM (Advanced Audio Coding LATM syntax)",
+	"ac3":                "ATSC A/52A (AC-3)",
+	"eac3":               "ATSC A/52B (AC-3, E-AC-3)",
+	"dts":                "DCA (DTS Coherent Acoustics)",
+	"truehd":             "TrueHD",
+	"flac":               "FLAC (Free Lossless Audio Codec)",
+	"opus":               "Opus (Opus Interactive Audio Codec)",
+	"vorbis":             "Vorbis",
+	"mp2":                "MP2 (MPEG audio layer 2)",
+	"mp3":                "MP3 (MPEG audio layer 3)",
+	"alac":               "ALAC (Apple Lossless Audio Codec)",
+	"wmav2":              "Windows Media Audio 2",
+	"wmapro":             "Windows Media Audio 9 Professional",
+	"pcm_u8":             "PCM unsigned 8-bit",
+	"pcm_s16le":          "PCM signed 16-bit little-endian",
+	"pcm_s16be":          "PCM signed 16-bit big-endian",
+	"pcm_s24le":          "PCM signed 24-bit little-endian",
+	"pcm_s24be":          "PCM signed 24-bit big-endian",
+	"pcm_s32le":          "PCM signed 32-bit little-endian",
+	"pcm_s32be":          "PCM signed 32-bit big-endian",
+	"pcm_f32le":          "PCM 32-bit floating point little-endian",
+	"pcm_f32be":          "PCM 32-bit floating point big-endian",
+	"pcm_bluray":         "PCM signed 16|20|24-bit big-endian for Blu-ray media",
+	"pcm_f64le":          "PCM 64-bit floating point little-endian",
+	"subrip":             "SubRip subtitle",
+	"ass":                "ASS (Advanced SSA) subtitle",
+	"webvtt":             "WebVTT subtitle",
+	"mov_text":           "MOV text",
+	"hdmv_pgs_subtitle":  "HDMV Presentation Graphic Stream subtitles",
+	"hdmv_text_subtitle": "HDMV Text subtitle",
+	"dvd_subtitle":       "DVD subtitles",
+	"dvb_subtitle":       "DVB subtitles",
+	"dvb_teletext":       "DVB teletext",
+	"eia_608":            "EIA-608 closed captions",
+	"ttf":                "TrueType font",
+	"otf":                "OpenType font",
+}
+
+// Sample formats ffmpeg's decoders output, for audio codecs where it does not
+// depend on the stream
+var CODEC_SAMPLE_FORMATS = map[string]string{
+	"aac":    "fltp",
+	"ac3":    "fltp",
+	"eac3":   "fltp",
+	"dts":    "fltp",
+	"opus":   "fltp",
+	"vorbis": "fltp",
+	"mp2":    "fltp",
+	"mp3":    "fltp",
+	"truehd": "s32",
+}
+
+// Color properties as numbered by ITU-T H.273, which containers and codecs share
+var (
+	COLOR_PRIMARIES = map[uint64]string{
+		1: "bt709", 4: "bt470m", 5: "bt470bg", 6: "smpte170m", 7: "smpte240m",
+		8: "film", 9: "bt2020", 10: "smpte428", 11: "smpte431", 12: "smpte432",
+	}
+	COLOR_TRANSFERS = map[uint64]string{
+		1: "bt709", 4: "gamma22", 5: "gamma28", 6: "smpte170m", 7: "smpte240m",
+		8: "linear", 13: "iec61966-2-1", 14: "bt2020-10", 15: "bt2020-12",
+		16: "smpte2084", 17: "smpte428", 18: "arib-std-b67",
+	}
+	COLOR_SPACES = map[uint64]string{
+		0: "gbr", 1: "bt709", 4: "fcc", 5: "bt470bg", 6: "smpte170m",
+		7: "smpte240m", 8: "ycgco", 9: "bt2020nc", 10: "bt2020c", 14: "ictcp",
+	}
+)
+
+// Frame rates as ffprobe prints them, matched against the frame duration of a stream
+var COMMON_FRAME_RATES = []struct{ Num, Den int64 }{
+	{24000, 1001}, {24, 1}, {25, 1}, {30000, 1001}, {30, 1}, {48, 1},
+	{50, 1}, {60000, 1001}, {60, 1}, {100, 1}, {120000, 1001}, {120, 1},
+}
+
+// Read the stream information of a file from its container headers, reading
+// no more than NATIVE_PROBE_BUDGET bytes of it. errNotThisFormat means that
+// no reader knows the container.
+func nativeProbe(path string, info os.FileInfo) (response *FFProbeResponse, err error) {
+	// A file no reader expected must not take the probe down with it
+	defer func() {
+		if r := recover(); r != nil {
+			response, err = nil, fmt.Errorf("native reader failed: %v", r)
+		}
+	}()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	for _, reader := range NATIVE_READERS {
+		r := newBudgetReader(file, info.Size(), int64(NATIVE_PROBE_BUDGET))
+		response, err := reader.Probe(r)
+		if err == errNotThisFormat {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", reader.Name, err)
+		}
+		log.Printf("Read %s headers of %s natively (%d bytes)", reader.Name, path, r.used)
+
+		response.Format.Filename = path
+		response.Format.Size = strconv.FormatInt(info.Size(), 10)
+		response.Format.NbStreams = len(response.Streams)
+		if duration, err := strconv.ParseFloat(response.Format.Duration, 64); err == nil && duration > 0 {
+			response.Format.BitRate = strconv.FormatInt(int64(float64(info.Size())*8/duration), 10)
+		}
+		return response, nil
+	}
+	return nil, errNotThisFormat
+}
+
+// Answer from a native probe, caching the result; false if the file could
+// not be read natively
+func serveNativeProbe(path string, info os.FileInfo) (*FFProbeResponse, bool) {
+	if !NATIVE_PROBE {
+		return nil, false
+	}
+	response, err := nativeProbe(path, info)
+	if err == errNotThisFormat {
+		return nil, false
+	} else if err != nil {
+		log.Printf("Cannot read %s natively: %v", path, err)
+		return nil, false
+	}
+
+	if data, err := json.Marshal(response); err != nil {
+		log.Printf("Error encoding native response for %s: %v", path, err)
+	} else if err := storeCachedResponse(path, info, data, cacheSourceNative); err != nil {
+		log.Printf("Error caching native response for %s: %v", path, err)
+	}
+	return response, true
+}
+
+// budgetReader reads a file in cached chunks, up to a budget
+type budgetReader struct {
+	file   io.ReaderAt
+	size   int64
+	budget int64
+	used   int64
+	chunks map[int64][]byte
+}
+
+func newBudgetReader(file io.ReaderAt, size, budget int64) *budgetReader {
+	return &budgetReader{file: file, size: size, budget: budget, chunks: map[int64][]byte{}}
+}
+
+func (b *budgetReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= b.size {
+			return n, io.EOF
+		}
+		base := pos - pos%nativeChunkSize
+		chunk, err := b.chunk(base)
+		if err != nil {
+			return n, err
+		}
+		if pos-base >= int64(len(chunk)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], chunk[pos-base:])
+	}
+	return n, nil
+}
+
+func (b *budgetReader) chunk(base int64) ([]byte, error) {
+	if chunk, cached := b.chunks[base]; cached {
+		return chunk, nil
+	}
+	length := min(nativeChunkSize, b.size-base)
+	if b.used+length > b.budget {
+		return nil, errBudgetExceeded
+	}
+	b.used += length
+
+	chunk := make([]byte, length)
+	n, err := b.file.ReadAt(chunk, base)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	b.chunks[base] = chunk[:n]
+	return chunk[:n], nil
+}
+
+// Disposition with every flag ffprobe prints cleared
+func newDisposition() map[string]int {
+	disposition := make(map[string]int, len(DISPOSITION_ORDER))
+	for _, key := range DISPOSITION_ORDER {
+		disposition[key] = 0
+	}
+	return disposition
+}
+
+// A ratio in lowest terms, e.g. "16:9"
+func reducedRatio(num, den int64) string {
+	if num <= 0 || den <= 0 {
+		return "0:1"
+	}
+	g := gcd(num, den)
+	return fmt.Sprintf("%d:%d", num/g, den/g)
+}
+
+// A fraction in lowest terms, e.g. "1001/24000"
+func reducedFraction(num, den int64) string {
+	if num <= 0 || den <= 0 {
+		return "0/0"
+	}
+	g := gcd(num, den)
+	return fmt.Sprintf("%d/%d", num/g, den/g)
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Frame rate of a stream from the duration of one frame in nanoseconds, as a
+// common rate where it is one, e.g. "24000/1001"
+func frameRateFromPeriod(nanoseconds int64) string {
+	if nanoseconds <= 0 {
+		return "0/0"
+	}
+	for _, rate := range COMMON_FRAME_RATES {
+		period := 1e9 * float64(rate.Den) / float64(rate.Num)
+		if diff := float64(nanoseconds) - period; diff > -1000 && diff < 1000 {
+			return fmt.Sprintf("%d/%d", rate.Num, rate.Den)
+		}
+	}
+	g := gcd(1e9, nanoseconds)
+	return fmt.Sprintf("%d/%d", 1e9/g, nanoseconds/g)
+}
+
+// Channel layout ffprobe reports for a number of channels
+func channelLayoutFor(codecName string, channels int) string {
+	switch channels {
+	case 1:
+		return "mono"
+	case 2:
+		return "stereo"
+	case 3:
+		return "2.1"
+	case 4:
+		return "quad"
+	case 5:
+		return "5.0(side)"
+	case 6:
+		if codecName == "aac" || codecName == "opus" || codecName == "vorbis" || codecName == "flac" {
+			return "5.1"
+		}
+		return "5.1(side)"
+	case 7:
+		return "6.1"
+	case 8:
+		return "7.1"
+	}
+	return ""
+}
+
+// Fill in what ffprobe prints for every stream of a codec type
+func finishNativeStream(stream *Stream) {
+	stream.CodecLongName = CODEC_LONG_NAMES[stream.CodecName]
+	if stream.CodecTagString == "" {
+		stream.CodecTagString = "[0][0][0][0]"
+		stream.CodecTag = "0x0000"
+	}
+	if stream.CodecType == "audio" {
+		setDefault(&stream.SampleFmt, CODEC_SAMPLE_FORMATS[stream.CodecName])
+		setDefault(&stream.ChannelLayout, channelLayoutFor(stream.CodecName, stream.Channels))
+	}
+	if stream.CodecType != "video" {
+		setDefault(&stream.RFrameRate, "0/0")
+		setDefault(&stream.AvgFrameRate, "0/0")
+	}
+	setDefault(&stream.StartTime, "0.000000")
+	if stream.Disposition == nil {
+		stream.Disposition = newDisposition()
+	}
+}
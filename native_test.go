@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// Run a container reader over a file held in memory
+func probeBytes(probe func(r *budgetReader) (*FFProbeResponse, error), data []byte, budget int64) (*FFProbeResponse, error) {
+	return probe(newBudgetReader(bytes.NewReader(data), int64(len(data)), budget))
+}
+
+// Fuzz a container reader: whatever the input, it must return rather than
+// panic, and never read past its budget
+func fuzzReader(f *testing.F, probe func(r *budgetReader) (*FFProbeResponse, error), seeds ...[]byte) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := newBudgetReader(bytes.NewReader(data), int64(len(data)), 2*nativeChunkSize)
+		response, err := probe(r)
+		if r.used > r.budget {
+			t.Errorf("read %d bytes on a budget of %d", r.used, r.budget)
+		}
+		if err == nil && response == nil {
+			t.Error("no response and no error")
+		}
+	})
+}
+
+func TestBudgetReader(t *testing.T) {
+	data := make([]byte, 3*nativeChunkSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	r := newBudgetReader(bytes.NewReader(data), int64(len(data)), 2*nativeChunkSize)
+
+	// Reads across a chunk boundary cost both chunks, and chunks are read once
+	buf := make([]byte, 4)
+	if _, err := r.ReadAt(buf, nativeChunkSize-2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[nativeChunkSize-2:nativeChunkSize+2]) {
+		t.Errorf("read %v, want %v", buf, data[nativeChunkSize-2:nativeChunkSize+2])
+	}
+	if _, err := r.ReadAt(buf, 0); err != nil || r.used != 2*nativeChunkSize {
+		t.Errorf("used %d bytes (%v), want %d", r.used, err, 2*nativeChunkSize)
+	}
+	if _, err := r.ReadAt(buf, 2*nativeChunkSize); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("read past the budget returned %v", err)
+	}
+	if n, err := r.ReadAt(buf, int64(len(data))); n != 0 || err == nil {
+		t.Errorf("read at the end returned %d bytes and %v", n, err)
+	}
+}
+
+func TestNativeProbe(t *testing.T) {
+	dir := t.TempDir()
+	movie := filepath.Join(dir, "movie.mkv")
+	if err := os.WriteFile(movie, matroskaFixture(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := nativeProbe(movie, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := response.Format
+	if format.Filename != movie || format.NbStreams != 3 || format.Size != strconv.FormatInt(info.Size(), 10) ||
+		format.BitRate != strconv.FormatInt(int64(float64(info.Size())*8/5400.5), 10) {
+		t.Errorf("format %+v", format)
+	}
+
+	unknown := filepath.Join(dir, "movie.bin")
+	if err := os.WriteFile(unknown, bytes.Repeat([]byte("not a container "), 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(unknown); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nativeProbe(unknown, info); err != errNotThisFormat {
+		t.Errorf("unknown container gave %v, want %v", err, errNotThisFormat)
+	}
+}
+
+func TestNativeHelpers(t *testing.T) {
+	tests := []struct{ got, want string }{
+		{reducedRatio(3840, 2160), "16:9"},
+		{reducedRatio(0, 1), "0:1"},
+		{reducedFraction(48000, 1001), "48000/1001"},
+		{reducedFraction(2000, 1000), "2/1"},
+		{frameRateFromPeriod(41708333), "24000/1001"},
+		{frameRateFromPeriod(40000000), "25/1"},
+		{frameRateFromPeriod(33000000), "1000/33"},
+		{frameRateFromPeriod(0), "0/0"},
+		{channelLayoutFor("ac3", 6), "5.1(side)"},
+		{channelLayoutFor("aac", 6), "5.1"},
+		{channelLayoutFor("dts", 8), "7.1"},
+		{channelLayoutFor("dts", 9), ""},
+	}
+	for i, test := range tests {
+		if test.got != test.want {
+			t.Errorf("case %d: got %q, want %q", i, test.got, test.want)
+		}
+	}
+}
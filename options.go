@@ -0,0 +1,493 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Log levels as understood by -loglevel / -v
+var LOG_LEVELS = map[string]int{
+	"quiet":   -8,
+	"panic":   0,
+	"fatal":   8,
+	"error":   16,
+	"warning": 24,
+	"info":    32,
+	"verbose": 40,
+	"debug":   48,
+	"trace":   56,
+}
+
+const defaultLogLevel = 32
+
+// Option kinds in the ffprobe option table
+type optionKind int
+
+const (
+	optFlag      optionKind = iota // takes no value
+	optBool                        // takes no value, accepts a "no" prefix
+	optValue                       // takes exactly one value
+	optInfo                        // prints program information and exits
+	optInfoValue                   // like optInfo, but takes a value
+)
+
+// Every option ffprobe knows about, and whether it consumes the next argument.
+// Anything not listed here is treated like ffprobe treats it: as an AVOption of
+// the demuxer or decoders, which always takes a value.
+var FFPROBE_OPTIONS = map[string]optionKind{
+	// Generic options shared by the ffmpeg tools
+	"L":            optInfo,
+	"h":            optInfo,
+	"?":            optInfo,
+	"help":         optInfo,
+	"-help":        optInfo,
+	"version":      optInfo,
+	"buildconf":    optInfo,
+	"formats":      optInfo,
+	"muxers":       optInfo,
+	"demuxers":     optInfo,
+	"devices":      optInfo,
+	"codecs":       optInfo,
+	"decoders":     optInfo,
+	"encoders":     optInfo,
+	"bsfs":         optInfo,
+	"protocols":    optInfo,
+	"filters":      optInfo,
+	"pix_fmts":     optInfo,
+	"layouts":      optInfo,
+	"sample_fmts":  optInfo,
+	"dispositions": optInfo,
+	"colors":       optInfo,
+	"sources":      optInfoValue,
+	"sinks":        optInfoValue,
+	"loglevel":     optValue,
+	"v":            optValue,
+	"report":       optBool,
+	"max_alloc":    optValue,
+	"cpuflags":     optValue,
+	"cpucount":     optValue,
+	"hide_banner":  optBool,
+
+	// ffprobe specific options
+	"f":                     optValue,
+	"c":                     optValue,
+	"codec":                 optValue,
+	"unit":                  optBool,
+	"prefix":                optBool,
+	"byte_binary_prefix":    optBool,
+	"sexagesimal":           optBool,
+	"pretty":                optFlag,
+	"print_format":          optValue,
+	"of":                    optValue,
+	"output_format":         optValue,
+	"select_streams":        optValue,
+	"sections":              optInfo,
+	"show_data":             optFlag,
+	"show_data_hash":        optValue,
+	"show_error":            optFlag,
+	"show_format":           optFlag,
+	"show_frames":           optFlag,
+	"show_entries":          optValue,
+	"show_log":              optValue,
+	"show_packets":          optFlag,
+	"show_programs":         optFlag,
+	"show_stream_groups":    optFlag,
+	"show_streams":          optFlag,
+	"show_chapters":         optFlag,
+	"count_frames":          optFlag,
+	"count_packets":         optFlag,
+	"show_program_version":  optInfo,
+	"show_library_versions": optInfo,
+	"show_versions":         optInfo,
+	"show_pixel_formats":    optInfo,
+	"show_optional_fields":  optValue,
+	"show_private_data":     optBool,
+	"private":               optBool,
+	"bitexact":              optBool,
+	"read_intervals":        optValue,
+	"i":                     optValue,
+	"o":                     optValue,
+	"print_filename":        optValue,
+	"find_stream_info":      optBool,
+}
+
+// ProbeOptions is the structured form of an ffprobe command line
+type ProbeOptions struct {
+	Args []string // Arguments as given, without the program name
+
+	Input         string // Input URL as given on the command line
+	InputPath     string // Local filesystem path of the input, empty for pipes and network URLs
+	Output        string // -o
+	PrintFilename string // -print_filename
+	ForceFormat   string // -f
+
+	Writer        string            // Writer name from -print_format / -of
+	WriterOptions map[string]string // Writer sub-options, e.g. nokey=1
+	WriterArgs    string            // Raw writer sub-option string
+
+	ShowStreams      bool
+	ShowFormat       bool
+	ShowChapters     bool
+	ShowPrograms     bool
+	ShowStreamGroups bool
+	ShowError        bool
+	ShowPackets      bool
+	ShowFrames       bool
+	ShowData         bool
+	ShowDataHash     string
+	ShowEntries      string
+	ShowLog          string
+	ShowOptional     string
+	CountFrames      bool
+	CountPackets     bool
+	SelectStreams    string
+	ReadIntervals    string
+
+	Unit             bool
+	Prefix           bool
+	ByteBinaryPrefix bool
+	Sexagesimal      bool
+	ShowPrivateData  bool
+	BitExact         bool
+	FindStreamInfo   bool
+	HideBanner       bool
+
+	LogLevel        int
+	ProbeSize       string
+	AnalyzeDuration string
+	AVOptions       map[string]string // Demuxer/decoder AVOptions, e.g. -user_agent
+
+	InfoOptions []string // Options that print program information instead of probing
+}
+
+// Parse an ffprobe command line (without the program name)
+func parseFFProbeArgs(args []string) (*ProbeOptions, error) {
+	opts := &ProbeOptions{
+		Args:            args,
+		Writer:          "default",
+		WriterOptions:   map[string]string{},
+		ShowPrivateData: true,
+		FindStreamInfo:  true,
+		LogLevel:        defaultLogLevel,
+		AVOptions:       map[string]string{},
+	}
+
+	handleOptions := true
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if !handleOptions || arg == "-" || !strings.HasPrefix(arg, "-") {
+			if err := opts.setInput(arg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if arg == "--" {
+			handleOptions = false
+			continue
+		}
+
+		name := arg[1:]
+		kind, known := lookupOption(name)
+		value := ""
+		negated := false
+		if !known && strings.HasPrefix(name, "no") {
+			if k, ok := lookupOption(name[2:]); ok && k == optBool {
+				name, kind, known, negated = name[2:], optBool, true, true
+			}
+		}
+		if !known || kind == optValue || kind == optInfoValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("Missing argument for option '%s'.", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		if err := opts.apply(name, kind, known, value, negated); err != nil {
+			return nil, err
+		}
+	}
+
+	return opts, nil
+}
+
+// Look up an option by name, ignoring any stream specifier suffix (-c:v)
+func lookupOption(name string) (optionKind, bool) {
+	if idx := strings.Index(name, ":"); idx > 0 {
+		name = name[:idx]
+	}
+	kind, exists := FFPROBE_OPTIONS[name]
+	return kind, exists
+}
+
+// Apply a single option to the options object
+func (opts *ProbeOptions) apply(name string, kind optionKind, known bool, value string, negated bool) error {
+	if !known {
+		switch name {
+		case "probesize":
+			opts.ProbeSize = value
+		case "analyzeduration":
+			opts.AnalyzeDuration = value
+		}
+		opts.AVOptions[name] = value
+		return nil
+	}
+
+	if kind == optInfo || kind == optInfoValue {
+		opts.InfoOptions = append(opts.InfoOptions, name)
+		return nil
+	}
+
+	switch name {
+	case "i":
+		return opts.setInput(value)
+	case "o":
+		opts.Output = value
+	case "f":
+		opts.ForceFormat = value
+	case "print_filename":
+		opts.PrintFilename = value
+	case "loglevel", "v":
+		level, err := parseLogLevel(value)
+		if err != nil {
+			return err
+		}
+		opts.LogLevel = level
+	case "print_format", "of", "output_format":
+		return opts.setWriter(value)
+	case "select_streams":
+		opts.SelectStreams = value
+	case "show_entries":
+		if opts.ShowEntries != "" {
+			opts.ShowEntries += ":"
+		}
+		opts.ShowEntries += value
+	case "show_data_hash":
+		opts.ShowDataHash = value
+	case "show_log":
+		opts.ShowLog = value
+	case "show_optional_fields":
+		opts.ShowOptional = value
+	case "read_intervals":
+		opts.ReadIntervals = value
+	case "show_streams":
+		opts.ShowStreams = true
+	case "show_format":
+		opts.ShowFormat = true
+	case "show_chapters":
+		opts.ShowChapters = true
+	case "show_programs":
+		opts.ShowPrograms = true
+	case "show_stream_groups":
+		opts.ShowStreamGroups = true
+	case "show_error":
+		opts.ShowError = true
+	case "show_packets":
+		opts.ShowPackets = true
+	case "show_frames":
+		opts.ShowFrames = true
+	case "show_data":
+		opts.ShowData = true
+	case "count_frames":
+		opts.CountFrames = true
+	case "count_packets":
+		opts.CountPackets = true
+	case "pretty":
+		opts.Unit, opts.Prefix, opts.ByteBinaryPrefix, opts.Sexagesimal = true, true, true, true
+	case "unit":
+		opts.Unit = !negated
+	case "prefix":
+		opts.Prefix = !negated
+	case "byte_binary_prefix":
+		opts.ByteBinaryPrefix = !negated
+	case "sexagesimal":
+		opts.Sexagesimal = !negated
+	case "show_private_data", "private":
+		opts.ShowPrivateData = !negated
+	case "bitexact":
+		opts.BitExact = !negated
+	case "find_stream_info":
+		opts.FindStreamInfo = !negated
+	case "hide_banner":
+		opts.HideBanner = !negated
+	}
+	return nil
+}
+
+// Record the input URL, resolving file: and pipe: prefixes
+func (opts *ProbeOptions) setInput(input string) error {
+	if opts.Input != "" {
+		return fmt.Errorf("Argument '%s' provided as input filename, but '%s' was already specified.", input, opts.Input)
+	}
+	opts.Input = input
+	opts.InputPath = localInputPath(input)
+	return nil
+}
+
+// Map an input URL to a local path; pipes and other protocols have none
+func localInputPath(input string) string {
+	switch {
+	case input == "-" || strings.HasPrefix(input, "pipe:"):
+		return ""
+	case strings.HasPrefix(input, "file:"):
+		return strings.TrimPrefix(input, "file:")
+	}
+
+	// Anything that looks like "proto://..." or "proto:..." is a URL, except
+	// single-letter schemes, which are Windows drive letters
+	if idx := strings.Index(input, ":"); idx > 1 && isURLScheme(input[:idx]) {
+		return ""
+	}
+	return input
+}
+
+// Whether s is made only of the characters ffmpeg allows in a protocol name
+func isURLScheme(s string) bool {
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse a writer specification such as "default=nw=1:nk=1"
+func (opts *ProbeOptions) setWriter(spec string) error {
+	name, args, _ := strings.Cut(spec, "=")
+	if name == "" {
+		return fmt.Errorf("Invalid output format '%s'", spec)
+	}
+	opts.Writer = name
+	opts.WriterArgs = args
+	opts.WriterOptions = map[string]string{}
+
+	for _, pair := range splitEscaped(args, ':') {
+		if pair == "" {
+			continue
+		}
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("Failed to parse option string '%s' for writer '%s'", args, name)
+		}
+		opts.WriterOptions[key] = value
+	}
+	return nil
+}
+
+// Split a string on sep, honoring backslash escapes and single quotes
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	var current strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			current.WriteByte(s[i])
+		case c == '\'':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if s != "" {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
+
+// Parse a -loglevel value, e.g. "error", "repeat+level+warning" or "24"
+func parseLogLevel(value string) (int, error) {
+	tokens := strings.FieldsFunc(value, func(r rune) bool { return r == '+' })
+	if len(tokens) == 0 {
+		return 0, fmt.Errorf("Invalid loglevel \"%s\".", value)
+	}
+	last := tokens[len(tokens)-1]
+	if level, exists := LOG_LEVELS[last]; exists {
+		return level, nil
+	}
+	if level, err := strconv.Atoi(last); err == nil {
+		return level, nil
+	}
+	// Only flags ("repeat", "level") were given; keep the default level
+	if last == "repeat" || last == "level" || last == "time" || last == "datetime" {
+		return defaultLogLevel, nil
+	}
+	return 0, fmt.Errorf("Invalid loglevel \"%s\".", value)
+}
+
+// Whether ffprobe would print program information instead of probing
+func (opts *ProbeOptions) isInfoRequest() bool {
+	return len(opts.InfoOptions) > 0
+}
+
+// AVOptions that only bound how much or how fast the input is read; the
+// canonical probe, which runs with the defaults, answers these calls as well
+var NEUTRAL_INPUT_OPTIONS = map[string]bool{
+	"probesize":       true,
+	"analyzeduration": true,
+	"threads":         true,
+}
+
+// Options that change how the real ffprobe reads the input (-f, -fflags and
+// other demuxer or decoder options), so that its answer may differ from the
+// one to the canonical probe
+func (opts *ProbeOptions) inputOptions() []string {
+	var options []string
+	if opts.ForceFormat != "" {
+		options = append(options, "f")
+	}
+	if !opts.FindStreamInfo {
+		options = append(options, "nofind_stream_info")
+	}
+	for name := range opts.AVOptions {
+		if !NEUTRAL_INPUT_OPTIONS[name] {
+			options = append(options, name)
+		}
+	}
+	sort.Strings(options)
+	return options
+}
+
+// Options whose output the shim cannot synthesize
+func (opts *ProbeOptions) unsupportedOptions() []string {
+	var unsupported []string
+	if opts.ShowPackets {
+		unsupported = append(unsupported, "show_packets")
+	}
+	if opts.ShowFrames {
+		unsupported = append(unsupported, "show_frames")
+	}
+	if opts.ShowData {
+		unsupported = append(unsupported, "show_data")
+	}
+	if opts.ShowDataHash != "" {
+		unsupported = append(unsupported, "show_data_hash")
+	}
+	if opts.ShowLog != "" {
+		unsupported = append(unsupported, "show_log")
+	}
+	if opts.CountFrames {
+		unsupported = append(unsupported, "count_frames")
+	}
+	if opts.CountPackets {
+		unsupported = append(unsupported, "count_packets")
+	}
+	if opts.ShowStreamGroups {
+		unsupported = append(unsupported, "show_stream_groups")
+	}
+	if opts.ReadIntervals != "" {
+		unsupported = append(unsupported, "read_intervals")
+	}
+	if opts.Output != "" {
+		unsupported = append(unsupported, "o")
+	}
+	return unsupported
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLocalInputPath(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"movie.mkv", "movie.mkv"},
+		{"/media/movie.mkv", "/media/movie.mkv"},
+		{"file:/media/movie.mkv", "/media/movie.mkv"},
+		{"-", ""},
+		{"pipe:0", ""},
+		{"http://host/movie.mkv", ""},
+		{"rtsp://host/stream", ""},
+		{"srt+tls:host", ""},
+		{"C:movie.mkv", "C:movie.mkv"},
+		{"My Movie: Sequel.mkv", "My Movie: Sequel.mkv"},
+		{"Movie_2:Part.mkv", "Movie_2:Part.mkv"},
+		{"dir/name:x.mkv", "dir/name:x.mkv"},
+	}
+	for _, test := range tests {
+		if got := localInputPath(test.input); got != test.want {
+			t.Errorf("localInputPath(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestInputOptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "[]"},
+		// Jellyfin, Sonarr and Radarr only bound how much is read
+		{[]string{"-analyzeduration", "200M", "-probesize", "1G", "-threads", "0"}, "[]"},
+		{[]string{"-f", "matroska"}, "[f]"},
+		{[]string{"-nofind_stream_info"}, "[nofind_stream_info]"},
+		{[]string{"-probesize", "1G", "-fflags", "+genpts"}, "[fflags]"},
+		{[]string{"-skip_frame", "nokey", "-threads", "4"}, "[skip_frame]"},
+	}
+	for _, test := range tests {
+		opts, err := parseFFProbeArgs(append(test.args, "movie.mkv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(opts.inputOptions()); got != test.want {
+			t.Errorf("input options of %v = %s, want %s", test.args, got, test.want)
+		}
+	}
+}
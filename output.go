@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// outputEntry is a single key/value pair of a section
+type outputEntry struct {
+	Key      string
+	Value    string
+	IsInt    bool
+	IntValue int64
+}
+
+// outputNode is a section instance with its entries and subsections
+type outputNode struct {
+	Def      *sectionDef
+	Entries  []outputEntry
+	Children []*outputNode
+}
+
+func (node *outputNode) addString(key, value string) {
+	node.Entries = append(node.Entries, outputEntry{Key: key, Value: value})
+}
+
+func (node *outputNode) addInt(key string, value int64) {
+	node.Entries = append(node.Entries, outputEntry{Key: key, Value: strconv.FormatInt(value, 10), IsInt: true, IntValue: value})
+}
+
+// Replace the value of an entry
+func (node *outputNode) setString(key, value string) {
+	for i := range node.Entries {
+		if node.Entries[i].Key == key {
+			node.Entries[i].Value = value
+		}
+	}
+}
+
+func (node *outputNode) addChild(child *outputNode) *outputNode {
+	node.Children = append(node.Children, child)
+	return child
+}
+
+// Build the output tree for the sections of a response selected on the command line
+func buildOutputTree(response *FFProbeResponse, selection sectionSelection, opts *ProbeOptions) *outputNode {
+	root := &outputNode{Def: SECTION_ROOT}
+
+	programs := root.addChild(&outputNode{Def: SECTION_PROGRAMS})
+	for _, program := range response.Programs {
+		programs.addChild(programNode(program))
+	}
+
+	streams := root.addChild(&outputNode{Def: SECTION_STREAMS})
+	for _, stream := range response.Streams {
+		streams.addChild(streamNode(stream, SECTION_STREAM, SECTION_STREAM_DISPOSITION, SECTION_STREAM_TAGS))
+	}
+
+	chapters := root.addChild(&outputNode{Def: SECTION_CHAPTERS})
+	for _, chapter := range response.Chapters {
+		if chapter.raw != nil {
+			chapters.addChild(rawNode(SECTION_CHAPTER, chapter.raw, SECTION_CHAPTER_TAGS))
+			continue
+		}
+		node := structNode(SECTION_CHAPTER, chapter)
+		addTags(node, SECTION_CHAPTER_TAGS, chapter.Tags)
+		chapters.addChild(node)
+	}
+
+	format := response.Format
+	if opts.PrintFilename != "" {
+		format.Filename = opts.PrintFilename
+	}
+	if format.raw != nil {
+		formatNode := root.addChild(rawNode(SECTION_FORMAT, format.raw, SECTION_FORMAT_TAGS))
+		formatNode.setString("filename", format.Filename)
+	} else {
+		formatNode := root.addChild(structNode(SECTION_FORMAT, format))
+		addTags(formatNode, SECTION_FORMAT_TAGS, format.Tags)
+	}
+
+	formatOutputValues(root, opts)
+	return selection.filter(root)
+}
+
+func programNode(program Program) *outputNode {
+	var node *outputNode
+	if program.raw != nil {
+		node = rawNode(SECTION_PROGRAM, program.raw, SECTION_PROGRAM_TAGS)
+	} else {
+		node = structNode(SECTION_PROGRAM, program)
+		addTags(node, SECTION_PROGRAM_TAGS, program.Tags)
+	}
+	// The streams may have been narrowed by -select_streams
+	streams := node.addChild(&outputNode{Def: SECTION_PROGRAM_STREAMS})
+	for _, stream := range program.Streams {
+		streams.addChild(streamNode(stream, SECTION_PROGRAM_STREAM, SECTION_PROGRAM_STREAM_DISPOSITION, SECTION_PROGRAM_STREAM_TAGS))
+	}
+	return node
+}
+
+func streamNode(stream Stream, def, dispositionDef, tagsDef *sectionDef) *outputNode {
+	if stream.raw != nil {
+		return rawNode(def, stream.raw, def.Children...)
+	}
+	node := structNode(def, stream)
+
+	if len(stream.Disposition) > 0 {
+		disposition := node.addChild(&outputNode{Def: dispositionDef})
+		for _, key := range orderedKeys(stream.Disposition, DISPOSITION_ORDER) {
+			disposition.addInt(key, int64(stream.Disposition[key]))
+		}
+	}
+
+	addTags(node, tagsDef, stream.Tags)
+
+	if len(stream.SideDataList) > 0 && def == SECTION_STREAM {
+		list := node.addChild(&outputNode{Def: SECTION_STREAM_SIDE_DATA_LIST})
+		for _, sideData := range stream.SideDataList {
+			sideDataNode := list.addChild(structNode(SECTION_STREAM_SIDE_DATA, sideData))
+			for _, field := range sideData.Fields {
+				switch value := field.Value.(type) {
+				case int64:
+					sideDataNode.addInt(field.Key, value)
+				case string:
+					sideDataNode.addString(field.Key, value)
+				}
+			}
+		}
+	}
+
+	return node
+}
+
+func addTags(node *outputNode, def *sectionDef, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	tagsNode := node.addChild(&outputNode{Def: def})
+	for _, key := range orderedKeys(tags, nil) {
+		tagsNode.addString(key, tags[key])
+	}
+}
+
+// Keys of a map, those listed in order first, the rest sorted
+func orderedKeys[V any](m map[string]V, order []string) []string {
+	keys := make([]string, 0, len(m))
+	for _, key := range order {
+		if _, exists := m[key]; exists {
+			keys = append(keys, key)
+		}
+	}
+	var rest []string
+	for key := range m {
+		if !containsString(order, key) {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	return append(keys, rest...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Turn the scalar fields of a struct into section entries, in field order,
+// honoring the json tags (name and omitempty)
+func structNode(def *sectionDef, value interface{}) *outputNode {
+	node := &outputNode{Def: def}
+	v := reflect.ValueOf(value)
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		field := v.Field(i)
+		if strings.Contains(options, "omitempty") && field.IsZero() {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			node.addString(name, field.String())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			node.addInt(name, field.Int())
+		}
+	}
+
+	return node
+}
+
+// Turn a JSON object the real ffprobe printed into a section, with its
+// scalar members as entries in their order, and those of its objects and
+// arrays named like one of children as subsections
+func rawNode(def *sectionDef, object jsonObject, children ...*sectionDef) *outputNode {
+	node := &outputNode{Def: def}
+	for _, member := range object {
+		var child *sectionDef
+		for _, candidate := range children {
+			if candidate.Name == member.Key {
+				child = candidate
+			}
+		}
+
+		switch value := member.Value.(type) {
+		case string:
+			node.addString(member.Key, value)
+		case json.Number:
+			if n, err := value.Int64(); err == nil {
+				node.addInt(member.Key, n)
+			} else {
+				node.addString(member.Key, value.String())
+			}
+		case jsonObject:
+			if child != nil {
+				node.addChild(rawNode(child, value))
+			}
+		case []interface{}:
+			if child != nil && child.Flags&sectionIsArray != 0 {
+				list := node.addChild(&outputNode{Def: child})
+				for _, element := range jsonObjects(value) {
+					list.addChild(rawNode(child.Children[0], element))
+				}
+			}
+		}
+	}
+	return node
+}
+
+// ProbeError is an error as ffprobe reports it: a negative errno and its description
+type ProbeError struct {
+	Code   int    `json:"code"`
+	String string `json:"string"`
+}
+
+// Errors reported for inputs that cannot be probed
+var (
+	ERROR_NO_SUCH_FILE      = ProbeError{Code: -2, String: "No such file or directory"}
+	ERROR_INPUT_OUTPUT      = ProbeError{Code: -5, String: "Input/output error"}
+	ERROR_PERMISSION_DENIED = ProbeError{Code: -13, String: "Permission denied"}
+)
+
+// The error ffprobe reports for a failed file operation: the negated errno
+// and its description as strerror() words it
+func probeErrorFor(err error) ProbeError {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return ERROR_INPUT_OUTPUT
+	}
+	message := errno.Error()
+	if message != "" {
+		message = strings.ToUpper(message[:1]) + message[1:]
+	}
+	return ProbeError{Code: -int(errno), String: message}
+}
+
+// Write the error section, if requested, in place of a response
+func writeErrorResponse(w io.Writer, probeError ProbeError, opts *ProbeOptions) error {
+	selection, err := newSectionSelection(opts)
+	if err != nil {
+		return err
+	}
+	writer, err := newOutputWriter(opts)
+	if err != nil {
+		return err
+	}
+	root := &outputNode{Def: SECTION_ROOT}
+	root.addChild(structNode(SECTION_ERROR, probeError))
+	return writeOutputTree(w, writer, selection.filter(root))
+}
+
+// Write the requested sections of a response to w using the requested writer
+func writeResponse(w io.Writer, response *FFProbeResponse, opts *ProbeOptions) error {
+	selection, err := newSectionSelection(opts)
+	if err != nil {
+		return err
+	}
+	response, err = selectStreams(response, opts.SelectStreams)
+	if err != nil {
+		return err
+	}
+	writer, err := newOutputWriter(opts)
+	if err != nil {
+		return err
+	}
+	return writeOutputTree(w, writer, buildOutputTree(response, selection, opts))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// A small probe result with a stream of each common type, tags, a chapter
+// and a program, for the output tests
+func testResponse() *FFProbeResponse {
+	return &FFProbeResponse{
+		Programs: []Program{{
+			ProgramID:  1,
+			ProgramNum: 1,
+			NbStreams:  1,
+			PmtPid:     4096,
+			PcrPid:     256,
+			Tags:       map[string]string{"service_name": "Service01"},
+			Streams: []Stream{{
+				Index:       0,
+				CodecName:   "h264",
+				CodecType:   "video",
+				Width:       1920,
+				Height:      1080,
+				Disposition: map[string]int{"default": 1},
+			}},
+		}},
+		Streams: []Stream{
+			{
+				Index:        0,
+				CodecName:    "h264",
+				Profile:      "High",
+				CodecType:    "video",
+				Width:        1920,
+				Height:       1080,
+				RFrameRate:   "24000/1001",
+				AvgFrameRate: "24000/1001",
+				TimeBase:     "1/1000",
+				StartTime:    "0.000000",
+				Duration:     "5400.500000",
+				BitRate:      "8000000",
+				Disposition:  map[string]int{"default": 1, "forced": 0},
+				Tags:         map[string]string{"language": "eng"},
+			},
+			{
+				Index:         1,
+				CodecName:     "ac3",
+				CodecType:     "audio",
+				SampleRate:    "48000",
+				Channels:      6,
+				ChannelLayout: "5.1(side)",
+				BitRate:       "640000",
+				Disposition:   map[string]int{"default": 0, "forced": 0},
+				Tags:          map[string]string{"language": "ger", "title": "Deutsch"},
+			},
+			{
+				Index:       2,
+				CodecName:   "subrip",
+				CodecType:   "subtitle",
+				Disposition: map[string]int{"default": 0, "forced": 1},
+				Tags:        map[string]string{"language": "eng"},
+			},
+		},
+		Chapters: []Chapter{{
+			ID:        0,
+			TimeBase:  "1/1000000000",
+			Start:     0,
+			StartTime: "0.000000",
+			End:       600000000000,
+			EndTime:   "600.000000",
+			Tags:      map[string]string{"title": "Chapter 1"},
+		}},
+		Format: Format{
+			Filename:       "movie.mkv",
+			NbStreams:      3,
+			NbPrograms:     1,
+			FormatName:     "matroska,webm",
+			FormatLongName: "Matroska / WebM",
+			StartTime:      "0.000000",
+			Duration:       "5400.500000",
+			Size:           "5400500000",
+			BitRate:        "8000000",
+			ProbeScore:     100,
+			Tags:           map[string]string{"title": "A Movie", "encoder": "libebml v1.4.4"},
+		},
+	}
+}
+
+// Print testResponse for an ffprobe command line
+func probeOutput(t *testing.T, args ...string) string {
+	t.Helper()
+	opts, err := parseFFProbeArgs(append(args, "movie.mkv"))
+	if err != nil {
+		t.Fatalf("parsing %v: %v", args, err)
+	}
+	var out bytes.Buffer
+	if err := writeResponse(&out, testResponse(), opts); err != nil {
+		t.Fatalf("writing %v: %v", args, err)
+	}
+	return out.String()
+}
+
+func TestSectionSelection(t *testing.T) {
+	tests := []struct {
+		args     []string
+		sections []string // Section headers of the default writer, in order
+	}{
+		{nil, nil},
+		{[]string{"-show_format"}, []string{"FORMAT"}},
+		{[]string{"-show_streams"}, []string{"STREAM", "STREAM", "STREAM"}},
+		{[]string{"-show_format", "-show_streams"}, []string{"STREAM", "STREAM", "STREAM", "FORMAT"}},
+		{[]string{"-show_chapters"}, []string{"CHAPTER"}},
+		{[]string{"-show_programs"}, []string{"PROGRAM", "STREAM"}},
+		{[]string{"-show_error"}, nil},
+		{[]string{"-show_entries", "format=duration"}, []string{"FORMAT"}},
+		// Like in ffprobe, "stream" also names the streams of programs
+		{[]string{"-show_entries", "stream=index:format=size"}, []string{"PROGRAM", "STREAM", "STREAM", "STREAM", "STREAM", "FORMAT"}},
+		{[]string{"-show_entries", "format_tags=title"}, []string{"FORMAT"}},
+	}
+	for _, test := range tests {
+		var sections []string
+		for _, line := range strings.Split(probeOutput(t, test.args...), "\n") {
+			if strings.HasPrefix(line, "[") && !strings.HasPrefix(line, "[/") {
+				sections = append(sections, strings.Trim(line, "[]"))
+			}
+		}
+		if strings.Join(sections, " ") != strings.Join(test.sections, " ") {
+			t.Errorf("%v printed sections %v, want %v", test.args, sections, test.sections)
+		}
+	}
+}
+
+func TestSectionContent(t *testing.T) {
+	want := `[FORMAT]
+filename=movie.mkv
+nb_streams=3
+nb_programs=1
+format_name=matroska,webm
+format_long_name=Matroska / WebM
+start_time=0.000000
+duration=5400.500000
+size=5400500000
+bit_rate=8000000
+probe_score=100
+TAG:encoder=libebml v1.4.4
+TAG:title=A Movie
+[/FORMAT]
+`
+	if got := probeOutput(t, "-show_format"); got != want {
+		t.Errorf("-show_format printed\n%s\nwant\n%s", got, want)
+	}
+}
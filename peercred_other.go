@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// Without SO_PEERCRED, only the permissions of the socket and its directory
+// keep other users out
+func peerUID(conn net.Conn) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Whether to queue a real probe in the background after serving a synthetic response
+var BACKGROUND_PROBE = envOrDefault("FFPROBE_SHIM_BACKGROUND_PROBE", "") != ""
+
+// Minimum time between two background probes, to keep the load on the remote mount low
+var BACKGROUND_PROBE_INTERVAL = envDuration("FFPROBE_SHIM_BACKGROUND_INTERVAL", 30*time.Second)
+
+// Subcommand that runs the background probe worker
+const refreshWorkerCommand = "shim-refresh"
+
+// Set by the daemon, which drains the queue itself instead of starting workers
+var refreshWake chan struct{}
+
+// RefreshJob is a queued background probe
+type RefreshJob struct {
+	Path     string    `json:"path"`
+	Enqueued time.Time `json:"enqueued"`
+}
+
+func refreshQueueDir() string {
+	return filepath.Join(CACHE_DIR, "queue")
+}
+
+// Queue a real probe of a file and make sure a worker is running to drain the queue
+func enqueueBackgroundProbe(path string, info os.FileInfo) {
+	if !BACKGROUND_PROBE || CACHE_DIR == "" {
+		return
+	}
+
+	// Jobs are named after the cache key, so a file is queued at most once
+	jobFile := filepath.Join(refreshQueueDir(), cacheKey(path, info)+".job")
+	if _, err := os.Stat(jobFile); err == nil {
+		log.Printf("Background probe of %s already queued", path)
+		return
+	}
+
+	job := RefreshJob{Path: normalizeCachePath(path), Enqueued: time.Now().UTC()}
+	if err := writeRefreshJob(jobFile, job); err != nil {
+		log.Printf("Error queueing background probe of %s: %v", path, err)
+		return
+	}
+	log.Printf("Queued background probe of %s", path)
+
+	if refreshWake != nil {
+		select {
+		case refreshWake <- struct{}{}:
+		default: // A drain is already pending
+		}
+		return
+	}
+
+	// A running worker looks for new jobs before it exits
+	lock, err := tryLockFile(filepath.Join(refreshQueueDir(), "worker.lock"))
+	if err == errLocked {
+		return
+	} else if err == nil {
+		lock.Close()
+	}
+	startRefreshWorker()
+}
+
+// Write a job file through a temporary file, so that a worker never reads
+// a partial job
+func writeRefreshJob(jobFile string, job RefreshJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(jobFile), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(jobFile), ".job-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), jobFile); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Start a detached worker process; it exits at once if another one is running
+func startRefreshWorker() {
+	executable, err := os.Executable()
+	if err != nil {
+		log.Printf("Cannot start background probe worker: %v", err)
+		return
+	}
+
+	cmd := exec.Command(executable, refreshWorkerCommand)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Error starting background probe worker: %v", err)
+		return
+	}
+	cmd.Process.Release()
+}
+
+// Drain the queue in this process whenever a job is queued
+func startRefreshLoop() {
+	refreshWake = make(chan struct{}, 1)
+	go func() {
+		for range refreshWake {
+			runRefreshWorker()
+		}
+	}()
+	// Pick up jobs left over from before the daemon started
+	refreshWake <- struct{}{}
+}
+
+// Drain the background probe queue, one real probe per interval
+func runRefreshWorker() {
+	lockPath := filepath.Join(refreshQueueDir(), "worker.lock")
+	for {
+		lock, err := tryLockFile(lockPath)
+		if err == errLocked {
+			log.Println("Background probe worker already running")
+			return
+		} else if err != nil {
+			log.Printf("Error locking background probe queue: %v", err)
+			return
+		}
+
+		drainRefreshQueue()
+		lock.Close()
+
+		// A job queued while the lock was being released would otherwise
+		// wait for the next enqueue to be picked up
+		if len(pendingRefreshJobs()) == 0 {
+			return
+		}
+	}
+}
+
+func drainRefreshQueue() {
+	lastProbePath := filepath.Join(refreshQueueDir(), "last-probe")
+
+	for {
+		jobs := pendingRefreshJobs()
+		if len(jobs) == 0 {
+			return
+		}
+		jobFile := jobs[0]
+
+		var job RefreshJob
+		data, err := os.ReadFile(jobFile)
+		if err == nil {
+			err = json.Unmarshal(data, &job)
+		}
+		if err != nil {
+			log.Printf("Dropping unreadable background probe job %s: %v", jobFile, err)
+			os.Remove(jobFile)
+			continue
+		}
+
+		info, err := os.Stat(job.Path)
+		if err != nil {
+			log.Printf("Dropping background probe of %s: %v", job.Path, err)
+			os.Remove(jobFile)
+			continue
+		}
+		if entry, found := loadCachedEntry(job.Path, info); found && entry.Source == cacheSourceReal {
+			log.Printf("Background probe of %s not needed, already cached", job.Path)
+			os.Remove(jobFile)
+			continue
+		}
+
+		// Rate limit across worker generations using the last probe's timestamp
+		if stat, err := os.Stat(lastProbePath); err == nil {
+			if wait := BACKGROUND_PROBE_INTERVAL - time.Since(stat.ModTime()); wait > 0 {
+				log.Printf("Waiting %s before the next background probe", wait.Round(time.Millisecond))
+				time.Sleep(wait)
+			}
+		}
+		touchFile(lastProbePath)
+
+		start := time.Now()
+		if _, err := probeAndCache(job.Path, info, slotRequest{Priority: backgroundProbePriority}); err != nil {
+			log.Printf("Background probe of %s failed: %v", job.Path, err)
+		} else {
+			log.Printf("Background probe of %s finished in %s (queued %s ago)", job.Path,
+				time.Since(start).Round(time.Millisecond), time.Since(job.Enqueued).Round(time.Second))
+		}
+		os.Remove(jobFile)
+	}
+}
+
+// Queued job files, oldest first
+func pendingRefreshJobs() []string {
+	entries, err := os.ReadDir(refreshQueueDir())
+	if err != nil {
+		return nil
+	}
+
+	type queued struct {
+		path    string
+		modTime time.Time
+	}
+	var jobs []queued
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".job") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, queued{filepath.Join(refreshQueueDir(), entry.Name()), info.ModTime()})
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].modTime.Before(jobs[j].modTime) })
+
+	paths := make([]string, len(jobs))
+	for i, job := range jobs {
+		paths[i] = job.path
+	}
+	return paths
+}
+
+// Create a file or update its modification time
+func touchFile(path string) {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		if file, err := os.Create(path); err == nil {
+			file.Close()
+		}
+	}
+}
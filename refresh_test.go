@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnqueueBackgroundProbe(t *testing.T) {
+	backgroundProbe, cacheDir, wake := BACKGROUND_PROBE, CACHE_DIR, refreshWake
+	BACKGROUND_PROBE, CACHE_DIR, refreshWake = true, t.TempDir(), make(chan struct{}, 1)
+	t.Cleanup(func() { BACKGROUND_PROBE, CACHE_DIR, refreshWake = backgroundProbe, cacheDir, wake })
+
+	input := filepath.Join(t.TempDir(), "movie.mkv")
+	if err := os.WriteFile(input, []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enqueueBackgroundProbe(input, info)
+	jobs := pendingRefreshJobs()
+	if len(jobs) != 1 {
+		t.Fatalf("queued jobs %v, want one", jobs)
+	}
+	var job RefreshJob
+	if data, err := os.ReadFile(jobs[0]); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Path != normalizeCachePath(input) {
+		t.Errorf("queued %s, want %s", job.Path, input)
+	}
+	select {
+	case <-refreshWake:
+	default:
+		t.Error("a new job did not wake the worker")
+	}
+
+	// A file already queued wakes nobody
+	enqueueBackgroundProbe(input, info)
+	select {
+	case <-refreshWake:
+		t.Error("a job already queued woke the worker")
+	default:
+	}
+
+	// Nothing is left behind but the job
+	entries, err := os.ReadDir(refreshQueueDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("queue holds %d files, want the job only", len(entries))
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Section flags, mirroring ffprobe's section table
+type sectionFlags int
+
+const (
+	sectionIsWrapper         sectionFlags = 1 << iota // root of the output
+	sectionIsArray                                    // a list of elements of the same kind
+	sectionHasVariableFields                          // keys are data (tags), not field names
+)
+
+// sectionDef describes a kind of section in the output
+type sectionDef struct {
+	Name        string
+	UniqueName  string // name used by -show_entries, when different from Name
+	ElementName string // name of the contained elements, for arrays and variable fields
+	Flags       sectionFlags
+	Children    []*sectionDef
+}
+
+var (
+	SECTION_PROGRAM_STREAM_DISPOSITION = &sectionDef{Name: "disposition", UniqueName: "program_stream_disposition"}
+	SECTION_PROGRAM_STREAM_TAGS        = &sectionDef{Name: "tags", UniqueName: "program_stream_tags", ElementName: "tag", Flags: sectionHasVariableFields}
+	SECTION_PROGRAM_STREAM             = &sectionDef{Name: "stream", UniqueName: "program_stream", Children: []*sectionDef{SECTION_PROGRAM_STREAM_DISPOSITION, SECTION_PROGRAM_STREAM_TAGS}}
+	SECTION_PROGRAM_STREAMS            = &sectionDef{Name: "streams", UniqueName: "program_streams", ElementName: "stream", Flags: sectionIsArray, Children: []*sectionDef{SECTION_PROGRAM_STREAM}}
+	SECTION_PROGRAM_TAGS               = &sectionDef{Name: "tags", UniqueName: "program_tags", ElementName: "tag", Flags: sectionHasVariableFields}
+	SECTION_PROGRAM                    = &sectionDef{Name: "program", Children: []*sectionDef{SECTION_PROGRAM_TAGS, SECTION_PROGRAM_STREAMS}}
+	SECTION_PROGRAMS                   = &sectionDef{Name: "programs", ElementName: "program", Flags: sectionIsArray, Children: []*sectionDef{SECTION_PROGRAM}}
+
+	SECTION_STREAM_DISPOSITION    = &sectionDef{Name: "disposition", UniqueName: "stream_disposition"}
+	SECTION_STREAM_TAGS           = &sectionDef{Name: "tags", UniqueName: "stream_tags", ElementName: "tag", Flags: sectionHasVariableFields}
+	SECTION_STREAM_SIDE_DATA      = &sectionDef{Name: "side_data", UniqueName: "stream_side_data"}
+	SECTION_STREAM_SIDE_DATA_LIST = &sectionDef{Name: "side_data_list", UniqueName: "stream_side_data_list", ElementName: "side_data", Flags: sectionIsArray, Children: []*sectionDef{SECTION_STREAM_SIDE_DATA}}
+	SECTION_STREAM                = &sectionDef{Name: "stream", Children: []*sectionDef{SECTION_STREAM_DISPOSITION, SECTION_STREAM_TAGS, SECTION_STREAM_SIDE_DATA_LIST}}
+	SECTION_STREAMS               = &sectionDef{Name: "streams", ElementName: "stream", Flags: sectionIsArray, Children: []*sectionDef{SECTION_STREAM}}
+
+	SECTION_CHAPTER_TAGS = &sectionDef{Name: "tags", UniqueName: "chapter_tags", ElementName: "tag", Flags: sectionHasVariableFields}
+	SECTION_CHAPTER      = &sectionDef{Name: "chapter", Children: []*sectionDef{SECTION_CHAPTER_TAGS}}
+	SECTION_CHAPTERS     = &sectionDef{Name: "chapters", ElementName: "chapter", Flags: sectionIsArray, Children: []*sectionDef{SECTION_CHAPTER}}
+
+	SECTION_FORMAT_TAGS = &sectionDef{Name: "tags", UniqueName: "format_tags", ElementName: "tag", Flags: sectionHasVariableFields}
+	SECTION_FORMAT      = &sectionDef{Name: "format", Children: []*sectionDef{SECTION_FORMAT_TAGS}}
+
+	SECTION_ERROR = &sectionDef{Name: "error"}
+
+	SECTION_ROOT = &sectionDef{Name: "root", Flags: sectionIsWrapper, Children: []*sectionDef{
+		SECTION_PROGRAMS, SECTION_STREAMS, SECTION_CHAPTERS, SECTION_FORMAT, SECTION_ERROR,
+	}}
+)
+
+// Order in which ffprobe prints the disposition flags
+var DISPOSITION_ORDER = []string{
+	"default", "dub", "original", "comment", "lyrics", "karaoke", "forced",
+	"hearing_impaired", "visual_impaired", "clean_effects", "attached_pic",
+	"timed_thumbnails", "non_diegetic", "captions", "descriptions", "metadata",
+	"dependent", "still_image",
+}
+
+// sectionShow records which entries of a section were requested
+type sectionShow struct {
+	All     bool
+	Entries map[string]bool
+}
+
+// sectionSelection is the set of sections and entries to print
+type sectionSelection map[*sectionDef]*sectionShow
+
+// Build the selection from -show_streams, -show_format, ... and -show_entries
+func newSectionSelection(opts *ProbeOptions) (sectionSelection, error) {
+	selection := sectionSelection{}
+
+	for _, show := range []struct {
+		enabled bool
+		def     *sectionDef
+	}{
+		{opts.ShowPrograms, SECTION_PROGRAMS},
+		{opts.ShowStreams, SECTION_STREAMS},
+		{opts.ShowChapters, SECTION_CHAPTERS},
+		{opts.ShowFormat, SECTION_FORMAT},
+		{opts.ShowError, SECTION_ERROR},
+	} {
+		if show.enabled {
+			selection.mark(show.def, true, nil)
+		}
+	}
+
+	if opts.ShowEntries != "" {
+		if err := selection.parseShowEntries(opts.ShowEntries); err != nil {
+			return nil, err
+		}
+	}
+
+	return selection, nil
+}
+
+// Parse a -show_entries specification, e.g. "format=duration:stream=codec_name,width:stream_tags"
+func (selection sectionSelection) parseShowEntries(spec string) error {
+	for p := spec; p != ""; {
+		var name string
+		name, p = getToken(p, "=:")
+		entries := map[string]bool{}
+		all := true
+		if strings.HasPrefix(p, "=") {
+			all = false
+			for p = p[1:]; p != "" && p[0] != ':'; {
+				var entry string
+				entry, p = getToken(p, ",:")
+				entries[entry] = true
+				p = strings.TrimPrefix(p, ",")
+			}
+		}
+
+		matched := false
+		for _, def := range allSections() {
+			if def.Name == name || def.UniqueName == name {
+				selection.mark(def, all, entries)
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("No match for section '%s'", name)
+		}
+		p = strings.TrimPrefix(p, ":")
+	}
+	return nil
+}
+
+// Read a token up to one of the terminators, like av_get_token: leading and
+// unescaped trailing whitespace is dropped, backslashes escape a character
+// and single quotes a run of them
+func getToken(s, terms string) (token, rest string) {
+	s = strings.TrimLeft(s, " \n\t\r")
+	var b strings.Builder
+	keep := 0 // Length of the token that trailing whitespace must not cut into
+	i := 0
+	for ; i < len(s) && strings.IndexByte(terms, s[i]) < 0; i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+			keep = b.Len()
+		case c == '\'':
+			for i++; i < len(s) && s[i] != '\''; i++ {
+				b.WriteByte(s[i])
+			}
+			keep = b.Len()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	token = b.String()
+	trimmed := strings.TrimRight(token[keep:], " \n\t\r")
+	return token[:keep] + trimmed, s[min(i, len(s)):]
+}
+
+// Mark a section as shown; showing all entries also shows all subsections
+func (selection sectionSelection) mark(def *sectionDef, all bool, entries map[string]bool) {
+	show := selection[def]
+	if show == nil {
+		show = &sectionShow{Entries: map[string]bool{}}
+		selection[def] = show
+	}
+
+	if all {
+		show.All = true
+		for _, child := range def.Children {
+			selection.mark(child, true, nil)
+		}
+		return
+	}
+	for entry := range entries {
+		show.Entries[entry] = true
+	}
+}
+
+// Whether a section, or any of its subsections, was selected
+func (selection sectionSelection) isShown(def *sectionDef) bool {
+	if _, exists := selection[def]; exists {
+		return true
+	}
+	for _, child := range def.Children {
+		if selection.isShown(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether an entry of a section was selected
+func (selection sectionSelection) showsEntry(def *sectionDef, key string) bool {
+	show := selection[def]
+	return show != nil && (show.All || show.Entries[key])
+}
+
+// Remove unselected sections and entries from an output tree
+func (selection sectionSelection) filter(node *outputNode) *outputNode {
+	filtered := &outputNode{Def: node.Def}
+	for _, entry := range node.Entries {
+		if selection.showsEntry(node.Def, entry.Key) {
+			filtered.Entries = append(filtered.Entries, entry)
+		}
+	}
+
+	for _, child := range node.Children {
+		// Elements of an array are printed whenever the array is
+		if node.Def.Flags&sectionIsArray != 0 || selection.isShown(child.Def) {
+			filtered.Children = append(filtered.Children, selection.filter(child))
+		}
+	}
+	return filtered
+}
+
+// Every section in the table, depth first
+func allSections() []*sectionDef {
+	var sections []*sectionDef
+	var walk func(def *sectionDef)
+	walk = func(def *sectionDef) {
+		sections = append(sections, def)
+		for _, child := range def.Children {
+			walk(child)
+		}
+	}
+	walk(SECTION_ROOT)
+	return sections
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestShowEntries(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"format=duration,size", "format|duration=5400.500000|size=5400500000\n"},
+		{"format_tags", "format|tag:encoder=libebml v1.4.4|tag:title=A Movie\n"},
+		{"format=format_name:format_tags=title", "format|format_name=matroska,webm|tag:title=A Movie\n"},
+		{"stream=codec_name:stream_disposition=forced", "program|stream|codec_name=h264\n\n" +
+			"stream|codec_name=h264|disposition:forced=0\nstream|codec_name=ac3|disposition:forced=0\nstream|codec_name=subrip|disposition:forced=1\n"},
+		// Streams are printed even when none of their entries is
+		{"stream_tags=title", "stream|\nstream|tag:title=Deutsch\nstream|\n"},
+		{"stream=nonexistent", "program|stream|\n\nstream|\nstream|\nstream|\n"},
+		{"chapter=id:chapter_tags", "chapter|id=0|tag:title=Chapter 1\n"},
+		{"program=program_id:program_tags", "program|program_id=1|tag:service_name=Service01\n"},
+		{"program_stream_tags=language", "program|stream|\n\n"},
+		// An escaped separator is part of the entry name
+		{`format=size\,duration`, "format|\n"},
+		{" format = size , duration ", "format|duration=5400.500000|size=5400500000\n"},
+	}
+	for _, test := range tests {
+		if got := probeOutput(t, "-of", "compact", "-show_entries", test.spec); got != test.want {
+			t.Errorf("-show_entries %s printed %q, want %q", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestShowEntriesErrors(t *testing.T) {
+	for _, spec := range []string{"nosuchsection", "format=size:nosuch", "stream=index:foo"} {
+		opts, err := parseFFProbeArgs([]string{"-show_entries", spec, "movie.mkv"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newSectionSelection(opts); err == nil {
+			t.Errorf("-show_entries %s was accepted", spec)
+		}
+	}
+}
+
+func TestShowEntriesWithShowSections(t *testing.T) {
+	// -show_format shows the whole section whatever -show_entries narrows
+	got := probeOutput(t, "-of", "compact", "-show_format", "-show_entries", "format=size")
+	want := "format|filename=movie.mkv|nb_streams=3|nb_programs=1|format_name=matroska,webm|format_long_name=Matroska / WebM|" +
+		"start_time=0.000000|duration=5400.500000|size=5400500000|bit_rate=8000000|probe_score=100|" +
+		"tag:encoder=libebml v1.4.4|tag:title=A Movie\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
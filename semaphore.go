@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Maximum number of real ffprobe processes running at once on this host; 0 means no limit
+var MAX_REAL_PROBES = envInt("FFPROBE_SHIM_MAX_REAL_PROBES", 0)
+
+// Directory holding the slot locks and the queue shared by all shim processes
+var SEMAPHORE_DIR = envOrDefault("FFPROBE_SHIM_SEMAPHORE_DIR", "/tmp/ffprobe-shim-slots")
+
+// How long a caller waits for a slot by default; 0 means forever
+var REAL_PROBE_MAX_WAIT = envDuration("FFPROBE_SHIM_MAX_WAIT", 5*time.Minute)
+
+// What to answer when the wait for a slot times out
+var QUEUE_TIMEOUT_POLICY = envOrDefault("FFPROBE_SHIM_QUEUE_TIMEOUT_POLICY", timeoutPolicyError)
+
+// What to answer when the real ffprobe cannot answer in time
+const (
+	timeoutPolicyError     = "error"     // Fail the call like ffprobe would
+	timeoutPolicySynthetic = "synthetic" // Answer from a template
+)
+
+// Priorities range from -maxProbePriority to maxProbePriority; higher goes first
+const maxProbePriority = 999
+
+// Background probes yield to every caller that is waiting
+const backgroundProbePriority = -maxProbePriority
+
+// Returned when the wait for a slot exceeds the deadline
+var errSlotTimeout = errors.New("timed out waiting for a real ffprobe slot")
+
+// slotRequest says how a caller queues for a slot
+type slotRequest struct {
+	Priority int
+	MaxWait  time.Duration // 0 waits forever
+}
+
+// Slot request of a caller: FFPROBE_SHIM_PRIORITY and FFPROBE_SHIM_MAX_WAIT
+// in its environment override the defaults, so that each application can
+// be given its own place in the queue
+func (inv *invocation) slotRequest() slotRequest {
+	request := slotRequest{MaxWait: REAL_PROBE_MAX_WAIT}
+	if value, exists := inv.lookupEnv("FFPROBE_SHIM_PRIORITY"); exists {
+		if _, err := fmt.Sscan(value, &request.Priority); err != nil {
+			log.Printf("Ignoring invalid FFPROBE_SHIM_PRIORITY %q", value)
+		}
+	}
+	if value, exists := inv.lookupEnv("FFPROBE_SHIM_MAX_WAIT"); exists {
+		if wait, err := time.ParseDuration(value); err == nil {
+			request.MaxWait = wait
+		} else {
+			log.Printf("Ignoring invalid FFPROBE_SHIM_MAX_WAIT %q", value)
+		}
+	}
+	return request
+}
+
+// Wait for one of the MAX_REAL_PROBES slots and return the function that
+// releases it. Waiting callers queue up as ticket files named so that they
+// sort by priority, then by arrival. Each waits on the lock of the ticket
+// ahead of it, which is released when that caller leaves the queue or dies,
+// and the first in line waits on the locks of the slots; nobody polls.
+func acquireRealProbeSlot(request slotRequest) (func(), error) {
+	if MAX_REAL_PROBES <= 0 {
+		return func() {}, nil
+	}
+
+	queueDir := filepath.Join(SEMAPHORE_DIR, "queue")
+	if err := os.MkdirAll(queueDir, 0755); err != nil {
+		return nil, err
+	}
+
+	priority := request.Priority
+	if priority > maxProbePriority {
+		priority = maxProbePriority
+	} else if priority < -maxProbePriority {
+		priority = -maxProbePriority
+	}
+	name := fmt.Sprintf("%04d-%020d-%d", maxProbePriority-priority, time.Now().UnixNano(), os.Getpid())
+
+	// The ticket is locked before it is visible, so nobody mistakes it for
+	// the ticket of a dead process
+	tmpPath := filepath.Join(queueDir, "."+name)
+	ticket, err := lockFile(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	ticketPath := filepath.Join(queueDir, name)
+	if err := os.Rename(tmpPath, ticketPath); err != nil {
+		os.Remove(tmpPath)
+		ticket.Close()
+		return nil, err
+	}
+	leaveQueue := func() {
+		os.Remove(ticketPath)
+		ticket.Close()
+	}
+
+	start := time.Now()
+	var deadline time.Time
+	if request.MaxWait > 0 {
+		deadline = start.Add(request.MaxWait)
+	}
+
+	slotPaths := make([]string, MAX_REAL_PROBES)
+	for i := range slotPaths {
+		slotPaths[i] = filepath.Join(SEMAPHORE_DIR, fmt.Sprintf("slot-%d.lock", i))
+	}
+	for {
+		if err := waitInQueue(queueDir, name, deadline); err != nil {
+			leaveQueue()
+			return nil, err
+		}
+		slot, i, err := lockFirst(slotPaths, true, deadline)
+		if err == errLockTimeout {
+			leaveQueue()
+			return nil, errSlotTimeout
+		} else if err != nil {
+			leaveQueue()
+			return nil, err
+		}
+
+		// A caller of higher priority that lined up ahead in the meantime is
+		// waiting for a slot too, and gets this one
+		if ticketAhead(queueDir, name) != "" {
+			slot.Close()
+			continue
+		}
+		leaveQueue()
+		if waited := time.Since(start); waited > time.Second {
+			log.Printf("Got real ffprobe slot %d after %s", i, waited.Round(time.Millisecond))
+		}
+		return func() { slot.Close() }, nil
+	}
+}
+
+// Wait until a ticket is the first in the queue, on the lock of the ticket
+// just ahead of it
+func waitInQueue(queueDir, name string, deadline time.Time) error {
+	for {
+		ahead := ticketAhead(queueDir, name)
+		if ahead == "" {
+			return nil
+		}
+		// Tickets are removed before they are unlocked, so one whose lock
+		// can be taken while it is still there belongs to a dead process
+		aheadPath := filepath.Join(queueDir, ahead)
+		lock, _, err := lockFirst([]string{aheadPath}, false, deadline)
+		if err == errLockTimeout {
+			return errSlotTimeout
+		} else if err == nil {
+			log.Printf("Removing queue ticket of dead process: %s", ahead)
+			os.Remove(aheadPath)
+			lock.Close()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// The ticket just ahead of one in the queue; empty if it is the first
+func ticketAhead(queueDir, name string) string {
+	entries, err := os.ReadDir(queueDir)
+	if err != nil {
+		return ""
+	}
+
+	ahead := ""
+	for _, entry := range entries {
+		// Entries are sorted by name, and so by place in the queue
+		ticket := entry.Name()
+		if strings.HasPrefix(ticket, ".") || ticket >= name {
+			continue
+		}
+		ahead = ticket
+	}
+	return ahead
+}
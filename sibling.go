@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether to answer for an episode from a real probe of another episode of
+// the same release in its directory; set it to an empty value to disable
+var DERIVE_FROM_SIBLINGS = envOrDefault("FFPROBE_SHIM_DERIVE_SIBLINGS", "1") != ""
+
+// Matroska statistics tag holding a stream's duration, e.g. "DURATION-eng"
+var DURATION_TAG_PATTERN = regexp.MustCompile(`(?i)^DURATION(-|$)`)
+
+// releaseKey identifies the episodes of one release: files of a season pack
+// share it, and have the same stream layout
+type releaseKey struct {
+	Title      string
+	Season     int
+	Group      string
+	Resolution string
+	Extension  string
+}
+
+// Release of an episode file; false for files that are not episodes
+func releaseKeyFor(filename string) (releaseKey, int, bool) {
+	title, info := releaseTitle(filename)
+	if title == "" || (info.Season == 0 && info.Episode == 0) {
+		return releaseKey{}, 0, false
+	}
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9')
+	})
+	return releaseKey{
+		Title:      strings.Join(words, " "),
+		Season:     info.Season,
+		Group:      strings.ToLower(info.Group),
+		Resolution: strings.ToLower(info.Resolution),
+		Extension:  strings.ToLower(filepath.Ext(filename)),
+	}, info.Episode, true
+}
+
+// Derive a response for an episode from the cached real probe of a sibling
+// episode of the same release, the nearest one by episode number. The result
+// is cached as derived until a real probe replaces it.
+func deriveFromSibling(path string, info os.FileInfo) (*FFProbeResponse, bool) {
+	if !DERIVE_FROM_SIBLINGS || CACHE_DIR == "" {
+		return nil, false
+	}
+	key, episode, ok := releaseKeyFor(filepath.Base(path))
+	if !ok {
+		return nil, false
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		log.Printf("Error listing siblings of %s: %v", path, err)
+		return nil, false
+	}
+
+	type sibling struct {
+		path     string
+		info     os.FileInfo
+		distance int
+	}
+	var siblings []sibling
+	for _, dirEntry := range entries {
+		name := dirEntry.Name()
+		if name == filepath.Base(path) || !dirEntry.Type().IsRegular() {
+			continue
+		}
+		siblingKey, siblingEpisode, ok := releaseKeyFor(name)
+		if !ok || siblingKey != key {
+			continue
+		}
+		siblingPath := filepath.Join(filepath.Dir(path), name)
+		siblingInfo, err := os.Stat(siblingPath)
+		if err != nil {
+			continue
+		}
+		distance := siblingEpisode - episode
+		if distance < 0 {
+			distance = -distance
+		}
+		siblings = append(siblings, sibling{siblingPath, siblingInfo, distance})
+	}
+	sort.SliceStable(siblings, func(i, j int) bool {
+		return siblings[i].distance < siblings[j].distance
+	})
+
+	for _, sibling := range siblings {
+		// Derived entries are guesses themselves, so only real ones count
+		entry, found := loadCachedEntry(sibling.path, sibling.info)
+		if !found || entry.Source != cacheSourceReal {
+			continue
+		}
+		response, err := entry.decodeResponse()
+		if err != nil {
+			continue
+		}
+
+		adjustSiblingResponse(response, path, info.Size(), entry.Size)
+		log.Printf("Derived response for %s from sibling %s", path, sibling.path)
+
+		if data, err := json.Marshal(response); err != nil {
+			log.Printf("Error encoding derived response for %s: %v", path, err)
+		} else if err := storeCachedResponse(path, info, data, cacheSourceDerived); err != nil {
+			log.Printf("Error caching derived response for %s: %v", path, err)
+		}
+		return response, true
+	}
+	return nil, false
+}
+
+// Make the probe of a sibling describe another file of the same release:
+// its filename and size, and its duration estimated from the size, since
+// the episodes of a release share their bitrate far more than their length
+func adjustSiblingResponse(response *FFProbeResponse, path string, size, siblingSize int64) {
+	// What the real ffprobe printed describes the sibling
+	response.dropRaw()
+	response.Format.Filename = path
+	response.Format.Size = strconv.FormatInt(size, 10)
+
+	ratio := 1.0
+	if siblingSize > 0 {
+		ratio = float64(size) / float64(siblingSize)
+	}
+	response.Format.Duration = scaleSeconds(response.Format.Duration, ratio)
+	for i := range response.Streams {
+		stream := &response.Streams[i]
+		stream.Duration = scaleSeconds(stream.Duration, ratio)
+		stream.DurationTS = int64(float64(stream.DurationTS) * ratio)
+		for tag, value := range stream.Tags {
+			if DURATION_TAG_PATTERN.MatchString(tag) {
+				stream.Tags[tag] = scaleTimestamp(value, ratio)
+			}
+		}
+	}
+
+	// Chapters and titles belong to the sibling's episode
+	response.Chapters = nil
+	for _, tag := range FILE_SPECIFIC_FORMAT_TAGS {
+		delete(response.Format.Tags, tag)
+	}
+}
+
+// Scale a duration in seconds as ffprobe prints it, e.g. "2643.104000", or
+// "0:44:03.104000" with -sexagesimal
+func scaleSeconds(value string, ratio float64) string {
+	if strings.Contains(value, ":") {
+		total, ok := parseClock(value)
+		if !ok {
+			return value
+		}
+		total = time.Duration(float64(total) * ratio)
+		return fmt.Sprintf("%d:%02d:%02d.%06d",
+			int(total/time.Hour), int(total/time.Minute%60), int(total/time.Second%60), int(total%time.Second/time.Microsecond))
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	return fmt.Sprintf("%.6f", seconds*ratio)
+}
+
+// Scale a Matroska timestamp, e.g. "00:44:03.104000000"
+func scaleTimestamp(value string, ratio float64) string {
+	total, ok := parseClock(value)
+	if !ok {
+		return value
+	}
+	total = time.Duration(float64(total) * ratio)
+	return fmt.Sprintf("%02d:%02d:%02d.%09d",
+		int(total/time.Hour), int(total/time.Minute%60), int(total/time.Second%60), int(total%time.Second))
+}
+
+// Parse a duration written as hours:minutes:seconds
+func parseClock(value string) (time.Duration, bool) {
+	var hours, minutes int
+	var seconds float64
+	if _, err := fmt.Sscanf(value, "%d:%d:%f", &hours, &minutes, &seconds); err != nil {
+		return 0, false
+	}
+	return time.Duration((float64(hours*3600+minutes*60) + seconds) * float64(time.Second)), true
+}
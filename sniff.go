@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// containerFormat is a container as ffprobe names it, with the extension
+// template patterns know it by. Containers that hold only audio have the
+// codec and a typical bitrate of it, since the video templates do not fit them.
+type containerFormat struct {
+	Name         string
+	LongName     string
+	Extension    string
+	Score        int
+	AudioCodec   string
+	AudioBitRate int64
+}
+
+var (
+	FORMAT_MATROSKA = containerFormat{"matroska,webm", "Matroska / WebM", ".mkv", 100, "", 0}
+	FORMAT_MOV      = containerFormat{"mov,mp4,m4a,3gp,3g2,mj2", "QuickTime / MOV", ".mp4", 100, "", 0}
+	FORMAT_AVI      = containerFormat{"avi", "AVI (Audio Video Interleaved)", ".avi", 100, "", 0}
+	FORMAT_MPEGTS   = containerFormat{"mpegts", "MPEG-TS (MPEG-2 Transport Stream)", ".ts", 50, "", 0}
+	FORMAT_MPEGPS   = containerFormat{"mpeg", "MPEG-PS (MPEG-2 Program Stream)", ".mpg", 51, "", 0}
+	FORMAT_OGG      = containerFormat{"ogg", "Ogg", ".ogg", 100, "vorbis", 192000}
+	FORMAT_FLAC     = containerFormat{"flac", "raw FLAC", ".flac", 100, "flac", 900000}
+	FORMAT_MP3      = containerFormat{"mp3", "MP2/3 (MPEG audio layer 2/3)", ".mp3", 51, "mp3", 320000}
+)
+
+// Containers by extension, for files whose first bytes do not tell
+var CONTAINER_EXTENSIONS = map[string]containerFormat{
+	".mkv":  FORMAT_MATROSKA,
+	".mk3d": FORMAT_MATROSKA,
+	".mka":  FORMAT_MATROSKA,
+	".webm": FORMAT_MATROSKA,
+	".mp4":  FORMAT_MOV,
+	".m4v":  FORMAT_MOV,
+	".m4a":  FORMAT_MOV,
+	".mov":  FORMAT_MOV,
+	".avi":  FORMAT_AVI,
+	".ts":   FORMAT_MPEGTS,
+	".m2ts": FORMAT_MPEGTS,
+	".mts":  FORMAT_MPEGTS,
+	".mpg":  FORMAT_MPEGPS,
+	".mpeg": FORMAT_MPEGPS,
+	".vob":  FORMAT_MPEGPS,
+	".ogg":  FORMAT_OGG,
+	".ogv":  FORMAT_OGG,
+	".oga":  FORMAT_OGG,
+	".flac": FORMAT_FLAC,
+	".mp3":  FORMAT_MP3,
+}
+
+// Probe score ffprobe gives a format it knows only from the extension
+const extensionProbeScore = 50
+
+// Bytes read from the start of a file to tell its container
+const sniffBytes = 4096
+
+// Find the container of a file from its first bytes, or from its extension
+// when they do not tell; false if neither does
+func detectContainer(path string) (containerFormat, bool) {
+	if file, err := os.Open(path); err == nil {
+		head := make([]byte, sniffBytes)
+		n, err := file.ReadAt(head, 0)
+		file.Close()
+		if err == nil || err == io.EOF {
+			if container, found := sniffContainer(head[:n]); found {
+				return container, true
+			}
+		}
+	}
+
+	container, found := CONTAINER_EXTENSIONS[strings.ToLower(filepath.Ext(path))]
+	if !found {
+		return containerFormat{}, false
+	}
+	container.Score = extensionProbeScore
+	return container, true
+}
+
+// The container whose signature starts data
+func sniffContainer(data []byte) (containerFormat, bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		return FORMAT_MATROSKA, true
+	case len(data) >= 8 && isTopLevelBox(string(data[4:8])):
+		return FORMAT_MOV, true
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "AVI ":
+		return FORMAT_AVI, true
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return FORMAT_OGG, true
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return FORMAT_FLAC, true
+	case bytes.HasPrefix(data, []byte{0, 0, 1, 0xba}):
+		return FORMAT_MPEGPS, true
+	case hasSyncBytes(data, 0, 188) || hasSyncBytes(data, 4, 192):
+		return FORMAT_MPEGTS, true
+	case bytes.HasPrefix(data, []byte("ID3")) && len(data) >= 10:
+		// FLAC files may start with an ID3 tag too
+		size := int(data[6]&0x7f)<<21 | int(data[7]&0x7f)<<14 | int(data[8]&0x7f)<<7 | int(data[9]&0x7f)
+		if rest := data[min(10+size, len(data)):]; bytes.HasPrefix(rest, []byte("fLaC")) {
+			return FORMAT_FLAC, true
+		}
+		return FORMAT_MP3, true
+	}
+	return containerFormat{}, false
+}
+
+// Whether a box type may start an MP4 or QuickTime file
+func isTopLevelBox(boxType string) bool {
+	switch boxType {
+	case "ftyp", "moov", "mdat", "wide", "free", "skip":
+		return true
+	}
+	return false
+}
+
+// Whether data has transport stream sync bytes at the start of its first
+// packets of a size
+func hasSyncBytes(data []byte, offset, packetSize int) bool {
+	packets := min(5, len(data)/packetSize)
+	if packets < 3 {
+		return false
+	}
+	for i := 0; i < packets; i++ {
+		if data[offset+i*packetSize] != 0x47 {
+			return false
+		}
+	}
+	return true
+}
+
+// The filename template patterns should see: one whose extension does not
+// belong to its container gets the container's, so that a misnamed file
+// matches like one named right
+func templateFilename(filename string, container containerFormat) string {
+	ext := filepath.Ext(filename)
+	if container.Name == "" || CONTAINER_EXTENSIONS[strings.ToLower(ext)].Name == container.Name {
+		return filename
+	}
+	log.Printf("%s is %s, matching it as %s", filename, container.Name, container.Extension)
+	return strings.TrimSuffix(filename, ext) + container.Extension
+}
+
+// A synthetic answer for a file of an audio-only container: a stereo stream
+// of its codec, timed by the typical bitrate
+func audioResponse(path string, size int64, container containerFormat) *FFProbeResponse {
+	stream := Stream{
+		CodecName:  container.AudioCodec,
+		CodecType:  "audio",
+		SampleRate: "44100",
+		Channels:   2,
+		BitRate:    strconv.FormatInt(container.AudioBitRate, 10),
+	}
+	finishNativeStream(&stream)
+	response := &FFProbeResponse{
+		Streams: []Stream{stream},
+		Format: Format{
+			Filename:       path,
+			NbStreams:      1,
+			FormatName:     container.Name,
+			FormatLongName: container.LongName,
+			StartTime:      "0.000000",
+			ProbeScore:     container.Score,
+			Tags:           map[string]string{"title": filepath.Base(path)},
+		},
+	}
+	applyFileSize(response, size, true)
+	return response
+}
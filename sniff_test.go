@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The start of a file whose ID3v2 tag of a size is followed by rest
+func id3Tagged(size int, rest string) []byte {
+	header := []byte{'I', 'D', '3', 4, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(append(header, make([]byte, size)...), rest...)
+}
+
+func TestSniffContainer(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string // Empty if not found
+	}{
+		{"matroska", matroskaFixture(), "matroska,webm"},
+		{"mp4", mp4FixtureWith(nil), "mov,mp4,m4a,3gp,3g2,mj2"},
+		{"mov starting with mdat", newMP4Box("mdat", make([]byte, 16)), "mov,mp4,m4a,3gp,3g2,mj2"},
+		{"avi", aviFixtureWith(nil), "avi"},
+		{"wave", riffChunk("RIFF", []byte("WAVE")), ""},
+		{"ogg", []byte("OggS\x00\x02"), "ogg"},
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), "flac"},
+		{"program stream", []byte{0, 0, 1, 0xba, 0x44}, "mpeg"},
+		{"transport stream", tsFixture(188, 0), "mpegts"},
+		{"m2ts", tsFixture(192, 0), "mpegts"},
+		{"two packets", tsFixture(188, 0)[:2*188], ""},
+		{"mp3 with a tag", id3Tagged(100, "\xff\xfb\x90\x64"), "mp3"},
+		{"flac with a tag", id3Tagged(100, "fLaC"), "flac"},
+		{"tag past the data", id3Tagged(100, "")[:50], "mp3"},
+		{"short tag", []byte("ID3"), ""},
+		{"text", []byte("not a container at all"), ""},
+		{"empty", nil, ""},
+	}
+	for _, test := range tests {
+		container, found := sniffContainer(test.data)
+		if container.Name != test.want || found != (test.want != "") {
+			t.Errorf("%s: got %q (%v), want %q", test.name, container.Name, found, test.want)
+		}
+	}
+}
+
+func TestDetectContainer(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	text := []byte("not a container at all")
+	tests := []struct {
+		path  string
+		want  string // Empty if not found
+		score int
+	}{
+		{write("mp4.mkv", mp4FixtureWith(nil)), "mov,mp4,m4a,3gp,3g2,mj2", 100},
+		{write("matroska.MKV", matroskaFixture()), "matroska,webm", 100},
+		{write("unknown.ts", text), "mpegts", extensionProbeScore},
+		{write("unknown.bin", text), "", 0},
+		{filepath.Join(dir, "missing.avi"), "avi", extensionProbeScore},
+		{filepath.Join(dir, "missing"), "", 0},
+	}
+	for _, test := range tests {
+		container, found := detectContainer(test.path)
+		if container.Name != test.want || found != (test.want != "") || container.Score != test.score {
+			t.Errorf("%s: got %q (%v) with score %d, want %q with score %d", filepath.Base(test.path),
+				container.Name, found, container.Score, test.want, test.score)
+		}
+	}
+}
+
+func TestTemplateFilename(t *testing.T) {
+	tests := []struct {
+		filename  string
+		container containerFormat
+		want      string
+	}{
+		{"Show.S01E01.mkv", FORMAT_MOV, "Show.S01E01.mp4"},
+		{"Show.S01E01.mp4", FORMAT_MOV, "Show.S01E01.mp4"},
+		{"Show.S01E01.m4v", FORMAT_MOV, "Show.S01E01.m4v"},
+		{"Movie.2160p.MKV", FORMAT_MATROSKA, "Movie.2160p.MKV"},
+		{"Movie.2160p.mkv", FORMAT_AVI, "Movie.2160p.avi"},
+		{"Movie", FORMAT_MPEGTS, "Movie.ts"},
+		{"Movie.mkv", containerFormat{}, "Movie.mkv"},
+	}
+	for _, test := range tests {
+		if got := templateFilename(test.filename, test.container); got != test.want {
+			t.Errorf("templateFilename(%q, %s) = %q, want %q", test.filename, test.container.Name, got, test.want)
+		}
+	}
+}
+
+func TestAudioResponse(t *testing.T) {
+	response := audioResponse("/music/Album/01 Song.flac", 9000000, FORMAT_FLAC)
+	format := response.Format
+	if format.FormatName != "flac" || format.ProbeScore != 100 || format.Duration != "80.000000" ||
+		format.BitRate != "900000" || format.Tags["title"] != "01 Song.flac" {
+		t.Errorf("format %+v", format)
+	}
+	if len(response.Streams) != 1 {
+		t.Fatalf("%d streams, want 1", len(response.Streams))
+	}
+	stream := response.Streams[0]
+	if stream.CodecName != "flac" || stream.CodecType != "audio" || stream.ChannelLayout != "stereo" || stream.Duration != "80.000000" {
+		t.Errorf("stream %+v", stream)
+	}
+}
+
+func FuzzSniffContainer(f *testing.F) {
+	for _, seed := range [][]byte{matroskaFixture(), tsFixture(192, 0), id3Tagged(10, "fLaC"), []byte("RIFF\x00\x00\x00\x00AVI ")} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if container, found := sniffContainer(data); found && (container.Name == "" || container.Extension == "") {
+			t.Errorf("found a container without a name: %+v", container)
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Media types selected by the type letters of a stream specifier
+var STREAM_SPECIFIER_TYPES = map[byte]string{
+	'v': "video",
+	'V': "video",
+	'a': "audio",
+	's': "subtitle",
+	'd': "data",
+	't': "attachment",
+}
+
+// Keep only the streams matching the -select_streams specifier
+func selectStreams(response *FFProbeResponse, spec string) (*FFProbeResponse, error) {
+	if spec == "" {
+		return response, nil
+	}
+
+	selected := *response
+	selected.Streams = nil
+	matched := map[int]bool{}
+	for i := range response.Streams {
+		match, err := matchStreamSpecifier(response, &response.Streams[i], spec)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			selected.Streams = append(selected.Streams, response.Streams[i])
+			matched[response.Streams[i].Index] = true
+		}
+	}
+
+	selected.Programs = nil
+	for _, program := range response.Programs {
+		filtered := program
+		filtered.Streams = nil
+		for _, stream := range program.Streams {
+			if matched[stream.Index] {
+				filtered.Streams = append(filtered.Streams, stream)
+			}
+		}
+		selected.Programs = append(selected.Programs, filtered)
+	}
+
+	return &selected, nil
+}
+
+// Check whether a stream matches a stream specifier, following the grammar of
+// avformat_match_stream_specifier: [type][:p:program][:disp:flags][:index],
+// #id, i:id, m:key[:value] and u
+func matchStreamSpecifier(response *FFProbeResponse, stream *Stream, spec string) (bool, error) {
+	match, indexSpec, program, err := matchStreamSpecifierPrefix(response, stream, spec)
+	if err != nil || indexSpec == "" {
+		return match, err
+	}
+
+	index, err := strconv.ParseInt(indexSpec, 0, 64)
+	if err != nil {
+		return false, invalidStreamSpecifier(spec)
+	}
+
+	// A bare number is an absolute stream index
+	if indexSpec == spec {
+		return int64(stream.Index) == index, nil
+	}
+
+	// Otherwise it is the index among the streams matching the rest of the
+	// specifier, within the program if one was given
+	candidates := response.Streams
+	if program != nil {
+		candidates = nil
+		for _, programStream := range program.Streams {
+			for _, candidate := range response.Streams {
+				if candidate.Index == programStream.Index {
+					candidates = append(candidates, candidate)
+				}
+			}
+		}
+	}
+	for i := range candidates {
+		candidateMatch, _, _, err := matchStreamSpecifierPrefix(response, &candidates[i], spec)
+		if err != nil {
+			return false, err
+		}
+		if candidateMatch {
+			if index == 0 {
+				return candidates[i].Index == stream.Index, nil
+			}
+			index--
+		}
+	}
+	return false, nil
+}
+
+// Match everything but a trailing index, which is returned for the caller to resolve
+func matchStreamSpecifierPrefix(response *FFProbeResponse, stream *Stream, spec string) (bool, string, *Program, error) {
+	match := true
+	var program *Program
+	rest := spec
+
+	for rest != "" {
+		switch {
+		case rest[0] >= '0' && rest[0] <= '9':
+			return match, rest, program, nil
+
+		case strings.HasPrefix(rest, "disp:"):
+			flags, remaining, _ := strings.Cut(rest[len("disp:"):], ":")
+			for _, flag := range strings.Split(flags, "+") {
+				if !containsString(DISPOSITION_ORDER, flag) {
+					return false, "", nil, invalidStreamSpecifier(spec)
+				}
+				if stream.Disposition[flag] == 0 {
+					match = false
+				}
+			}
+			rest = remaining
+
+		case STREAM_SPECIFIER_TYPES[rest[0]] != "":
+			if stream.CodecType != STREAM_SPECIFIER_TYPES[rest[0]] {
+				match = false
+			}
+			if rest[0] == 'V' && stream.Disposition["attached_pic"] != 0 {
+				match = false
+			}
+			if len(rest) > 1 && rest[1] != ':' {
+				return false, "", nil, invalidStreamSpecifier(spec)
+			}
+			rest = strings.TrimPrefix(rest[1:], ":")
+
+		case strings.HasPrefix(rest, "p:"):
+			idSpec, remaining, _ := strings.Cut(rest[len("p:"):], ":")
+			id, err := strconv.ParseInt(idSpec, 0, 64)
+			if err != nil {
+				return false, "", nil, invalidStreamSpecifier(spec)
+			}
+			found := false
+			for i := range response.Programs {
+				if int64(response.Programs[i].ProgramID) != id {
+					continue
+				}
+				for _, programStream := range response.Programs[i].Streams {
+					if programStream.Index == stream.Index {
+						found = true
+						program = &response.Programs[i]
+					}
+				}
+			}
+			if !found {
+				match = false
+			}
+			rest = remaining
+
+		case rest[0] == '#' || strings.HasPrefix(rest, "i:"):
+			idSpec := strings.TrimPrefix(strings.TrimPrefix(rest, "#"), "i:")
+			id, err := strconv.ParseInt(idSpec, 0, 64)
+			if err != nil {
+				return false, "", nil, invalidStreamSpecifier(spec)
+			}
+			streamID, err := strconv.ParseInt(stream.ID, 0, 64)
+			return match && err == nil && streamID == id, "", program, nil
+
+		case strings.HasPrefix(rest, "m:"):
+			key, value, hasValue := strings.Cut(rest[len("m:"):], ":")
+			tag, exists := stream.Tags[key]
+			return match && exists && (!hasValue || tag == value), "", program, nil
+
+		case rest == "u":
+			return match && isUsableStream(stream), "", program, nil
+
+		case strings.HasPrefix(rest, "g:"):
+			return false, "", nil, fmt.Errorf("Stream group specifiers are not supported: %s", spec)
+
+		default:
+			return false, "", nil, invalidStreamSpecifier(spec)
+		}
+	}
+
+	return match, "", program, nil
+}
+
+// Whether a stream has a usable codec configuration, as checked by the "u" specifier
+func isUsableStream(stream *Stream) bool {
+	if stream.CodecName == "" || stream.CodecName == "none" {
+		return false
+	}
+	switch stream.CodecType {
+	case "audio":
+		return stream.SampleRate != "" && stream.SampleRate != "0" && stream.Channels > 0
+	case "video":
+		return stream.Width > 0 && stream.Height > 0
+	}
+	return true
+}
+
+func invalidStreamSpecifier(spec string) error {
+	return fmt.Errorf("Invalid stream specifier: %s.", spec)
+}
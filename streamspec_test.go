@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Streams of a transport stream with two programs, a cover picture and a
+// data stream, for the stream specifier tests
+func streamSpecifierResponse() *FFProbeResponse {
+	streams := []Stream{
+		{Index: 0, ID: "0x100", CodecName: "h264", CodecType: "video", Width: 1920, Height: 1080,
+			Disposition: map[string]int{"default": 1}},
+		{Index: 1, ID: "0x101", CodecName: "ac3", CodecType: "audio", SampleRate: "48000", Channels: 6,
+			Disposition: map[string]int{"default": 1}, Tags: map[string]string{"language": "eng"}},
+		{Index: 2, ID: "0x102", CodecName: "aac", CodecType: "audio", SampleRate: "48000", Channels: 2,
+			Disposition: map[string]int{}, Tags: map[string]string{"language": "ger"}},
+		{Index: 3, ID: "0x103", CodecName: "dvb_subtitle", CodecType: "subtitle",
+			Disposition: map[string]int{"forced": 1}, Tags: map[string]string{"language": "eng"}},
+		{Index: 4, CodecName: "mjpeg", CodecType: "video", Width: 600, Height: 600,
+			Disposition: map[string]int{"attached_pic": 1}},
+		{Index: 5, CodecType: "data"},
+	}
+	return &FFProbeResponse{
+		Streams: streams,
+		Programs: []Program{
+			{ProgramID: 1, Streams: []Stream{streams[0], streams[1]}},
+			{ProgramID: 2, Streams: []Stream{streams[2], streams[3]}},
+		},
+	}
+}
+
+func TestSelectStreams(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string // Indexes of the selected streams
+	}{
+		{"", "[0 1 2 3 4 5]"},
+		{"v", "[0 4]"},
+		{"V", "[0]"},
+		{"a", "[1 2]"},
+		{"s", "[3]"},
+		{"d", "[5]"},
+		{"t", "[]"},
+		{"1", "[1]"},
+		{"0x3", "[3]"},
+		{"9", "[]"},
+		{"a:1", "[2]"},
+		{"v:1", "[4]"},
+		{"a:2", "[]"},
+		{"p:2", "[2 3]"},
+		{"p:2:a", "[2]"},
+		{"p:2:0", "[2]"},
+		{"p:1:1", "[1]"},
+		{"p:3", "[]"},
+		{"disp:default", "[0 1]"},
+		{"disp:default+forced", "[]"},
+		{"a:disp:default", "[1]"},
+		{"s:disp:forced", "[3]"},
+		{"#0x101", "[1]"},
+		{"i:256", "[0]"},
+		{"#7", "[]"},
+		{"m:language", "[1 2 3]"},
+		{"m:language:ger", "[2]"},
+		{"a:m:language:eng", "[1]"},
+		{"u", "[0 1 2 3 4]"},
+	}
+	for _, test := range tests {
+		selected, err := selectStreams(streamSpecifierResponse(), test.spec)
+		if err != nil {
+			t.Errorf("-select_streams %q: %v", test.spec, err)
+			continue
+		}
+		indexes := []int{}
+		for _, stream := range selected.Streams {
+			indexes = append(indexes, stream.Index)
+		}
+		if got := fmt.Sprint(indexes); got != test.want {
+			t.Errorf("-select_streams %q selected %s, want %s", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestSelectStreamsPrograms(t *testing.T) {
+	selected, err := selectStreams(streamSpecifierResponse(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Programs stay, with only their selected streams
+	if len(selected.Programs) != 2 || len(selected.Programs[0].Streams) != 1 || selected.Programs[0].Streams[0].Index != 1 ||
+		len(selected.Programs[1].Streams) != 1 || selected.Programs[1].Streams[0].Index != 2 {
+		t.Errorf("programs after -select_streams a: %+v", selected.Programs)
+	}
+}
+
+func TestSelectStreamsErrors(t *testing.T) {
+	for _, spec := range []string{"x", "a1", "vv", "p:x", "p:1:x", "disp:nosuch", "#x", "g:0"} {
+		if _, err := selectStreams(streamSpecifierResponse(), spec); err == nil {
+			t.Errorf("-select_streams %q was accepted", spec)
+		}
+	}
+}
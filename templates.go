@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Keys of a configured template that say how it is composed rather than
+// what it contains. A template is built by taking the template it extends,
+// applying each overlay in order, then applying its own content:
+//
+//	"base-mkv":     {"streams": [...], "format": {...}},
+//	"hevc-10bit":   {"streams": [{"codec_type": "video", "codec_name": "hevc", "pix_fmt": "yuv420p10le"}]},
+//	"4k-hdr-remux": {"extends": "base-mkv", "overlays": ["hevc-10bit", "truehd-atmos"]}
+const (
+	templateExtendsKey  = "extends"
+	templateOverlaysKey = "overlays"
+)
+
+// templateSource is a configured template before composition
+type templateSource struct {
+	Content  map[string]interface{}
+	Extends  string
+	Overlays []string
+}
+
+// Split a configured template into its composition and its content
+func parseTemplateSource(raw json.RawMessage) (*templateSource, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var content map[string]interface{}
+	if err := dec.Decode(&content); err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return nil, fmt.Errorf("a template must be an object")
+	}
+
+	source := &templateSource{Content: content}
+	if value, exists := content[templateExtendsKey]; exists {
+		name, ok := value.(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s must be a template name", templateExtendsKey)
+		}
+		source.Extends = name
+		delete(content, templateExtendsKey)
+	}
+	if value, exists := content[templateOverlaysKey]; exists {
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of template names", templateOverlaysKey)
+		}
+		for _, item := range list {
+			name, ok := item.(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("%s must be a list of template names", templateOverlaysKey)
+			}
+			source.Overlays = append(source.Overlays, name)
+		}
+		delete(content, templateOverlaysKey)
+	}
+	return source, nil
+}
+
+// templateResolver composes configured templates, falling back to the
+// compiled-in ones for names the configuration does not define
+type templateResolver struct {
+	sources  map[string]*templateSource
+	builtins map[string]FFProbeResponse
+	resolved map[string]map[string]interface{}
+	visiting []string
+}
+
+func newTemplateResolver(sources map[string]*templateSource, builtins map[string]FFProbeResponse) *templateResolver {
+	return &templateResolver{
+		sources:  sources,
+		builtins: builtins,
+		resolved: map[string]map[string]interface{}{},
+	}
+}
+
+// The composed content of a template
+func (t *templateResolver) resolve(name string) (map[string]interface{}, error) {
+	if content, done := t.resolved[name]; done {
+		return content, nil
+	}
+	for i, visiting := range t.visiting {
+		if visiting == name {
+			return nil, fmt.Errorf("template cycle: %s", strings.Join(append(t.visiting[i:], name), " -> "))
+		}
+	}
+
+	source, exists := t.sources[name]
+	if !exists {
+		builtin, exists := t.builtins[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown template %q", name)
+		}
+		content, err := templateContent(builtin)
+		if err != nil {
+			return nil, err
+		}
+		t.resolved[name] = content
+		return content, nil
+	}
+
+	t.visiting = append(t.visiting, name)
+	defer func() { t.visiting = t.visiting[:len(t.visiting)-1] }()
+
+	content := map[string]interface{}{}
+	if source.Extends != "" {
+		base, err := t.resolve(source.Extends)
+		if err != nil {
+			return nil, err
+		}
+		content = mergeTemplateContent(content, base)
+	}
+	for _, overlayName := range source.Overlays {
+		overlay, err := t.resolve(overlayName)
+		if err != nil {
+			return nil, err
+		}
+		content = mergeTemplateContent(content, overlay)
+	}
+	content = mergeTemplateContent(content, source.Content)
+
+	t.resolved[name] = content
+	return content, nil
+}
+
+// Compose a template with overlays applied on top, as a rule may ask for
+func (t *templateResolver) compose(name string, overlays []string) (FFProbeResponse, error) {
+	content, err := t.resolve(name)
+	if err != nil {
+		return FFProbeResponse{}, err
+	}
+	for _, overlayName := range overlays {
+		overlay, err := t.resolve(overlayName)
+		if err != nil {
+			return FFProbeResponse{}, err
+		}
+		content = mergeTemplateContent(content, overlay)
+	}
+	return templateResponse(content)
+}
+
+// Name under which a rule's composition is registered
+func composedTemplateName(name string, overlays []string) string {
+	return strings.Join(append([]string{name}, overlays...), "+")
+}
+
+// Generic form of a compiled-in template, for merging
+func templateContent(response FFProbeResponse) (map[string]interface{}, error) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var content map[string]interface{}
+	err = dec.Decode(&content)
+	return content, err
+}
+
+// Turn composed content into a response, numbering streams that were
+// added by overlays and counting them in the format
+func templateResponse(content map[string]interface{}) (FFProbeResponse, error) {
+	var response FFProbeResponse
+	data, err := json.Marshal(content)
+	if err != nil {
+		return response, err
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return response, err
+	}
+
+	if streams, ok := content["streams"].([]interface{}); ok {
+		for i, stream := range streams {
+			if stream, ok := stream.(map[string]interface{}); ok {
+				if _, exists := stream["index"]; !exists {
+					response.Streams[i].Index = i
+				}
+			}
+		}
+		response.Format.NbStreams = len(response.Streams)
+	}
+	return response, nil
+}
+
+// Deterministic deep merge of an overlay into a copy of base:
+//   - objects are merged key by key, and a null removes a key
+//   - streams are merged into the base stream with the same index or, without
+//     an index, into the first base stream of the same codec_type not already
+//     merged with; other overlay streams are appended
+//   - any other value, including other lists, replaces the base value
+func mergeTemplateContent(base, overlay map[string]interface{}) map[string]interface{} {
+	merged := deepCopyValue(base).(map[string]interface{})
+
+	keys := make([]string, 0, len(overlay))
+	for key := range overlay {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := overlay[key]
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+
+		baseObject, baseIsObject := merged[key].(map[string]interface{})
+		overlayObject, overlayIsObject := value.(map[string]interface{})
+		baseList, baseIsList := merged[key].([]interface{})
+		overlayList, overlayIsList := value.([]interface{})
+
+		switch {
+		case baseIsObject && overlayIsObject:
+			merged[key] = mergeTemplateContent(baseObject, overlayObject)
+		case key == "streams" && baseIsList && overlayIsList:
+			merged[key] = mergeStreams(baseList, overlayList)
+		default:
+			merged[key] = deepCopyValue(value)
+		}
+	}
+	return merged
+}
+
+func mergeStreams(base, overlay []interface{}) []interface{} {
+	merged := deepCopyValue(base).([]interface{})
+	used := make([]bool, len(merged))
+
+	for _, item := range overlay {
+		stream, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		target := -1
+		if index, exists := stream["index"]; exists {
+			for i, candidate := range merged {
+				if candidate, ok := candidate.(map[string]interface{}); ok && fmt.Sprint(candidate["index"]) == fmt.Sprint(index) {
+					target = i
+					break
+				}
+			}
+		} else if codecType, exists := stream["codec_type"]; exists {
+			for i, candidate := range merged {
+				if candidate, ok := candidate.(map[string]interface{}); ok && i < len(used) && !used[i] && candidate["codec_type"] == codecType {
+					target = i
+					break
+				}
+			}
+		}
+
+		if target < 0 {
+			merged = append(merged, deepCopyValue(stream))
+			continue
+		}
+		if target < len(used) {
+			used[target] = true
+		}
+		merged[target] = mergeTemplateContent(merged[target].(map[string]interface{}), stream)
+	}
+	return merged
+}
+
+func deepCopyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopyValue(item)
+		}
+		return copied
+	}
+	return value
+}
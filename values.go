@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Units ffprobe attaches to values, as printed by -unit
+const (
+	unitSecond       = "s"
+	unitHertz        = "Hz"
+	unitByte         = "byte"
+	unitBitPerSecond = "bit/s"
+)
+
+// Entries that carry a unit, and are therefore subject to -unit, -prefix,
+// -byte_binary_prefix and -sexagesimal
+var VALUE_UNITS = map[string]string{
+	"start_time":   unitSecond,
+	"end_time":     unitSecond,
+	"duration":     unitSecond,
+	"sample_rate":  unitHertz,
+	"size":         unitByte,
+	"bit_rate":     unitBitPerSecond,
+	"max_bit_rate": unitBitPerSecond,
+}
+
+// SI and binary prefixes used by -prefix and -byte_binary_prefix
+var SI_PREFIXES = []struct {
+	DecValue  float64
+	DecString string
+	BinValue  float64
+	BinString string
+}{
+	{1.0, "", 1.0, ""},
+	{1e3, "K", 1024, "Ki"},
+	{1e6, "M", 1024 * 1024, "Mi"},
+	{1e9, "G", 1024 * 1024 * 1024, "Gi"},
+	{1e12, "T", 1024 * 1024 * 1024 * 1024, "Ti"},
+	{1e15, "P", 1024 * 1024 * 1024 * 1024 * 1024, "Pi"},
+}
+
+// Render the values with units of an output tree according to the
+// formatting flags, so streams, format and chapters are treated alike
+func formatOutputValues(node *outputNode, opts *ProbeOptions) {
+	if node.Def.Flags&sectionHasVariableFields == 0 {
+		for i, entry := range node.Entries {
+			unit, exists := VALUE_UNITS[entry.Key]
+			if !exists || entry.IsInt {
+				continue
+			}
+			node.Entries[i].Value = formatValue(entry.Value, unit, opts)
+		}
+	}
+
+	for _, child := range node.Children {
+		formatOutputValues(child, opts)
+	}
+}
+
+// Format a raw value (seconds, or an integer for the other units); values
+// that are not numbers, such as "N/A", are kept as they are
+func formatValue(raw, unit string, opts *ProbeOptions) string {
+	if unit == unitSecond {
+		seconds, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return raw
+		}
+		return valueString(seconds, unit, opts)
+	}
+
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return raw
+	}
+	return valueString(float64(value), unit, opts)
+}
+
+// Port of ffprobe's value_string()
+func valueString(value float64, unit string, opts *ProbeOptions) string {
+	if unit == unitSecond && opts.Sexagesimal {
+		secs := value
+		mins := int(secs) / 60
+		secs -= float64(mins * 60)
+		hours := mins / 60
+		mins %= 60
+		return fmt.Sprintf("%d:%02d:%09.6f", hours, mins, secs)
+	}
+
+	showFloat := unit == unitSecond
+	integer := int64(value)
+	prefix := ""
+
+	if opts.Prefix && value > 1 {
+		if unit == unitByte && opts.ByteBinaryPrefix {
+			index := clampPrefixIndex(int(math.Log2(value)) / 10)
+			value /= SI_PREFIXES[index].BinValue
+			prefix = SI_PREFIXES[index].BinString
+		} else {
+			index := clampPrefixIndex(int(math.Log10(value)) / 3)
+			value /= SI_PREFIXES[index].DecValue
+			prefix = SI_PREFIXES[index].DecString
+		}
+		integer = int64(value)
+	}
+
+	var s string
+	if showFloat || (opts.Prefix && value != float64(int64(value))) {
+		s = fmt.Sprintf("%f", value)
+	} else {
+		s = fmt.Sprintf("%d", integer)
+	}
+
+	if prefix != "" || opts.Unit {
+		s += " "
+	}
+	s += prefix
+	if opts.Unit {
+		s += unit
+	}
+	return s
+}
+
+func clampPrefixIndex(index int) int {
+	if index < 0 {
+		return 0
+	}
+	if index >= len(SI_PREFIXES) {
+		return len(SI_PREFIXES) - 1
+	}
+	return index
+}
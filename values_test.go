@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestValueString(t *testing.T) {
+	tests := []struct {
+		raw   string
+		unit  string
+		flags []string
+		want  string
+	}{
+		{"5400.500000", unitSecond, nil, "5400.500000"},
+		{"5400.500000", unitSecond, []string{"-sexagesimal"}, "1:30:00.500000"},
+		{"0.000000", unitSecond, []string{"-sexagesimal"}, "0:00:00.000000"},
+		{"-1.500000", unitSecond, []string{"-sexagesimal"}, "0:00:-1.500000"},
+		{"5400.500000", unitSecond, []string{"-unit"}, "5400.500000 s"},
+		{"5400.500000", unitSecond, []string{"-prefix"}, "5.400500 K"},
+		{"8000000", unitBitPerSecond, nil, "8000000"},
+		{"8000000", unitBitPerSecond, []string{"-unit"}, "8000000 bit/s"},
+		{"8000000", unitBitPerSecond, []string{"-prefix"}, "8 M"},
+		{"8000000", unitBitPerSecond, []string{"-pretty"}, "8 Mbit/s"},
+		{"640123", unitBitPerSecond, []string{"-pretty"}, "640.123000 Kbit/s"},
+		{"48000", unitHertz, []string{"-pretty"}, "48 KHz"},
+		{"1", unitHertz, []string{"-prefix"}, "1"},
+		{"5400500000", unitByte, []string{"-prefix"}, "5.400500 G"},
+		{"5400500000", unitByte, []string{"-prefix", "-byte_binary_prefix"}, "5.029608 Gi"},
+		{"5400500000", unitByte, []string{"-pretty"}, "5.029608 Gibyte"},
+		{"2048", unitByte, []string{"-pretty"}, "2 Kibyte"},
+		{"N/A", unitSecond, []string{"-pretty"}, "N/A"},
+		{"N/A", unitByte, []string{"-pretty"}, "N/A"},
+	}
+	for _, test := range tests {
+		opts, err := parseFFProbeArgs(append(test.flags, "movie.mkv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatValue(test.raw, test.unit, opts); got != test.want {
+			t.Errorf("%s %s with %v = %q, want %q", test.raw, test.unit, test.flags, got, test.want)
+		}
+	}
+}
+
+func TestPrettyOutput(t *testing.T) {
+	got := probeOutput(t, "-of", "compact", "-pretty", "-show_entries",
+		"stream=index,sample_rate,bit_rate,duration:stream_tags=:format=duration,size,bit_rate,probe_score:chapter=start,start_time,end_time")
+	want := "program|stream|index=0\n\n" +
+		"stream|index=0|duration=1:30:00.500000|bit_rate=8 Mbit/s\n" +
+		"stream|index=1|sample_rate=48 KHz|bit_rate=640 Kbit/s\n" +
+		"stream|index=2\n" +
+		"chapter|start=0|start_time=0:00:00.000000|end_time=0:10:00.000000\n" +
+		"format|duration=1:30:00.500000|size=5.029608 Gibyte|bit_rate=8 Mbit/s|probe_score=100\n"
+	if got != want {
+		t.Errorf("-pretty printed\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long to wait for an input file that does not exist yet; 0 disables waiting
+var FILE_WAIT = envDuration("FFPROBE_SHIM_WAIT", 30*time.Second)
+
+// Waits for files under particular directories, as a comma-separated list of
+// prefix=duration pairs such as "/mnt/zurg=2m,/media/local=0"; the longest
+// matching prefix wins over FILE_WAIT
+var FILE_WAIT_PATHS = parseWaitOverrides(envOrDefault("FFPROBE_SHIM_WAIT_PATHS", ""))
+
+// How often the file is looked for again when no event announces it
+const filePollInterval = time.Second
+
+// waitOverride is the wait for files under a path prefix
+type waitOverride struct {
+	Prefix string
+	Wait   time.Duration
+}
+
+// Parse FFPROBE_SHIM_WAIT_PATHS, longest prefixes first
+func parseWaitOverrides(spec string) []waitOverride {
+	var overrides []waitOverride
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, value, found := strings.Cut(part, "=")
+		wait, err := time.ParseDuration(value)
+		if !found || prefix == "" || err != nil {
+			configWarnings = append(configWarnings, "Ignoring invalid FFPROBE_SHIM_WAIT_PATHS entry "+part)
+			continue
+		}
+		overrides = append(overrides, waitOverride{Prefix: filepath.Clean(prefix), Wait: wait})
+	}
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return len(overrides[i].Prefix) > len(overrides[j].Prefix)
+	})
+	return overrides
+}
+
+// How long to wait for a file to appear
+func fileWaitFor(path string) time.Duration {
+	for _, override := range FILE_WAIT_PATHS {
+		if hasPathPrefix(path, override.Prefix) {
+			return override.Wait
+		}
+	}
+	return FILE_WAIT
+}
+
+// fileWatcher wakes a waiting caller when a file may have appeared
+type fileWatcher interface {
+	// Return after an event in the watched directory, or after the timeout
+	wait(timeout time.Duration)
+	close()
+}
+
+// Watcher for when no events are available: it only sleeps
+type pollingWatcher struct{}
+
+func (pollingWatcher) wait(timeout time.Duration) { time.Sleep(timeout) }
+func (pollingWatcher) close()                     {}
+
+// Wait for the input file to become available, and check that it can be
+// read. Only a missing file is waited for; the error returned is the one
+// ffprobe would have run into.
+func waitForInputFile(inputFile string) (os.FileInfo, error) {
+	maxWait := fileWaitFor(inputFile)
+	start := time.Now()
+
+	var watcher fileWatcher
+	defer func() {
+		if watcher != nil {
+			watcher.close()
+		}
+	}()
+
+	for {
+		fileInfo, err := checkInputFile(inputFile)
+		if err == nil {
+			if watcher != nil {
+				log.Printf("File %s appeared after %s", inputFile, time.Since(start).Round(time.Millisecond))
+			}
+			return fileInfo, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		remaining := maxWait - time.Since(start)
+		if remaining <= 0 {
+			log.Printf("File %s did not become available within %s", inputFile, maxWait)
+			return nil, err
+		}
+
+		if watcher == nil {
+			log.Printf("File does not exist: %s, waiting up to %s", inputFile, maxWait)
+			// Events do not cover everything, such as files showing up on
+			// network mounts, so the file is still looked for regularly
+			watcher = newFileWatcher(filepath.Dir(inputFile))
+		}
+		watcher.wait(min(remaining, filePollInterval))
+	}
+}
+
+// Check that an input file exists and can be opened
+func checkInputFile(inputFile string) (os.FileInfo, error) {
+	fileInfo, err := os.Stat(inputFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("File cannot be accessed: %s, error: %v", inputFile, err)
+		}
+		return nil, err
+	}
+	if fileInfo.IsDir() {
+		log.Printf("Argument is a directory, not a file: %s", inputFile)
+		return nil, syscall.EISDIR
+	}
+
+	file, err := os.Open(inputFile)
+	if err != nil {
+		log.Printf("File cannot be opened: %s, error: %v", inputFile, err)
+		return nil, err
+	}
+	file.Close()
+	log.Printf("Detected input file: %s", inputFile)
+	return fileInfo, nil
+}
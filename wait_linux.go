@@ -0,0 +1,47 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Watcher woken by inotify events in the directory of the awaited file
+type inotifyWatcher struct {
+	file *os.File
+	buf  []byte
+}
+
+// Watch a directory with inotify, or fall back to polling if that fails,
+// for instance because the directory does not exist yet
+func newFileWatcher(dir string) fileWatcher {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		log.Printf("Cannot use inotify, polling instead: %v", err)
+		return pollingWatcher{}
+	}
+	mask := uint32(syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		log.Printf("Cannot watch %s, polling instead: %v", dir, err)
+		return pollingWatcher{}
+	}
+	return &inotifyWatcher{file: os.NewFile(uintptr(fd), "inotify"), buf: make([]byte, 4096)}
+}
+
+func (w *inotifyWatcher) wait(timeout time.Duration) {
+	if err := w.file.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		time.Sleep(timeout)
+		return
+	}
+	// Any event in the directory is a reason to look again, so the events
+	// themselves are not decoded
+	w.file.Read(w.buf)
+}
+
+func (w *inotifyWatcher) close() {
+	w.file.Close()
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Without inotify the file is polled for
+func newFileWatcher(dir string) fileWatcher {
+	return pollingWatcher{}
+}
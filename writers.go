@@ -0,0 +1,816 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const maxSectionLevels = 10
+
+// writerContext tracks the position in the output tree while writing,
+// like ffprobe's WriterContext
+type writerContext struct {
+	out      *bufio.Writer
+	level    int
+	sections [maxSectionLevels]*sectionDef
+	nbItem   [maxSectionLevels]int // entries and subsections printed so far at each level
+	prefix   [maxSectionLevels]string
+}
+
+// outputWriter renders sections and entries in one output format
+type outputWriter interface {
+	printSectionHeader(wctx *writerContext)
+	printSectionFooter(wctx *writerContext)
+	printString(wctx *writerContext, key, value string)
+	printInt(wctx *writerContext, key string, value int64)
+}
+
+// Writer constructors by name, taking the writer sub-options
+var WRITERS = map[string]func(options map[string]string) (outputWriter, error){
+	"default": newDefaultWriter,
+	"compact": newCompactWriter,
+	"csv":     newCSVWriter,
+	"flat":    newFlatWriter,
+	"ini":     newINIWriter,
+	"json":    newJSONWriter,
+	"xml":     newXMLWriter,
+}
+
+// Create the writer selected with -print_format
+func newOutputWriter(opts *ProbeOptions) (outputWriter, error) {
+	constructor, exists := WRITERS[opts.Writer]
+	if !exists {
+		return nil, fmt.Errorf("Unknown output format with name '%s'", opts.Writer)
+	}
+	writer, err := constructor(opts.WriterOptions)
+	if err != nil {
+		return nil, err
+	}
+	if xml, ok := writer.(*xmlWriter); ok && xml.xsdStrict {
+		if err := checkXSDCompliance(opts); err != nil {
+			return nil, err
+		}
+	}
+	return writer, nil
+}
+
+// Walk an output tree, calling the writer for every section and entry
+func writeOutputTree(w io.Writer, writer outputWriter, root *outputNode) error {
+	wctx := &writerContext{out: bufio.NewWriter(w), level: -1}
+	writeNode(wctx, writer, root)
+	return wctx.out.Flush()
+}
+
+func writeNode(wctx *writerContext, writer outputWriter, node *outputNode) {
+	wctx.level++
+	wctx.sections[wctx.level] = node.Def
+	wctx.nbItem[wctx.level] = 0
+	writer.printSectionHeader(wctx)
+
+	for _, entry := range node.Entries {
+		if entry.IsInt {
+			writer.printInt(wctx, entry.Key, entry.IntValue)
+		} else {
+			writer.printString(wctx, entry.Key, entry.Value)
+		}
+		wctx.nbItem[wctx.level]++
+	}
+
+	for _, child := range node.Children {
+		writeNode(wctx, writer, child)
+	}
+
+	if wctx.level > 0 {
+		wctx.nbItem[wctx.level-1]++
+	}
+	writer.printSectionFooter(wctx)
+	wctx.level--
+}
+
+func (wctx *writerContext) section() *sectionDef {
+	return wctx.sections[wctx.level]
+}
+
+func (wctx *writerContext) parent() *sectionDef {
+	if wctx.level == 0 {
+		return nil
+	}
+	return wctx.sections[wctx.level-1]
+}
+
+func (wctx *writerContext) printf(format string, args ...interface{}) {
+	fmt.Fprintf(wctx.out, format, args...)
+}
+
+func isWrapperOrArray(def *sectionDef) bool {
+	return def != nil && def.Flags&(sectionIsWrapper|sectionIsArray) != 0
+}
+
+// Parse the sub-options of a writer; aliases maps short names to long ones
+func parseWriterOptions(options map[string]string, aliases map[string]string, defaults map[string]string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for key, value := range defaults {
+		parsed[key] = value
+	}
+	for key, value := range options {
+		if long, exists := aliases[key]; exists {
+			key = long
+		}
+		if _, exists := defaults[key]; !exists {
+			return nil, fmt.Errorf("Failed to set option '%s' with value '%s' provided to writer context", key, value)
+		}
+		parsed[key] = value
+	}
+	return parsed, nil
+}
+
+// Interpret a boolean writer option value the way AVOptions do
+func writerBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "true", "y", "yes", "enable", "enabled", "on":
+		return true, nil
+	case "0", "false", "n", "no", "disable", "disabled", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("Unable to parse option value \"%s\" as boolean", value)
+}
+
+func writerBools(options map[string]string, keys ...string) (map[string]bool, error) {
+	values := map[string]bool{}
+	for _, key := range keys {
+		value, err := writerBool(options[key])
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func singleChar(value string) (byte, error) {
+	if len(value) != 1 {
+		return 0, fmt.Errorf("Item separator '%s' specified, but must contain a single character", value)
+	}
+	return value[0], nil
+}
+
+// Default output format: INI-like sections with [SECTION] wrappers
+
+type defaultWriter struct {
+	noprintWrappers bool
+	nokey           bool
+	nested          [maxSectionLevels]bool
+}
+
+func newDefaultWriter(options map[string]string) (outputWriter, error) {
+	parsed, err := parseWriterOptions(options,
+		map[string]string{"nw": "noprint_wrappers", "nk": "nokey"},
+		map[string]string{"noprint_wrappers": "0", "nokey": "0"})
+	if err != nil {
+		return nil, err
+	}
+	bools, err := writerBools(parsed, "noprint_wrappers", "nokey")
+	if err != nil {
+		return nil, err
+	}
+	return &defaultWriter{noprintWrappers: bools["noprint_wrappers"], nokey: bools["nokey"]}, nil
+}
+
+func (w *defaultWriter) printSectionHeader(wctx *writerContext) {
+	section := wctx.section()
+	parent := wctx.parent()
+
+	wctx.prefix[wctx.level] = ""
+	w.nested[wctx.level] = parent != nil && !isWrapperOrArray(parent)
+	if w.nested[wctx.level] {
+		name := section.ElementName
+		if name == "" {
+			name = section.Name
+		}
+		wctx.prefix[wctx.level] = wctx.prefix[wctx.level-1] + strings.ToUpper(name) + ":"
+	}
+
+	if w.noprintWrappers || w.nested[wctx.level] {
+		return
+	}
+	if !isWrapperOrArray(section) {
+		wctx.printf("[%s]\n", strings.ToUpper(section.Name))
+	}
+}
+
+func (w *defaultWriter) printSectionFooter(wctx *writerContext) {
+	if w.noprintWrappers || w.nested[wctx.level] {
+		return
+	}
+	if section := wctx.section(); !isWrapperOrArray(section) {
+		wctx.printf("[/%s]\n", strings.ToUpper(section.Name))
+	}
+}
+
+func (w *defaultWriter) printString(wctx *writerContext, key, value string) {
+	if !w.nokey {
+		wctx.printf("%s%s=", wctx.prefix[wctx.level], key)
+	}
+	wctx.printf("%s\n", value)
+}
+
+func (w *defaultWriter) printInt(wctx *writerContext, key string, value int64) {
+	if !w.nokey {
+		wctx.printf("%s%s=", wctx.prefix[wctx.level], key)
+	}
+	wctx.printf("%d\n", value)
+}
+
+// Compact and CSV output formats: one line per section
+
+type compactWriter struct {
+	itemSep      byte
+	nokey        bool
+	printSection bool
+	escape       func(s string, sep byte) string
+	nested       [maxSectionLevels]bool
+}
+
+func newCompactWriter(options map[string]string) (outputWriter, error) {
+	return newCompactWriterWithDefaults(options, map[string]string{
+		"item_sep": "|", "nokey": "0", "escape": "c", "print_section": "1",
+	})
+}
+
+func newCSVWriter(options map[string]string) (outputWriter, error) {
+	return newCompactWriterWithDefaults(options, map[string]string{
+		"item_sep": ",", "nokey": "1", "escape": "csv", "print_section": "1",
+	})
+}
+
+func newCompactWriterWithDefaults(options map[string]string, defaults map[string]string) (outputWriter, error) {
+	parsed, err := parseWriterOptions(options,
+		map[string]string{"s": "item_sep", "nk": "nokey", "e": "escape", "p": "print_section"},
+		defaults)
+	if err != nil {
+		return nil, err
+	}
+	bools, err := writerBools(parsed, "nokey", "print_section")
+	if err != nil {
+		return nil, err
+	}
+	sep, err := singleChar(parsed["item_sep"])
+	if err != nil {
+		return nil, err
+	}
+
+	w := &compactWriter{itemSep: sep, nokey: bools["nokey"], printSection: bools["print_section"]}
+	switch parsed["escape"] {
+	case "c":
+		w.escape = cEscape
+	case "csv":
+		w.escape = csvEscape
+	case "none":
+		w.escape = func(s string, sep byte) string { return s }
+	default:
+		return nil, fmt.Errorf("Unknown escape mode '%s'", parsed["escape"])
+	}
+	return w, nil
+}
+
+func (w *compactWriter) printSectionHeader(wctx *writerContext) {
+	section := wctx.section()
+	parent := wctx.parent()
+
+	wctx.prefix[wctx.level] = ""
+	w.nested[wctx.level] = parent != nil && section.Flags&sectionIsArray == 0 && !isWrapperOrArray(parent)
+	if w.nested[wctx.level] {
+		// Elements not contained in an array or a wrapper are printed
+		// inline, with a prefix
+		name := section.ElementName
+		if name == "" {
+			name = section.Name
+		}
+		wctx.prefix[wctx.level] = wctx.prefix[wctx.level-1] + name + ":"
+		wctx.nbItem[wctx.level] = wctx.nbItem[wctx.level-1]
+		return
+	}
+
+	if parent != nil && !isWrapperOrArray(parent) && wctx.nbItem[wctx.level-1] > 0 {
+		wctx.out.WriteByte(w.itemSep)
+	}
+	if w.printSection && !isWrapperOrArray(section) {
+		wctx.printf("%s%c", section.Name, w.itemSep)
+	}
+}
+
+func (w *compactWriter) printSectionFooter(wctx *writerContext) {
+	if !w.nested[wctx.level] && !isWrapperOrArray(wctx.section()) {
+		wctx.out.WriteByte('\n')
+	}
+}
+
+func (w *compactWriter) printString(wctx *writerContext, key, value string) {
+	if wctx.nbItem[wctx.level] > 0 {
+		wctx.out.WriteByte(w.itemSep)
+	}
+	if !w.nokey {
+		wctx.printf("%s%s=", wctx.prefix[wctx.level], key)
+	}
+	wctx.out.WriteString(w.escape(value, w.itemSep))
+}
+
+func (w *compactWriter) printInt(wctx *writerContext, key string, value int64) {
+	if wctx.nbItem[wctx.level] > 0 {
+		wctx.out.WriteByte(w.itemSep)
+	}
+	if !w.nokey {
+		wctx.printf("%s%s=", wctx.prefix[wctx.level], key)
+	}
+	wctx.printf("%d", value)
+}
+
+// Escape a value C-style, also escaping the item separator
+func cEscape(s string, sep byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\\':
+			b.WriteString(`\\`)
+		default:
+			if c == sep {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Quote a value as a CSV field when it contains special characters
+func csvEscape(s string, sep byte) string {
+	if !strings.ContainsAny(s, string([]byte{sep, '"', '\n', '\r'})) {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// Flat output format: one shell-friendly key=value line per entry
+
+type flatWriter struct {
+	sepChar      byte
+	hierarchical bool
+}
+
+func newFlatWriter(options map[string]string) (outputWriter, error) {
+	parsed, err := parseWriterOptions(options,
+		map[string]string{"s": "sep_char", "h": "hierarchical"},
+		map[string]string{"sep_char": ".", "hierarchical": "1"})
+	if err != nil {
+		return nil, err
+	}
+	bools, err := writerBools(parsed, "hierarchical")
+	if err != nil {
+		return nil, err
+	}
+	sep, err := singleChar(parsed["sep_char"])
+	if err != nil {
+		return nil, err
+	}
+	return &flatWriter{sepChar: sep, hierarchical: bools["hierarchical"]}, nil
+}
+
+func (w *flatWriter) printSectionHeader(wctx *writerContext) {
+	parent := wctx.parent()
+	wctx.prefix[wctx.level] = ""
+	if parent == nil {
+		return
+	}
+
+	prefix := wctx.prefix[wctx.level-1]
+	// Without hierarchy arrays and tags leave no trace in the keys
+	if w.hierarchical || wctx.section().Flags&(sectionIsArray|sectionHasVariableFields) == 0 {
+		prefix += wctx.section().Name + string(w.sepChar)
+		if parent.Flags&sectionIsArray != 0 {
+			prefix += fmt.Sprintf("%d%c", wctx.nbItem[wctx.level-1], w.sepChar)
+		}
+	}
+	wctx.prefix[wctx.level] = prefix
+}
+
+func (w *flatWriter) printSectionFooter(wctx *writerContext) {}
+
+func (w *flatWriter) printString(wctx *writerContext, key, value string) {
+	wctx.printf("%s%s=\"%s\"\n", wctx.prefix[wctx.level], flatEscapeKey(key), flatEscapeValue(value))
+}
+
+func (w *flatWriter) printInt(wctx *writerContext, key string, value int64) {
+	wctx.printf("%s%s=%d\n", wctx.prefix[wctx.level], key, value)
+}
+
+func flatEscapeKey(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func flatEscapeValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '`':
+			b.WriteString("\\`")
+		case '$':
+			b.WriteString(`\$`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// INI output format
+
+type iniWriter struct {
+	hierarchical bool
+}
+
+func newINIWriter(options map[string]string) (outputWriter, error) {
+	parsed, err := parseWriterOptions(options,
+		map[string]string{"h": "hierarchical"},
+		map[string]string{"hierarchical": "1"})
+	if err != nil {
+		return nil, err
+	}
+	bools, err := writerBools(parsed, "hierarchical")
+	if err != nil {
+		return nil, err
+	}
+	return &iniWriter{hierarchical: bools["hierarchical"]}, nil
+}
+
+func (w *iniWriter) printSectionHeader(wctx *writerContext) {
+	section := wctx.section()
+	parent := wctx.parent()
+	wctx.prefix[wctx.level] = ""
+	if parent == nil {
+		wctx.printf("# ffprobe output\n\n")
+		return
+	}
+
+	if wctx.nbItem[wctx.level-1] > 0 {
+		wctx.out.WriteByte('\n')
+	}
+
+	prefix := wctx.prefix[wctx.level-1]
+	if w.hierarchical || section.Flags&(sectionIsArray|sectionHasVariableFields) == 0 {
+		if prefix != "" {
+			prefix += "."
+		}
+		prefix += section.Name
+		if parent.Flags&sectionIsArray != 0 {
+			prefix += fmt.Sprintf(".%d", wctx.nbItem[wctx.level-1])
+		}
+	}
+	wctx.prefix[wctx.level] = prefix
+
+	if !isWrapperOrArray(section) {
+		wctx.printf("[%s]\n", prefix)
+	}
+}
+
+func (w *iniWriter) printSectionFooter(wctx *writerContext) {}
+
+func (w *iniWriter) printString(wctx *writerContext, key, value string) {
+	wctx.printf("%s=%s\n", iniEscape(key), iniEscape(value))
+}
+
+func (w *iniWriter) printInt(wctx *writerContext, key string, value int64) {
+	wctx.printf("%s=%d\n", key, value)
+}
+
+func iniEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\\', '#', '=', ';':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			if c < 32 {
+				fmt.Fprintf(&b, "\\x00%02x", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// JSON output format
+
+type jsonWriter struct {
+	compact      bool
+	itemSep      string
+	itemStartEnd string
+	indentLevel  int
+}
+
+func newJSONWriter(options map[string]string) (outputWriter, error) {
+	parsed, err := parseWriterOptions(options,
+		map[string]string{"c": "compact"},
+		map[string]string{"compact": "0"})
+	if err != nil {
+		return nil, err
+	}
+	bools, err := writerBools(parsed, "compact")
+	if err != nil {
+		return nil, err
+	}
+	w := &jsonWriter{compact: bools["compact"], itemSep: ",\n", itemStartEnd: "\n"}
+	if w.compact {
+		w.itemSep, w.itemStartEnd = ", ", " "
+	}
+	return w, nil
+}
+
+func (w *jsonWriter) indent(wctx *writerContext) {
+	wctx.out.WriteString(strings.Repeat(" ", w.indentLevel*4))
+}
+
+func (w *jsonWriter) printSectionHeader(wctx *writerContext) {
+	section := wctx.section()
+	parent := wctx.parent()
+
+	if wctx.level > 0 && wctx.nbItem[wctx.level-1] > 0 {
+		wctx.out.WriteString(",\n")
+	}
+
+	if section.Flags&sectionIsWrapper != 0 {
+		wctx.out.WriteString("{\n")
+		w.indentLevel++
+		return
+	}
+
+	w.indent(wctx)
+	w.indentLevel++
+	switch {
+	case section.Flags&sectionIsArray != 0:
+		wctx.printf("\"%s\": [\n", jsonEscape(section.Name))
+	case parent != nil && parent.Flags&sectionIsArray == 0:
+		wctx.printf("\"%s\": {%s", jsonEscape(section.Name), w.itemStartEnd)
+	default:
+		wctx.printf("{%s", w.itemStartEnd)
+	}
+}
+
+func (w *jsonWriter) printSectionFooter(wctx *writerContext) {
+	section := wctx.section()
+
+	switch {
+	case wctx.level == 0:
+		w.indentLevel--
+		wctx.out.WriteString("\n}\n")
+	case section.Flags&sectionIsArray != 0:
+		wctx.out.WriteByte('\n')
+		w.indentLevel--
+		w.indent(wctx)
+		wctx.out.WriteByte(']')
+	default:
+		wctx.out.WriteString(w.itemStartEnd)
+		w.indentLevel--
+		if !w.compact {
+			w.indent(wctx)
+		}
+		wctx.out.WriteByte('}')
+	}
+}
+
+func (w *jsonWriter) printItemPrefix(wctx *writerContext) {
+	if wctx.nbItem[wctx.level] > 0 {
+		wctx.out.WriteString(w.itemSep)
+	}
+	if !w.compact {
+		w.indent(wctx)
+	}
+}
+
+func (w *jsonWriter) printString(wctx *writerContext, key, value string) {
+	w.printItemPrefix(wctx)
+	wctx.printf("\"%s\": \"%s\"", jsonEscape(key), jsonEscape(value))
+}
+
+func (w *jsonWriter) printInt(wctx *writerContext, key string, value int64) {
+	w.printItemPrefix(wctx)
+	wctx.printf("\"%s\": %d", jsonEscape(key), value)
+}
+
+func jsonEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < 32 {
+				fmt.Fprintf(&b, "\\u00%02x", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// XML output format
+
+type xmlWriter struct {
+	fullyQualified bool
+	xsdStrict      bool
+	withinTag      bool
+	indentLevel    int
+}
+
+func newXMLWriter(options map[string]string) (outputWriter, error) {
+	parsed, err := parseWriterOptions(options,
+		map[string]string{"q": "fully_qualified", "x": "xsd_strict"},
+		map[string]string{"fully_qualified": "0", "xsd_strict": "0"})
+	if err != nil {
+		return nil, err
+	}
+	bools, err := writerBools(parsed, "fully_qualified", "xsd_strict")
+	if err != nil {
+		return nil, err
+	}
+	w := &xmlWriter{fullyQualified: bools["fully_qualified"], xsdStrict: bools["xsd_strict"]}
+	if w.xsdStrict {
+		w.fullyQualified = true
+	}
+	return w, nil
+}
+
+// Options that make the XML output violate the ffprobe schema
+func checkXSDCompliance(opts *ProbeOptions) error {
+	for _, check := range []struct {
+		enabled bool
+		name    string
+	}{
+		{opts.ShowPrivateData, "private"},
+		{opts.Unit, "unit"},
+		{opts.Prefix, "prefix"},
+	} {
+		if check.enabled {
+			return fmt.Errorf("XSD-compliant output selected but option '%s' was selected, XML output may be non-compliant.\nYou need to disable such option with '-no%s'", check.name, check.name)
+		}
+	}
+	return nil
+}
+
+func (w *xmlWriter) indent(wctx *writerContext) {
+	wctx.out.WriteString(strings.Repeat(" ", w.indentLevel*4))
+}
+
+func (w *xmlWriter) printSectionHeader(wctx *writerContext) {
+	section := wctx.section()
+	parent := wctx.parent()
+
+	if wctx.level == 0 {
+		qualifier, attributes := "", ""
+		if w.fullyQualified {
+			qualifier = "ffprobe:"
+			attributes = " xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\" " +
+				"xmlns:ffprobe=\"http://www.ffmpeg.org/schema/ffprobe\" " +
+				"xsi:schemaLocation=\"http://www.ffmpeg.org/schema/ffprobe ffprobe.xsd\""
+		}
+		wctx.out.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+		wctx.printf("<%sffprobe%s>\n", qualifier, attributes)
+		return
+	}
+
+	if w.withinTag {
+		w.withinTag = false
+		wctx.out.WriteString(">\n")
+	}
+
+	if parent != nil && parent.Flags&sectionIsWrapper != 0 && wctx.nbItem[wctx.level-1] > 0 {
+		wctx.out.WriteByte('\n')
+	}
+	w.indentLevel++
+
+	w.indent(wctx)
+	if section.Flags&(sectionIsArray|sectionHasVariableFields) != 0 {
+		wctx.printf("<%s>\n", section.Name)
+	} else {
+		wctx.printf("<%s ", section.Name)
+		w.withinTag = true
+	}
+}
+
+func (w *xmlWriter) printSectionFooter(wctx *writerContext) {
+	section := wctx.section()
+
+	switch {
+	case wctx.level == 0:
+		qualifier := ""
+		if w.fullyQualified {
+			qualifier = "ffprobe:"
+		}
+		wctx.printf("</%sffprobe>\n", qualifier)
+	case w.withinTag:
+		w.withinTag = false
+		wctx.out.WriteString("/>\n")
+		w.indentLevel--
+	default:
+		w.indent(wctx)
+		wctx.printf("</%s>\n", section.Name)
+		w.indentLevel--
+	}
+}
+
+func (w *xmlWriter) printValue(wctx *writerContext, key, value string) {
+	section := wctx.section()
+
+	if section.Flags&sectionHasVariableFields != 0 {
+		w.indentLevel++
+		w.indent(wctx)
+		wctx.printf("<%s key=\"%s\" value=\"%s\"/>\n", section.ElementName, xmlEscape(key), xmlEscape(value))
+		w.indentLevel--
+		return
+	}
+
+	if wctx.nbItem[wctx.level] > 0 {
+		wctx.out.WriteByte(' ')
+	}
+	wctx.printf("%s=\"%s\"", key, xmlEscape(value))
+}
+
+func (w *xmlWriter) printString(wctx *writerContext, key, value string) {
+	w.printValue(wctx, key, value)
+}
+
+func (w *xmlWriter) printInt(wctx *writerContext, key string, value int64) {
+	w.printValue(wctx, key, fmt.Sprintf("%d", value))
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '&':
+			b.WriteString("&amp;")
+		case '"':
+			b.WriteString("&quot;")
+		case '\'':
+			b.WriteString("&apos;")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the output tests")
+
+// Compare output with a file under testdata, or rewrite it with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s:\n%s", path, got)
+	}
+}
+
+func TestWritersGolden(t *testing.T) {
+	for name := range WRITERS {
+		t.Run(name, func(t *testing.T) {
+			got := probeOutput(t, "-of", name, "-show_programs", "-show_streams", "-show_chapters", "-show_format")
+			checkGolden(t, filepath.Join("writers", name+".golden"), got)
+		})
+	}
+}
+
+func TestWriterOptions(t *testing.T) {
+	// "stream" also selects the streams of the program, as in ffprobe
+	entries := []string{"-show_entries", "stream=index,codec_type:stream_tags=language:format=format_name"}
+	tests := []struct {
+		writer string
+		want   string
+	}{
+		{"default=nw=1", "index=0\ncodec_type=video\nindex=0\ncodec_type=video\nTAG:language=eng\nindex=1\ncodec_type=audio\nTAG:language=ger\nindex=2\ncodec_type=subtitle\nTAG:language=eng\nformat_name=matroska,webm\n"},
+		{"default=nw=1:nk=1", "0\nvideo\n0\nvideo\neng\n1\naudio\nger\n2\nsubtitle\neng\nmatroska,webm\n"},
+		{"compact=nk=1:p=0", "0|video\n\n0|video|eng\n1|audio|ger\n2|subtitle|eng\nmatroska,webm\n"},
+		{"compact=s=;", "program;stream;index=0;codec_type=video\n\nstream;index=0;codec_type=video;tag:language=eng\nstream;index=1;codec_type=audio;tag:language=ger\nstream;index=2;codec_type=subtitle;tag:language=eng\nformat;format_name=matroska,webm\n"},
+		{"csv=p=0", "0,video\n\n0,video,eng\n1,audio,ger\n2,subtitle,eng\n\"matroska,webm\"\n"},
+		{"flat=s=_", "programs_program_0_streams_stream_0_index=0\nprograms_program_0_streams_stream_0_codec_type=\"video\"\nstreams_stream_0_index=0\nstreams_stream_0_codec_type=\"video\"\nstreams_stream_0_tags_language=\"eng\"\nstreams_stream_1_index=1\nstreams_stream_1_codec_type=\"audio\"\nstreams_stream_1_tags_language=\"ger\"\nstreams_stream_2_index=2\nstreams_stream_2_codec_type=\"subtitle\"\nstreams_stream_2_tags_language=\"eng\"\nformat_format_name=\"matroska,webm\"\n"},
+		{"flat=h=0", "program.0.stream.0.index=0\nprogram.0.stream.0.codec_type=\"video\"\nstream.0.index=0\nstream.0.codec_type=\"video\"\nstream.0.language=\"eng\"\nstream.1.index=1\nstream.1.codec_type=\"audio\"\nstream.1.language=\"ger\"\nstream.2.index=2\nstream.2.codec_type=\"subtitle\"\nstream.2.language=\"eng\"\nformat.format_name=\"matroska,webm\"\n"},
+		{"json=c=1", "{\n    \"programs\": [\n        {             \"streams\": [\n                { \"index\": 0, \"codec_type\": \"video\" }\n            ] }\n    ],\n    \"streams\": [\n        { \"index\": 0, \"codec_type\": \"video\",\n            \"tags\": { \"language\": \"eng\" } },\n        { \"index\": 1, \"codec_type\": \"audio\",\n            \"tags\": { \"language\": \"ger\" } },\n        { \"index\": 2, \"codec_type\": \"subtitle\",\n            \"tags\": { \"language\": \"eng\" } }\n    ],\n    \"format\": { \"format_name\": \"matroska,webm\" }\n}\n"},
+		{"xml=q=1", "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<ffprobe:ffprobe xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\" xmlns:ffprobe=\"http://www.ffmpeg.org/schema/ffprobe\" xsi:schemaLocation=\"http://www.ffmpeg.org/schema/ffprobe ffprobe.xsd\">\n    <programs>\n        <program >\n            <streams>\n                <stream index=\"0\" codec_type=\"video\"/>\n            </streams>\n        </program>\n    </programs>\n\n    <streams>\n        <stream index=\"0\" codec_type=\"video\">\n            <tags>\n                <tag key=\"language\" value=\"eng\"/>\n            </tags>\n        </stream>\n        <stream index=\"1\" codec_type=\"audio\">\n            <tags>\n                <tag key=\"language\" value=\"ger\"/>\n            </tags>\n        </stream>\n        <stream index=\"2\" codec_type=\"subtitle\">\n            <tags>\n                <tag key=\"language\" value=\"eng\"/>\n            </tags>\n        </stream>\n    </streams>\n\n    <format format_name=\"matroska,webm\"/>\n</ffprobe:ffprobe>\n"},
+	}
+	for _, test := range tests {
+		args := append([]string{"-of", test.writer}, entries...)
+		if got := probeOutput(t, args...); got != test.want {
+			t.Errorf("-of %s printed\n%s\nwant\n%s", test.writer, got, test.want)
+		}
+	}
+}
+
+func TestWriterEscaping(t *testing.T) {
+	tests := []struct {
+		name   string
+		escape func(string) string
+		in     string
+		want   string
+	}{
+		{"compact", func(s string) string { return cEscape(s, '|') }, "a|b\\c\nd", `a\|b\\c\nd`},
+		{"csv", func(s string) string { return csvEscape(s, ',') }, `say "hi", bye`, `"say ""hi"", bye"`},
+		{"csv plain", func(s string) string { return csvEscape(s, ',') }, "plain", "plain"},
+		{"flat key", flatEscapeKey, "BPS-eng", "BPS_eng"},
+		{"flat value", flatEscapeValue, "a \"b\" $c `d` \\e", "a \\\"b\\\" \\$c \\`d\\` \\\\e"},
+		{"ini", iniEscape, "a=b;c#d\n", `a\=b\;c\#d\n`},
+		{"json", jsonEscape, "a\"b\\c\n\t\x01", `a\"b\\c\n\t\u0001`},
+	}
+	for _, test := range tests {
+		if got := test.escape(test.in); got != test.want {
+			t.Errorf("%s escape of %q = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestUnknownWriter(t *testing.T) {
+	opts, err := parseFFProbeArgs([]string{"-of", "yaml", "movie.mkv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newOutputWriter(opts); err == nil {
+		t.Error("an unknown writer was accepted")
+	}
+}